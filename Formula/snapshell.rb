@@ -8,6 +8,8 @@ class Snapshell < Formula
   depends_on "go" => :build
   depends_on "pkg-config" => :build
   depends_on "opencv"
+  depends_on "opus"
+  depends_on "opusfile"
 
   def install
     ENV["CGO_ENABLED"] = "1"
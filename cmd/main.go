@@ -4,10 +4,18 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
+	"net/url"
 	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
 
+	"github.com/saswatsam786/snapshell/internal/doctor"
+	"github.com/saswatsam786/snapshell/internal/render"
+	sig "github.com/saswatsam786/snapshell/internal/signal"
 	"github.com/saswatsam786/snapshell/internal/webrtc"
 )
 
@@ -20,31 +28,283 @@ func getDefaultServer() string {
 	return "http://localhost:8080"
 }
 
+// runSend implements "snapshell send [flags] <path>"
+func runSend(args []string) {
+	fs := flag.NewFlagSet("send", flag.ExitOnError)
+	server := fs.String("server", getDefaultServer(), "Signaling server base URL")
+	room := fs.String("room", "", "Meeting ID (room)")
+	clientID := fs.String("id", "", "Client ID (optional; random if empty)")
+	password := fs.String("password", "", "Room password, if the room has one")
+	token := fs.String("token", "", "Invite token for a room with a password")
+	fs.Parse(args)
+
+	if *room == "" || fs.NArg() != 1 {
+		fmt.Println("Usage: snapshell send --room <id> [--server <url>] [--id <client>] <path>")
+		os.Exit(1)
+	}
+	webrtc.RunSendFile(*server, *room, *clientID, fs.Arg(0), sig.Credentials{Password: *password, Token: *token})
+}
+
+// runInvite implements "snapshell invite --room <id> [--password <pw>] [--ttl 24h]":
+// it prints the commands and link that join the room with an invite token
+func runInvite(args []string) {
+	fs := flag.NewFlagSet("invite", flag.ExitOnError)
+	server := fs.String("server", getDefaultServer(), "Signaling server base URL")
+	room := fs.String("room", "", "Meeting ID (room)")
+	password := fs.String("password", "", "Room password, if the room has one")
+	valid := fs.Duration("ttl", 24*time.Hour, "How long the invite works (at most 168h)")
+	fs.Parse(args)
+
+	if *room == "" {
+		fmt.Println("Usage: snapshell invite --room <id> [--server <url>] [--password <pw>] [--ttl 24h]")
+		os.Exit(1)
+	}
+	base := strings.TrimRight(*server, "/")
+	c := sig.New(base, *room, "")
+	c.Creds.Password = *password
+	token, expires, err := c.Invite(*valid)
+	if err != nil {
+		fmt.Println("❌ Invite failed:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("✉️  Invite to room %s, valid until %s\n\n", *room, expires.Local().Format("Jan 2 15:04"))
+	fmt.Printf("  snapshell join %s --token %s --server %s\n", *room, token, base)
+	fmt.Printf("  snapshell -mesh --room %s --token %s --server %s    # group rooms\n", *room, token, base)
+	fmt.Printf("  %s/call/?%s\n", base, url.Values{"room": {*room}, "token": {token}}.Encode())
+}
+
+// runRooms implements "snapshell rooms [--token <admin token>] [--json] [room]":
+// the signaler's active rooms and who is in them
+func runRooms(args []string) {
+	fs := flag.NewFlagSet("rooms", flag.ExitOnError)
+	server := fs.String("server", getDefaultServer(), "Signaling server base URL")
+	token := fs.String("token", os.Getenv("SNAPSHELL_ADMIN_TOKEN"), "The signaler's SIGNALER_ADMIN_TOKEN (env SNAPSHELL_ADMIN_TOKEN)")
+	asJSON := fs.Bool("json", false, "Print the rooms as JSON")
+	fs.Parse(args)
+
+	c := sig.New(strings.TrimRight(*server, "/"), fs.Arg(0), "")
+	rooms, err := c.Rooms(*token)
+	if err != nil {
+		fmt.Println("❌ Listing rooms failed:", err)
+		os.Exit(1)
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(rooms)
+		return
+	}
+	if len(rooms) == 0 {
+		fmt.Println("No active rooms")
+		return
+	}
+	ago := func(t time.Time) string {
+		return time.Since(t).Round(time.Second).String() + " ago"
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ROOM\tMEMBER\tROLE\tPHASE\tJOINED\tLAST HEARTBEAT")
+	for _, r := range rooms {
+		name := r.ID
+		if r.Password {
+			name += " (password)"
+		}
+		for _, m := range r.Members {
+			seen := "-"
+			if m.LastSeen != nil {
+				seen = ago(*m.LastSeen)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", name, m.ClientID, m.Role, m.Phase, ago(m.Joined), seen)
+			name = ""
+		}
+	}
+	tw.Flush()
+}
+
+// runDoctor implements "snapshell doctor [--server <url>] [--json]"
+func runDoctor(args []string) {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	server := fs.String("server", getDefaultServer(), "Signaling server base URL")
+	asJSON := fs.Bool("json", false, "Print the report as JSON")
+	fs.Parse(args)
+
+	report := doctor.Run(*server)
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+	} else {
+		report.Print(os.Stdout)
+	}
+	if !report.OK {
+		os.Exit(1)
+	}
+}
+
+// runSelfTest implements "snapshell selftest [--duration 10s] [--fps 15]":
+// a call between two peers in this process, no signaling server needed
+func runSelfTest(args []string) {
+	fs := flag.NewFlagSet("selftest", flag.ExitOnError)
+	duration := fs.Duration("duration", 10*time.Second, "How long to stream the test pattern")
+	fps := fs.Int("fps", 15, "Frames per second to send")
+	color := fs.String("color", "gray", "Color mode: gray, 256 or truecolor")
+	charset := fs.String("charset", "standard", "Character ramp: standard, blocks or detailed")
+	quiet := fs.Bool("quiet", false, "Only print the summary, do not draw frames")
+	fs.Parse(args)
+
+	colorMode, ok := render.ParseColorMode(*color)
+	if !ok {
+		fmt.Println("--color must be gray, 256 or truecolor")
+		os.Exit(1)
+	}
+	ramp, ok := render.Charsets[*charset]
+	if !ok {
+		fmt.Println("--charset must be standard, blocks or detailed")
+		os.Exit(1)
+	}
+	q := render.TerminalQuality()
+	q.Height-- // status bar
+	q.Color, q.Charset = colorMode, ramp
+
+	fmt.Println("🧪 Running loopback self-test...")
+	res, err := webrtc.RunSelfTest(webrtc.SelfTestOptions{Duration: *duration, FPS: *fps, Quality: q, Show: !*quiet})
+	if !*quiet {
+		render.ClearTerminal()
+	}
+	if err != nil {
+		fmt.Println("❌", err)
+		os.Exit(1)
+	}
+	fmt.Println("✅ Self-test:", res)
+}
+
 func main() {
-	autoOfferSignaled := flag.Bool("signaled-o", false, "Start as offerer (caller) - signaling server mode")
-	autoAnswerSignaled := flag.Bool("signaled-a", false, "Start as answerer (callee) - signaling server mode")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "send":
+			runSend(os.Args[2:])
+			return
+		case "doctor":
+			runDoctor(os.Args[2:])
+			return
+		case "selftest":
+			runSelfTest(os.Args[2:])
+			return
+		case "invite":
+			runInvite(os.Args[2:])
+			return
+		case "rooms":
+			runRooms(os.Args[2:])
+			return
+		}
+	}
+
+	// "snapshell join <room>" takes the call flags, with the room before or
+	// after them
+	args, join, joinRoom := os.Args[1:], false, ""
+	if len(args) > 0 && args[0] == "join" {
+		join, args = true, args[1:]
+		if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+			joinRoom, args = args[0], args[1:]
+		}
+	}
+
+	autoOfferSignaled := flag.Bool("signaled-o", false, "Deprecated: use snapshell join, which this runs; the server picks caller or answerer - signaling server mode")
+	autoAnswerSignaled := flag.Bool("signaled-a", false, "Deprecated: same as -signaled-o - signaling server mode")
+	mesh := flag.Bool("mesh", false, "Join a mesh room: a call with up to 8 people, shown as a grid - signaling server mode")
+	watch := flag.Bool("watch", false, "Watch a mesh room or two-person call without sending anything - signaling server mode")
 	server := flag.String("server", getDefaultServer(), "Signaling server base URL (default: SNAPSHELL_SERVER env var or http://localhost:8080)")
-	room := flag.String("room", "", "Meeting ID (room)")
+	room := flag.String("room", joinRoom, "Meeting ID (room)")
 	clientID := flag.String("id", "", "Client ID (optional; random if empty)")
-	flag.Parse()
+	password := flag.String("password", "", "Room password: sets it when creating the room, proves it when joining")
+	token := flag.String("token", "", "Invite token for a room with a password (from snapshell invite)")
+	audioSrc := flag.String("audio", "", "Send audio: \"mic\" for the default capture device or a .wav/.ogg/.opus file (looped)")
+	videoTrack := flag.Bool("video-track", false, "Send the webcam as a VP8 video track (needs ffmpeg) so the receiver renders it")
+	color := flag.String("color", "gray", "Color mode for received video tracks: gray, 256 or truecolor")
+	charset := flag.String("charset", "standard", "Character ramp for received video tracks: standard, blocks or detailed")
+	icePolicy := flag.String("ice-policy", "auto", "ICE candidates to use: all, relay, or auto (relay first, then all if that does not connect)")
+	debugLogPath := flag.String("debug-log", "", "Write debug output (quality decisions, stats) to this file")
+	flag.CommandLine.Parse(args)
+	if join && *room == "" && flag.NArg() == 1 {
+		*room = flag.Arg(0)
+	}
 
-	if (*autoOfferSignaled || *autoAnswerSignaled) && *room == "" {
+	if *debugLogPath != "" {
+		f, err := os.OpenFile(*debugLogPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			fmt.Println("Cannot open debug log:", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		webrtc.SetDebugLog(f)
+	}
+
+	if join && *room == "" {
+		fmt.Println("Usage: snapshell join <room> [--id <client>] [--server <url>] [--password <pw> | --token <token>]")
+		os.Exit(1)
+	}
+	if (*autoOfferSignaled || *autoAnswerSignaled || *mesh || *watch) && *room == "" {
 		fmt.Println("For signaled auto mode, provide --room (and optionally --id)")
 		fmt.Printf("Using signaling server: %s\n", *server)
 		os.Exit(1)
 	}
 
-	if *autoOfferSignaled {
-		fmt.Println("Running as auto caller (signaling server)...")
-		webrtc.RunAutoOfferSignaled(*server, *room, *clientID)
+	colorMode, ok := render.ParseColorMode(*color)
+	if !ok {
+		fmt.Println("--color must be gray, 256 or truecolor")
+		os.Exit(1)
+	}
+	if _, ok := render.Charsets[*charset]; !ok {
+		fmt.Println("--charset must be standard, blocks or detailed")
+		os.Exit(1)
+	}
+
+	policy, ok := webrtc.ParseICEPolicy(*icePolicy)
+	if !ok {
+		fmt.Println("--ice-policy must be all, relay or auto")
+		os.Exit(1)
+	}
+
+	opts := webrtc.CallOptions{
+		Audio:      *audioSrc,
+		VideoTrack: *videoTrack,
+		Color:      colorMode,
+		Charset:    *charset,
+		ICEPolicy:  policy,
+		Credentials: sig.Credentials{
+			Password: *password,
+			Token:    *token,
+		},
+	}
+
+	if join {
+		fmt.Println("Joining room (signaling server)...")
+		webrtc.RunSignaled(*server, *room, *clientID, opts)
+	} else if *mesh {
+		fmt.Println("Joining mesh room (signaling server)...")
+		webrtc.RunMesh(*server, *room, *clientID, opts)
+	} else if *watch {
+		fmt.Println("Watching room (signaling server)...")
+		webrtc.RunWatch(*server, *room, *clientID, opts)
+	} else if *autoOfferSignaled {
+		fmt.Println("⚠️  -signaled-o is deprecated and does not make you the caller: the server picks the role. Use snapshell join <room>.")
+		fmt.Println("Joining room (signaling server)...")
+		webrtc.RunAutoOfferSignaled(*server, *room, *clientID, opts)
 	} else if *autoAnswerSignaled {
-		fmt.Println("Running as auto callee (signaling server)...")
-		webrtc.RunAutoAnswerSignaled(*server, *room, *clientID)
+		fmt.Println("⚠️  -signaled-a is deprecated and does not make you the answerer: the server picks the role. Use snapshell join <room>.")
+		fmt.Println("Joining room (signaling server)...")
+		webrtc.RunAutoAnswerSignaled(*server, *room, *clientID, opts)
 	} else {
 		fmt.Println("Usage:")
 		fmt.Println("  Signaling server mode (recommended):")
-		fmt.Println("    snapshell -signaled-o --room <id> [--id <client>]    # Start as caller")
-		fmt.Println("    snapshell -signaled-a --room <id> [--id <client>]    # Join as answerer")
+		fmt.Println("    snapshell join <id> [--id <client>]                   # Call whoever else joins; first in calls, second answers")
+		fmt.Println("    snapshell -signaled-o|-signaled-a --room <id>         # Deprecated; same as join")
+		fmt.Println("    snapshell -mesh --room <id>                           # Group call: everyone connects to everyone")
+		fmt.Println("    snapshell -watch --room <id>                          # Watch a group call or broadcast, sending nothing")
+		fmt.Println("    snapshell send --room <id> <path>                     # Send a file to the peer in the room")
+		fmt.Println("    snapshell invite --room <id> [--password <pw>]        # Print commands and a link that join the room")
+		fmt.Println("    snapshell rooms [--token <admin token>] [<id>]        # List the signaler's rooms, members and connection phases")
+		fmt.Println("    snapshell doctor [--json]                             # Check signaler, ICE servers, camera and terminal")
+		fmt.Println("    snapshell selftest [--duration 10s] [--quiet]         # Loopback call in this process: FPS, latency, bandwidth")
 		fmt.Println("    # Server auto-detected from SNAPSHELL_SERVER env var or defaults to localhost:8080")
 		fmt.Println("")
 		fmt.Println("  Other modes:")
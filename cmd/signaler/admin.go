@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	sig "github.com/saswatsam786/snapshell/internal/signal"
+)
+
+// Admin API: the active rooms with their members, roles, join times and
+// connection phases, for operators. It is off unless SIGNALER_ADMIN_TOKEN
+// is set, and takes that token as "Authorization: Bearer <token>".
+
+// adminToken guards /admin/*; empty turns the API off
+var adminToken string
+
+// checkAdmin fails unless r carries the admin token
+func checkAdmin(r *http.Request) error {
+	if adminToken == "" {
+		return &roomError{http.StatusNotFound, "admin API is off; set SIGNALER_ADMIN_TOKEN"}
+	}
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(adminToken)) != 1 {
+		return &roomError{http.StatusUnauthorized, "admin token required"}
+	}
+	return nil
+}
+
+// roomInfo describes room id, created at the unix time since; false if the
+// room has no members
+func roomInfo(id, since string) (sig.RoomInfo, bool) {
+	roles, _ := store.HashGetAll(ctx, kRoles(id))
+	if len(roles) == 0 {
+		return sig.RoomInfo{}, false
+	}
+	joined, _ := store.HashGetAll(ctx, kJoined(id))
+	phases, _ := store.HashGetAll(ctx, kPhase(id))
+	seen, _ := store.HashGetAll(ctx, kSeen(id))
+	_, err := store.Get(ctx, kPassword(id))
+
+	room := sig.RoomInfo{ID: id, Created: unixTime(since), Password: err == nil, Members: []sig.MemberInfo{}}
+	for clientID, role := range roles {
+		m := sig.MemberInfo{ClientID: clientID, Role: role, Joined: unixTime(joined[clientID]), Phase: phases[clientID]}
+		if at, ok := seen[clientID]; ok {
+			t := unixTime(at)
+			m.LastSeen = &t
+		}
+		room.Members = append(room.Members, m)
+	}
+	sort.Slice(room.Members, func(i, j int) bool {
+		a, b := room.Members[i], room.Members[j]
+		if !a.Joined.Equal(b.Joined) {
+			return a.Joined.Before(b.Joined)
+		}
+		return a.ClientID < b.ClientID
+	})
+	return room, true
+}
+
+func unixTime(s string) time.Time {
+	n, _ := strconv.ParseInt(s, 10, 64)
+	return time.Unix(n, 0).UTC()
+}
+
+// GET /admin/rooms -> {"rooms": [RoomInfo...]}
+func getRooms(w http.ResponseWriter, r *http.Request) {
+	if err := checkAdmin(r); err != nil {
+		fail(w, err)
+		return
+	}
+	index, _ := store.HashGetAll(ctx, kRooms())
+	rooms := []sig.RoomInfo{}
+	for id, since := range index {
+		if room, ok := roomInfo(id, since); ok {
+			rooms = append(rooms, room)
+		}
+	}
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].ID < rooms[j].ID })
+	writeJSON(w, map[string]any{"rooms": rooms})
+}
+
+// GET /admin/rooms/{id} -> RoomInfo
+func getRoom(w http.ResponseWriter, r *http.Request) {
+	if err := checkAdmin(r); err != nil {
+		fail(w, err)
+		return
+	}
+	id := r.PathValue("id")
+	since, _ := store.HashGet(ctx, kRooms(), id)
+	room, ok := roomInfo(id, since)
+	if !ok {
+		http.Error(w, "no such room", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, room)
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Room access. Whoever creates a room may give it a password; others then
+// join with the password or an invite token. Every join issues the client a
+// secret, and the room endpoints, reads included, want it in the
+// X-Client-Secret header (or, on the WebSocket, in the join that opens the
+// connection) so a clientId alone proves nothing. Invite tokens carry the
+// room and their expiry, signed with SIGNALER_SECRET over a nonce kept with
+// the password, so they only work for the password they were made under.
+// A room without a password has no invites.
+
+func kPassword(id string) string { return "room:" + id + ":password" } // string: invite nonce, a space, bcrypt hash of the room password
+func kSecrets(id string) string  { return "room:" + id + ":secrets" }  // hash: clientID -> sha256 of its secret
+
+const (
+	defaultInviteTTL = 24 * time.Hour
+	maxInviteTTL     = 7 * 24 * time.Hour
+)
+
+// inviteKey signs invite tokens
+var inviteKey []byte
+
+var (
+	errNeedPassword = &roomError{http.StatusUnauthorized, "room needs a password or an invite"}
+	errNoPassword   = &roomError{http.StatusConflict, "room has no password; anyone can join it"}
+	// errInviteGone refuses an invite to a room that has lost its password,
+	// which is signed into every invite; the room it was for has ended
+	errInviteGone = &roomError{http.StatusGone, "the room this invite was for has ended"}
+)
+
+// credentials are what a client presents when it joins
+type credentials struct {
+	Password string `json:"password,omitempty"`
+	Token    string `json:"token,omitempty"`
+	Secret   string `json:"secret,omitempty"` // from an earlier join with the same clientId
+}
+
+type inviteReq struct {
+	Password string `json:"password,omitempty"`
+	TTL      string `json:"ttl,omitempty"` // Go duration, e.g. "2h"
+}
+
+// loadInviteKey reads SIGNALER_SECRET. Without it tokens are signed with a
+// random key and stop working when the process restarts.
+func loadInviteKey() {
+	if k := os.Getenv("SIGNALER_SECRET"); k != "" {
+		inviteKey = []byte(k)
+		return
+	}
+	inviteKey = make([]byte, 32)
+	if _, err := rand.Read(inviteKey); err != nil {
+		log.Fatal("invite key: ", err)
+	}
+	log.Printf("Warning: SIGNALER_SECRET not set; invite tokens end with this process")
+}
+
+// roomPassword returns the bcrypt hash of room id's password and the nonce
+// its invites are signed over; ErrNotFound if the room has none
+func roomPassword(id string) (hash, nonce string, err error) {
+	v, err := store.Get(ctx, kPassword(id))
+	if err != nil {
+		return "", "", err
+	}
+	nonce, hash, _ = strings.Cut(v, " ")
+	return hash, nonce, nil
+}
+
+// admit checks that a new member may join room id, whose members are
+// roles. The first member of a room may set its password; a password for
+// a room that already has members without one is refused rather than
+// ignored, so nobody believes an open room is protected. So is an invite
+// without a password, so the room it opened is not recreated open.
+func admit(id string, roles map[string]string, c credentials) error {
+	hash, nonce, err := roomPassword(id)
+	if err == ErrNotFound {
+		if c.Password == "" {
+			if c.Token != "" {
+				return errInviteGone
+			}
+			return nil
+		}
+		if len(roles) > 0 {
+			return &roomError{http.StatusConflict, "room already exists without a password"}
+		}
+		h, err := bcrypt.GenerateFromPassword([]byte(c.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return errServer
+		}
+		n := make([]byte, 16)
+		if _, err := rand.Read(n); err != nil {
+			return errServer
+		}
+		set, err := store.SetNX(ctx, kPassword(id), hex.EncodeToString(n)+" "+string(h), ttl)
+		if err != nil {
+			return errServer
+		}
+		if set {
+			return nil
+		}
+		// another first member set one meanwhile; ours has to match it
+		if hash, nonce, err = roomPassword(id); err != nil {
+			return errServer
+		}
+	} else if err != nil {
+		return errServer
+	}
+	if c.Token != "" && checkInvite(id, nonce, c.Token) == nil {
+		return nil
+	}
+	if c.Password != "" && bcrypt.CompareHashAndPassword([]byte(hash), []byte(c.Password)) == nil {
+		return nil
+	}
+	return errNeedPassword
+}
+
+// issueSecret gives clientID a new secret for room id
+func issueSecret(id, clientID string) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", errServer
+	}
+	secret := hex.EncodeToString(b)
+	if err := store.HashSet(ctx, kSecrets(id), clientID, hashSecret(secret), ttl); err != nil {
+		return "", errServer
+	}
+	return secret, nil
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// checkSecret fails unless secret is the one clientID was issued in room id
+func checkSecret(id, clientID, secret string) error {
+	want, _ := store.HashGet(ctx, kSecrets(id), clientID)
+	if want == "" || secret == "" || subtle.ConstantTimeCompare([]byte(want), []byte(hashSecret(secret))) != 1 {
+		return errForbidden
+	}
+	return nil
+}
+
+// authorize checks a REST request's clientId against its X-Client-Secret
+// and returns the clientId. The secret may come as the secret query
+// parameter instead, for browsers' EventSource, which cannot set headers.
+func authorize(r *http.Request, id string) (string, error) {
+	clientID := r.URL.Query().Get("clientId")
+	secret := r.Header.Get("X-Client-Secret")
+	if secret == "" {
+		secret = r.URL.Query().Get("secret")
+	}
+	return clientID, checkSecret(id, clientID, secret)
+}
+
+// authorizeRole is authorize for a stream addressed to role, which the
+// member has to hold so it reads nobody else's signaling
+func authorizeRole(r *http.Request, id, role string) (string, error) {
+	clientID, err := authorize(r, id)
+	if err != nil {
+		return "", err
+	}
+	if held, _ := store.HashGet(ctx, kRoles(id), clientID); held != role {
+		return "", errForbidden
+	}
+	return clientID, nil
+}
+
+// signInvite returns a token that admits its holder to room id until exp,
+// for as long as the room keeps the password whose nonce is nonce
+func signInvite(id, nonce string, exp time.Time) string {
+	payload := id + "|" + strconv.FormatInt(exp.Unix(), 10)
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString([]byte(payload)) + "." + enc.EncodeToString(inviteMAC([]byte(payload), nonce))
+}
+
+func inviteMAC(payload []byte, nonce string) []byte {
+	mac := hmac.New(sha256.New, inviteKey)
+	mac.Write(payload)
+	mac.Write([]byte("|" + nonce))
+	return mac.Sum(nil)
+}
+
+// checkInvite verifies a token from signInvite for room id
+func checkInvite(id, nonce, token string) error {
+	enc := base64.RawURLEncoding
+	p, s, ok := strings.Cut(token, ".")
+	payload, err1 := enc.DecodeString(p)
+	sum, err2 := enc.DecodeString(s)
+	if !ok || err1 != nil || err2 != nil {
+		return errors.New("malformed token")
+	}
+	if !hmac.Equal(sum, inviteMAC(payload, nonce)) {
+		return errors.New("bad signature")
+	}
+	i := strings.LastIndexByte(string(payload), '|')
+	exp, err := strconv.ParseInt(string(payload[i+1:]), 10, 64)
+	if i < 0 || err != nil || string(payload[:i]) != id {
+		return errors.New("token is for another room")
+	}
+	if time.Now().Unix() > exp {
+		return errors.New("token expired")
+	}
+	return nil
+}
+
+// POST /room/{id}/invite[?clientId=...]
+// Body: {"password": ..., "ttl": "24h"} -> {"token": ..., "expires": ...}
+// The room must have a password, and the request needs it or a member's
+// clientId and X-Client-Secret.
+func postInvite(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	var req inviteReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, "bad request", 400)
+		return
+	}
+	valid := defaultInviteTTL
+	if req.TTL != "" {
+		d, err := time.ParseDuration(req.TTL)
+		if err != nil || d <= 0 || d > maxInviteTTL {
+			http.Error(w, fmt.Sprintf("ttl must be a duration up to %s", maxInviteTTL), 400)
+			return
+		}
+		valid = d
+	}
+
+	hash, nonce, err := roomPassword(id)
+	if err == ErrNotFound {
+		fail(w, errNoPassword)
+		return
+	}
+	if err != nil {
+		http.Error(w, "server", 500)
+		return
+	}
+	_, memberErr := authorize(r, id)
+	passErr := bcrypt.CompareHashAndPassword([]byte(hash), []byte(req.Password))
+	if memberErr != nil && (req.Password == "" || passErr != nil) {
+		fail(w, errNeedPassword)
+		return
+	}
+
+	exp := time.Now().Add(valid)
+	writeJSON(w, map[string]string{"token": signInvite(id, nonce, exp), "expires": exp.UTC().Format(time.RFC3339)})
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// useMemoryStore gives the test an empty memory store and a fixed invite key
+func useMemoryStore(t *testing.T) {
+	t.Helper()
+	oldStore, oldKey := store, inviteKey
+	store, inviteKey = newMemoryStore(), []byte("test key")
+	t.Cleanup(func() { store, inviteKey = oldStore, oldKey })
+}
+
+// rawToken signs payload as signInvite would, whatever its shape
+func rawToken(payload, nonce string) string {
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString([]byte(payload)) + "." + enc.EncodeToString(inviteMAC([]byte(payload), nonce))
+}
+
+func TestCheckInvite(t *testing.T) {
+	useMemoryStore(t)
+	later := time.Now().Add(time.Hour)
+	valid := signInvite("team", "n1", later)
+	sig := valid[len(valid)-43:] // the MAC, unpadded base64 of 32 bytes
+
+	tests := []struct {
+		name  string
+		room  string
+		nonce string
+		token string
+		ok    bool
+	}{
+		{"valid", "team", "n1", valid, true},
+		{"expired", "team", "n1", signInvite("team", "n1", time.Now().Add(-time.Minute)), false},
+		{"other room", "other", "n1", valid, false},
+		{"room that ends with the same name", "eam", "n1", valid, false},
+		{"room id with a bar", "a|b", "n1", signInvite("a|b", "n1", later), true},
+		{"password changed", "team", "n2", valid, false},
+		{"empty", "team", "n1", "", false},
+		{"no signature", "team", "n1", "dGVhbXwx", false},
+		{"payload not base64", "team", "n1", "!!!." + sig, false},
+		{"signature not base64", "team", "n1", "dGVhbXwx.!!!", false},
+		{"tampered payload", "team", "n1", base64.RawURLEncoding.EncodeToString([]byte("team|99999999999")) + "." + sig, false},
+		{"signed payload without a bar", "team", "n1", rawToken(strconv.FormatInt(later.Unix(), 10), "n1"), false},
+		{"signed payload with a bad expiry", "team", "n1", rawToken("team|soon", "n1"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkInvite(tt.room, tt.nonce, tt.token)
+			if tt.ok && err != nil {
+				t.Errorf("checkInvite: %v, want ok", err)
+			}
+			if !tt.ok && err == nil {
+				t.Error("checkInvite accepted the token")
+			}
+		})
+	}
+}
+
+func TestAdmit(t *testing.T) {
+	useMemoryStore(t)
+	member := map[string]string{"a": "offer"}
+
+	// an open room, then one with a password set by its first member
+	if err := admit("open", nil, credentials{}); err != nil {
+		t.Fatalf("first member of an open room: %v", err)
+	}
+	if err := admit("locked", nil, credentials{Password: "hunter2"}); err != nil {
+		t.Fatalf("first member setting a password: %v", err)
+	}
+	_, nonce, err := roomPassword("locked")
+	if err != nil {
+		t.Fatal(err)
+	}
+	invite := signInvite("locked", nonce, time.Now().Add(time.Hour))
+
+	tests := []struct {
+		name  string
+		room  string
+		roles map[string]string
+		c     credentials
+		want  error // nil, or the roomError to get
+	}{
+		{"open room", "open", member, credentials{}, nil},
+		{"password for an open room with members", "open", member, credentials{Password: "x"}, errConflict},
+		{"invite for a room without a password", "gone", nil, credentials{Token: invite}, errInviteGone},
+		{"no credentials", "locked", member, credentials{}, errNeedPassword},
+		{"wrong password", "locked", member, credentials{Password: "hunter3"}, errNeedPassword},
+		{"right password", "locked", member, credentials{Password: "hunter2"}, nil},
+		{"invite", "locked", member, credentials{Token: invite}, nil},
+		{"invite for another room", "locked", member, credentials{Token: signInvite("open", nonce, time.Now().Add(time.Hour))}, errNeedPassword},
+		{"malformed invite", "locked", member, credentials{Token: "junk"}, errNeedPassword},
+		{"bad invite, right password", "locked", member, credentials{Token: "junk", Password: "hunter2"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkRoomError(t, admit(tt.room, tt.roles, tt.c), tt.want)
+		})
+	}
+
+	// A new password for the room, as when it ends and is created again,
+	// voids the invites made under the old one
+	store.Del(ctx, kPassword("locked"))
+	if err := admit("locked", nil, credentials{Password: "hunter2"}); err != nil {
+		t.Fatal(err)
+	}
+	checkRoomError(t, admit("locked", member, credentials{Token: invite}), errNeedPassword)
+}
+
+// errConflict stands for any 409 in TestAdmit
+var errConflict = &roomError{http.StatusConflict, ""}
+
+func checkRoomError(t *testing.T, err, want error) {
+	t.Helper()
+	if want == nil {
+		if err != nil {
+			t.Errorf("got %v, want ok", err)
+		}
+		return
+	}
+	re, ok := err.(*roomError)
+	if !ok {
+		t.Errorf("got %v, want %v", err, want)
+		return
+	}
+	w := want.(*roomError)
+	if re.code != w.code || (w.msg != "" && re.msg != w.msg) {
+		t.Errorf("got %d %q, want %d %q", re.code, re.msg, w.code, w.msg)
+	}
+}
+
+// Two first members with different passwords: only one of them gets in,
+// and the room keeps that one's password
+func TestAdmitFirstMembersRace(t *testing.T) {
+	useMemoryStore(t)
+	passwords := []string{"one", "two"}
+	errs := make([]error, len(passwords))
+	var wg sync.WaitGroup
+	for i, p := range passwords {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = admit("race", nil, credentials{Password: p})
+		}()
+	}
+	wg.Wait()
+
+	var admitted []string
+	for i, err := range errs {
+		if err == nil {
+			admitted = append(admitted, passwords[i])
+		}
+	}
+	if len(admitted) != 1 {
+		t.Fatalf("admitted %v, want exactly one", admitted)
+	}
+	for _, p := range passwords {
+		err := admit("race", map[string]string{"a": "offer"}, credentials{Password: p})
+		if (p == admitted[0]) != (err == nil) {
+			t.Errorf("password %q: %v", p, err)
+		}
+	}
+}
+
+func TestCheckSecret(t *testing.T) {
+	useMemoryStore(t)
+	secret, err := issueSecret("room", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := issueSecret("other", "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, room, client, secret string
+		ok                         bool
+	}{
+		{"issued", "room", "alice", secret, true},
+		{"wrong", "room", "alice", secret + "0", false},
+		{"empty", "room", "alice", "", false},
+		{"another client", "room", "bob", secret, false},
+		{"another room", "other", "alice", secret, false},
+		{"hash instead of secret", "room", "alice", hashSecret(secret), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkSecret(tt.room, tt.client, tt.secret)
+			if (err == nil) != tt.ok {
+				t.Errorf("checkSecret: %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
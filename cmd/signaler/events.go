@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	sig "github.com/saswatsam786/snapshell/internal/signal"
+)
+
+// GET /room/{id}/events?to=offer|answer|peer|viewer&clientId=...   (SSE stream)
+// For a member holding role to, with its X-Client-Secret (or secret=...).
+// Everything the peer of role to does, as named events with IDs:
+//
+//	offer, answer   {"sdp": ...}
+//	description     {"seq": n, "type": "offer"|"answer", "sdp": ...}
+//	candidate       base64 candidate, as on /ice
+//	peer-joined     {"clientId": ..., "role": ...}
+//	peer-left       {"clientId": ..., "role": ...}
+//	signal          a mesh member's offer, answer or candidate for clientId,
+//	                as the JSON sig.Message
+//
+// A new stream starts with the current state (members, the peer's SDP,
+// descriptions and candidates) as events without IDs, followed by just the
+// ID of the newest logged event; sending that ID back as Last-Event-ID
+// resumes with the events after it.
+func streamEvents(w http.ResponseWriter, r *http.Request) {
+	serveEvents(w, r, false)
+}
+
+// GET /room/{id}/ice?to=offer|answer&clientId=...   (SSE stream)
+// The candidates of /events alone, as unnamed events, for older clients
+func streamICE(w http.ResponseWriter, r *http.Request) {
+	serveEvents(w, r, true)
+}
+
+func serveEvents(w http.ResponseWriter, r *http.Request, iceOnly bool) {
+	id := r.PathValue("id")
+	to := r.URL.Query().Get("to")
+	if to != "offer" && to != "answer" && (!meshRole(to) || iceOnly) {
+		http.Error(w, "to must be offer|answer", 400)
+		return
+	}
+	clientID, err := authorizeRole(r, id, to)
+	if err != nil {
+		fail(w, err)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "no flush", 500)
+		return
+	}
+
+	// subscribe before reading the log so nothing falls in between
+	ch, err := store.Subscribe(r.Context(), chRoom(id))
+	if err != nil {
+		http.Error(w, "server", 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	write := func(eventID int, m sig.Message) {
+		if !forRole(m, clientID, to) {
+			return
+		}
+		name, data, ok := sseEvent(m)
+		if !ok || (iceOnly && name != "candidate") {
+			return
+		}
+		if eventID > 0 {
+			fmt.Fprintf(w, "id: %d\n", eventID)
+		}
+		if !iceOnly {
+			fmt.Fprintf(w, "event: %s\n", name)
+		}
+		fmt.Fprintf(w, "data: %s\n\n", data)
+	}
+
+	// an ID past the end means the log expired meanwhile: start over
+	last, err := strconv.Atoi(r.Header.Get("Last-Event-ID"))
+	if err == nil && last >= 0 && last <= lastEventID(id) {
+		// resume
+		for _, ev := range roomEvents(id, last) {
+			write(ev.ID, ev.message())
+			last = ev.ID
+		}
+	} else {
+		// current state first, without IDs: a stream that drops halfway
+		// through it starts over. The ID after it resumes from there.
+		last = lastEventID(id)
+		replayRoom(id, clientID, to, func(m sig.Message) { write(0, m) })
+		fmt.Fprintf(w, "id: %d\n\n", last)
+	}
+	flusher.Flush()
+
+	// live
+	tick := time.NewTicker(15 * time.Second)
+	defer tick.Stop()
+
+	for {
+		select {
+		case e, ok := <-ch:
+			if !ok {
+				return
+			}
+			var ev roomEvent
+			if json.Unmarshal([]byte(e), &ev) != nil || ev.ID <= last {
+				continue
+			}
+			last = ev.ID
+			write(ev.ID, ev.message())
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-tick.C:
+			// keep-alive
+			fmt.Fprint(w, ": ping\n\n")
+			flusher.Flush()
+		}
+	}
+}
+
+// sseEvent names a room event and encodes its data on one line
+func sseEvent(m sig.Message) (name, data string, ok bool) {
+	var v any
+	switch {
+	case m.To != "":
+		name, v = "signal", m
+	case m.Type == sig.MsgCandidate:
+		return "candidate", m.Candidate, true
+	case m.Type == sig.MsgOffer, m.Type == sig.MsgAnswer:
+		name, v = m.Type, map[string]string{"sdp": m.SDP}
+	case m.Type == sig.MsgDescription:
+		name, v = m.Type, descMsg{Seq: m.Seq, Type: m.SDPType, SDP: m.SDP}
+	case m.Type == sig.MsgPresence:
+		name, v = "peer-"+m.Event, map[string]string{"clientId": m.ClientID, "role": m.Role}
+	default:
+		return "", "", false
+	}
+	b, _ := json.Marshal(v)
+	return name, string(b), true
+}
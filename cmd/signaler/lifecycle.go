@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	sig "github.com/saswatsam786/snapshell/internal/signal"
+)
+
+// Room lifecycle. Members leave explicitly, or stop sending heartbeats and
+// are expired by the reaper a little after staleAfter. Clients that never
+// send one keep their role until the room's ttl runs out. When one side of
+// a two-person call goes, the call's SDPs and candidates go with it, so
+// whoever takes the free role starts from scratch; a room nobody is left
+// in is removed altogether.
+
+func kRooms() string           { return "rooms" }                  // hash: roomID -> unix time of its first join
+func kSeen(id string) string   { return "room:" + id + ":seen" }   // hash: clientID -> unix time of its last heartbeat
+func kJoined(id string) string { return "room:" + id + ":joined" } // hash: clientID -> unix time it joined
+func kPhase(id string) string  { return "room:" + id + ":phase" }  // hash: clientID -> sig.Phase*
+
+const (
+	// staleAfter expires members this long after their last heartbeat;
+	// clients send one every 10s
+	staleAfter = 30 * time.Second
+	// reapInterval is how often rooms are checked for stale members
+	reapInterval = 5 * time.Second
+)
+
+var (
+	errNotMember = &roomError{http.StatusNotFound, "not in the room"}
+	// errExpired answers the heartbeat of a member that was expired; it
+	// has to join again
+	errExpired = &roomError{http.StatusGone, "expired from the room; join again"}
+)
+
+// touchRoom records room id in the room index. The index does not expire:
+// the reaper walks it, and removes a room only once its roles are gone.
+func touchRoom(id string) {
+	if since, _ := store.HashGet(ctx, kRooms(), id); since != "" {
+		return
+	}
+	store.HashSet(ctx, kRooms(), id, strconv.FormatInt(time.Now().Unix(), 10), 0)
+}
+
+// recordJoin notes when clientID joined room id, for the admin view
+func recordJoin(id, clientID string) {
+	touchRoom(id)
+	store.HashSet(ctx, kJoined(id), clientID, strconv.FormatInt(time.Now().Unix(), 10), ttl)
+	store.HashSet(ctx, kPhase(id), clientID, sig.PhaseJoined, ttl)
+}
+
+// setPhase records how far clientID's connection got
+func setPhase(id, clientID, phase string) {
+	store.HashSet(ctx, kPhase(id), clientID, phase, ttl)
+}
+
+// validPhase reports whether a client may report phase
+func validPhase(phase string) bool {
+	switch phase {
+	case sig.PhaseJoined, sig.PhaseOffered, sig.PhaseAnswered, sig.PhaseConnected, sig.PhaseReconnecting:
+		return true
+	}
+	return false
+}
+
+// refreshRoom restarts the ttl of room id's membership
+func refreshRoom(id string) {
+	for _, k := range []string{kRoles(id), kSecrets(id), kJoined(id), kPhase(id), kPassword(id)} {
+		store.Expire(ctx, k, ttl)
+	}
+}
+
+// heartbeat marks clientID as alive in room id, at phase if it reports one
+func heartbeat(id, clientID, phase string) error {
+	if role, _ := store.HashGet(ctx, kRoles(id), clientID); role == "" {
+		return errExpired
+	}
+	if phase != "" && !validPhase(phase) {
+		return &roomError{http.StatusBadRequest, "unknown phase " + phase}
+	}
+	if err := store.HashSet(ctx, kSeen(id), clientID, strconv.FormatInt(time.Now().Unix(), 10), ttl); err != nil {
+		return errServer
+	}
+	if phase != "" {
+		setPhase(id, clientID, phase)
+	}
+	refreshRoom(id)
+	return nil
+}
+
+// leave removes clientID from room id with its secret and, for a side of a
+// two-person call, the call's signaling state
+func leave(id, clientID string) error {
+	role, _ := store.HashGet(ctx, kRoles(id), clientID)
+	if role == "" {
+		return errNotMember
+	}
+	store.HashDel(ctx, kRoles(id), clientID)
+	store.HashDel(ctx, kSecrets(id), clientID)
+	store.HashDel(ctx, kSeen(id), clientID)
+	store.HashDel(ctx, kJoined(id), clientID)
+	store.HashDel(ctx, kPhase(id), clientID)
+	if callRole(role) {
+		store.Del(ctx, callKeys(id)...)
+	}
+	publishEvent(id, sig.Message{Type: sig.MsgPresence, ClientID: clientID, Role: role, Event: "left"})
+
+	if roles, _ := store.HashGetAll(ctx, kRoles(id)); len(roles) == 0 {
+		dropRoom(id)
+	}
+	return nil
+}
+
+// callKeys are the SDPs, candidates and descriptions of a two-person call
+func callKeys(id string) []string {
+	return []string{
+		kOfferSDP(id), kAnswerSDP(id),
+		kICEList(id, "offer"), kICEList(id, "answer"),
+		kSDPList(id, "offer"), kSDPList(id, "answer"),
+	}
+}
+
+// dropRoom deletes everything kept for room id
+func dropRoom(id string) {
+	keys := append(callKeys(id), kRoles(id), kSecrets(id), kSeen(id), kJoined(id), kPhase(id), kPassword(id), kEvents(id))
+	store.Del(ctx, keys...)
+	store.HashDel(ctx, kRooms(), id)
+}
+
+// reapRooms expires members that stopped sending heartbeats and drops rooms
+// that are empty, including ones whose roles ran out their ttl
+func reapRooms() {
+	for range time.Tick(reapInterval) {
+		rooms, _ := store.HashGetAll(ctx, kRooms())
+		for id := range rooms {
+			reapRoom(id)
+		}
+	}
+}
+
+func reapRoom(id string) {
+	roles, _ := store.HashGetAll(ctx, kRoles(id))
+	if len(roles) == 0 {
+		dropRoom(id)
+		return
+	}
+	seen, _ := store.HashGetAll(ctx, kSeen(id))
+	for clientID, at := range seen {
+		t, err := strconv.ParseInt(at, 10, 64)
+		if err != nil || time.Since(time.Unix(t, 0)) < staleAfter {
+			continue
+		}
+		if roles[clientID] == "" {
+			store.HashDel(ctx, kSeen(id), clientID)
+			continue
+		}
+		log.Printf("room %s: %s (%s) stopped sending heartbeats", id, clientID, roles[clientID])
+		leave(id, clientID)
+	}
+}
+
+// POST /room/{id}/heartbeat?clientId=...
+// Body (optional): {"phase": "connected"}
+// 410 tells an expired member to join again; its secret went with it, so
+// that comes before the secret is checked
+func postHeartbeat(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	clientID := r.URL.Query().Get("clientId")
+	if role, _ := store.HashGet(ctx, kRoles(id), clientID); role == "" {
+		fail(w, errExpired)
+		return
+	}
+	if _, err := authorize(r, id); err != nil {
+		fail(w, err)
+		return
+	}
+	var req struct {
+		Phase string `json:"phase"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, "bad request", 400)
+		return
+	}
+	if err := heartbeat(id, clientID, req.Phase); err != nil {
+		fail(w, err)
+		return
+	}
+	writeJSON(w, map[string]string{"ok": "1"})
+}
+
+// POST /room/{id}/leave?clientId=...
+func postLeave(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	clientID, err := authorize(r, id)
+	if err == nil {
+		err = leave(id, clientID)
+	}
+	if err != nil {
+		fail(w, err)
+		return
+	}
+	writeJSON(w, map[string]string{"ok": "1"})
+}
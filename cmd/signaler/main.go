@@ -4,35 +4,46 @@
 package main
 
 import (
+	"embed"
 	"encoding/json"
+	"flag"
 	"fmt"
+	"io/fs"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/joho/godotenv"
-	"github.com/redis/go-redis/v9"
 	"golang.org/x/net/context"
+	"golang.org/x/net/websocket"
 )
 
 var (
-	ctx = context.Background()
-	rdb *redis.Client
+	ctx   = context.Background()
+	store Store
 )
 
 const ttl = 15 * time.Minute
 
+// webClient is the browser peer served under /call/
+//
+//go:embed web
+var webClient embed.FS
+
 // Keys / channels
-func kRoles(id string) string         { return "room:" + id + ":roles" }       // hash: clientID -> offer|answer
+func kRoles(id string) string         { return "room:" + id + ":roles" }       // hash: clientID -> offer|answer|peer
 func kOfferSDP(id string) string      { return "room:" + id + ":offer" }       // string
 func kAnswerSDP(id string) string     { return "room:" + id + ":answer" }      // string
 func kICEList(id, side string) string { return "room:" + id + ":ice:" + side } // list backlog for side (offer|answer)
-func chICE(id, to string) string      { return "chan:" + id + ":ice:" + to }   // pubsub for to=offer|answer
+func kSDPList(id, side string) string { return "room:" + id + ":sdp:" + side } // list of later descriptions from side
 
 type joinReq struct {
 	ClientID string `json:"clientId"`
+	Role     string `json:"role,omitempty"` // "peer" or "viewer" for a mesh room
+	credentials
 }
 type sdpReq struct {
 	SDP string `json:"sdp"`
@@ -40,6 +51,15 @@ type sdpReq struct {
 type iceReq struct {
 	Candidate string `json:"candidate"`
 }
+type descReq struct {
+	Type string `json:"type"`
+	SDP  string `json:"sdp"`
+}
+type descMsg struct {
+	Seq  int    `json:"seq"`
+	Type string `json:"type"`
+	SDP  string `json:"sdp"`
+}
 
 func writeJSON(w http.ResponseWriter, v any) {
 	w.Header().Set("Content-Type", "application/json")
@@ -53,70 +73,41 @@ func joinRoom(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "missing clientId", http.StatusBadRequest)
 		return
 	}
-
-	rolesKey := kRoles(id)
-	roles, _ := rdb.HGetAll(ctx, rolesKey).Result()
-
-	// already joined?
-	if role, ok := roles[req.ClientID]; ok {
-		rdb.Expire(ctx, rolesKey, ttl)
-		writeJSON(w, map[string]string{"role": role})
-		return
-	}
-
-	// assign role: first -> offer, second -> answer, else full
-	haveOffer, haveAnswer := false, false
-	for _, role := range roles {
-		if role == "offer" {
-			haveOffer = true
-		}
-		if role == "answer" {
-			haveAnswer = true
-		}
-	}
-	if haveOffer && haveAnswer {
-		http.Error(w, "room full", http.StatusConflict)
-		return
-	}
-	role := "offer"
-	if haveOffer {
-		role = "answer"
-	}
-
-	if err := rdb.HSet(ctx, rolesKey, req.ClientID, role).Err(); err != nil {
-		http.Error(w, "server error", http.StatusInternalServerError)
+	role, secret, err := join(id, req.ClientID, req.Role, req.credentials)
+	if err != nil {
+		fail(w, err)
 		return
 	}
-	rdb.Expire(ctx, rolesKey, ttl)
-	writeJSON(w, map[string]string{"role": role})
+	writeJSON(w, map[string]string{"role": role, "secret": secret})
 }
 
 func postOffer(w http.ResponseWriter, r *http.Request) {
 	id := r.PathValue("id")
-	clientID := r.URL.Query().Get("clientId")
+	clientID, err := authorize(r, id)
+	if err != nil {
+		fail(w, err)
+		return
+	}
 	var req sdpReq
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.SDP == "" {
 		http.Error(w, "bad sdp", 400)
 		return
 	}
-	role, _ := rdb.HGet(ctx, kRoles(id), clientID).Result()
-	if role != "offer" {
-		http.Error(w, "forbidden", 403)
+	if err := setOffer(id, clientID, req.SDP); err != nil {
+		fail(w, err)
 		return
 	}
-	if err := rdb.Set(ctx, kOfferSDP(id), req.SDP, ttl).Err(); err != nil {
-		http.Error(w, "server", 500)
-		return
-	}
-	// reset answer's backlog because it will consume fresh ICE from offer
-	rdb.Del(ctx, kICEList(id, "offer"))
 	writeJSON(w, map[string]string{"ok": "1"})
 }
 
 func getOffer(w http.ResponseWriter, r *http.Request) {
 	id := r.PathValue("id")
-	val, err := rdb.Get(ctx, kOfferSDP(id)).Result()
-	if err == redis.Nil {
+	if _, err := authorize(r, id); err != nil {
+		fail(w, err)
+		return
+	}
+	val, err := store.Get(ctx, kOfferSDP(id))
+	if err == ErrNotFound {
 		http.NotFound(w, r)
 		return
 	}
@@ -129,30 +120,31 @@ func getOffer(w http.ResponseWriter, r *http.Request) {
 
 func postAnswer(w http.ResponseWriter, r *http.Request) {
 	id := r.PathValue("id")
-	clientID := r.URL.Query().Get("clientId")
+	clientID, err := authorize(r, id)
+	if err != nil {
+		fail(w, err)
+		return
+	}
 	var req sdpReq
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.SDP == "" {
 		http.Error(w, "bad sdp", 400)
 		return
 	}
-	role, _ := rdb.HGet(ctx, kRoles(id), clientID).Result()
-	if role != "answer" {
-		http.Error(w, "forbidden", 403)
-		return
-	}
-	if err := rdb.Set(ctx, kAnswerSDP(id), req.SDP, ttl).Err(); err != nil {
-		http.Error(w, "server", 500)
+	if err := setAnswer(id, clientID, req.SDP); err != nil {
+		fail(w, err)
 		return
 	}
-	// reset offer's backlog because it will consume fresh ICE from answer
-	rdb.Del(ctx, kICEList(id, "answer"))
 	writeJSON(w, map[string]string{"ok": "1"})
 }
 
 func getAnswer(w http.ResponseWriter, r *http.Request) {
 	id := r.PathValue("id")
-	val, err := rdb.Get(ctx, kAnswerSDP(id)).Result()
-	if err == redis.Nil {
+	if _, err := authorize(r, id); err != nil {
+		fail(w, err)
+		return
+	}
+	val, err := store.Get(ctx, kAnswerSDP(id))
+	if err == ErrNotFound {
 		http.NotFound(w, r)
 		return
 	}
@@ -163,94 +155,78 @@ func getAnswer(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, map[string]string{"sdp": val})
 }
 
-// POST /room/{id}/ice?from=offer|answer&clientId=...
-func postICE(w http.ResponseWriter, r *http.Request) {
+// POST /room/{id}/sdp?from=offer|answer&clientId=...
+// Descriptions after the initial offer/answer (new tracks, ICE restarts).
+// Either side may send offers and answers; they are kept in order per sender.
+func postSDP(w http.ResponseWriter, r *http.Request) {
 	id := r.PathValue("id")
-	from := r.URL.Query().Get("from") // role of sender
-	clientID := r.URL.Query().Get("clientId")
-	if from != "offer" && from != "answer" {
-		http.Error(w, "from must be offer|answer", 400)
+	clientID, err := authorize(r, id)
+	if err != nil {
+		fail(w, err)
 		return
 	}
-
-	role, _ := rdb.HGet(ctx, kRoles(id), clientID).Result()
-	if role != from {
-		http.Error(w, "forbidden", 403)
+	var req descReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad description", 400)
 		return
 	}
+	n, err := addDescription(id, r.URL.Query().Get("from"), clientID, req.Type, req.SDP)
+	if err != nil {
+		fail(w, err)
+		return
+	}
+	writeJSON(w, map[string]int{"seq": n})
+}
 
-	var req iceReq
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Candidate == "" {
-		http.Error(w, "bad candidate", 400)
+// GET /room/{id}/sdp?from=offer|answer&after=N&clientId=... -> descriptions after seq N
+func getSDP(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if _, err := authorize(r, id); err != nil {
+		fail(w, err)
 		return
 	}
-	// store in sender backlog (useful for history) and publish to the opposite
-	if err := rdb.RPush(ctx, kICEList(id, from), req.Candidate).Err(); err != nil {
-		http.Error(w, "server", 500)
+	from := r.URL.Query().Get("from")
+	if from != "offer" && from != "answer" {
+		http.Error(w, "from must be offer|answer", 400)
 		return
 	}
-	rdb.Expire(ctx, kICEList(id, from), ttl)
-
-	to := "offer"
-	if from == "offer" {
-		to = "answer"
+	after, _ := strconv.Atoi(r.URL.Query().Get("after"))
+	if after < 0 {
+		after = 0
 	}
-	if err := rdb.Publish(ctx, chICE(id, to), req.Candidate).Err(); err != nil {
+	vals, err := store.Range(ctx, kSDPList(id, from), after)
+	if err != nil {
 		http.Error(w, "server", 500)
 		return
 	}
-	writeJSON(w, map[string]string{"ok": "1"})
+	out := make([]descMsg, 0, len(vals))
+	for i, v := range vals {
+		var d descReq
+		if json.Unmarshal([]byte(v), &d) == nil {
+			out = append(out, descMsg{Seq: after + i + 1, Type: d.Type, SDP: d.SDP})
+		}
+	}
+	writeJSON(w, map[string]any{"descriptions": out})
 }
 
-// GET /room/{id}/ice?to=offer|answer   (SSE stream)
-func streamICE(w http.ResponseWriter, r *http.Request) {
+// POST /room/{id}/ice?from=offer|answer&clientId=...
+func postICE(w http.ResponseWriter, r *http.Request) {
 	id := r.PathValue("id")
-	to := r.URL.Query().Get("to")
-	if to != "offer" && to != "answer" {
-		http.Error(w, "to must be offer|answer", 400)
+	clientID, err := authorize(r, id)
+	if err != nil {
+		fail(w, err)
 		return
 	}
-
-	flusher, ok := w.(http.Flusher)
-	if !ok {
-		http.Error(w, "no flush", 500)
+	var req iceReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad candidate", 400)
 		return
 	}
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
-
-	// backlog first
-	vals, _ := rdb.LRange(ctx, kICEList(id, to), 0, -1).Result()
-	for _, c := range vals {
-		fmt.Fprintf(w, "data: %s\n\n", c)
-	}
-	flusher.Flush()
-
-	// live
-	sub := rdb.Subscribe(ctx, chICE(id, to))
-	defer sub.Close()
-
-	ch := sub.Channel()
-	tick := time.NewTicker(15 * time.Second)
-	defer tick.Stop()
-
-	for {
-		select {
-		case m := <-ch:
-			if m == nil {
-				return
-			}
-			fmt.Fprintf(w, "data: %s\n\n", m.Payload)
-			flusher.Flush()
-		case <-r.Context().Done():
-			return
-		case <-tick.C:
-			// keep-alive
-			fmt.Fprint(w, ": ping\n\n")
-			flusher.Flush()
-		}
+	if err := addICE(id, r.URL.Query().Get("from"), clientID, req.Candidate); err != nil {
+		fail(w, err)
+		return
 	}
+	writeJSON(w, map[string]string{"ok": "1"})
 }
 
 // GET /ice -> returns { "ice_servers": [ {urls, username, credential}, ... ] }
@@ -382,48 +358,36 @@ func main() {
 		log.Printf("Warning: Could not load .env.development: %v", err)
 	}
 
-	// REDIS_URL like: redis://:password@host:6379/0  (or leave empty for localhost)
-	redisAddr := "127.0.0.1:6379"
-	if env := os.Getenv("REDIS_ADDR"); env != "" {
-		redisAddr = env
+	// SIGNALER_STORE or -store picks the backend; memory needs no Redis
+	storeKind := os.Getenv("SIGNALER_STORE")
+	if storeKind == "" {
+		storeKind = "redis"
 	}
-
-	redisOpts := &redis.Options{Addr: redisAddr}
-
-	// Support full Redis URL format
-	if redisURL := os.Getenv("REDIS_URL"); redisURL != "" {
-		log.Printf("Using REDIS_URL: %s", redisURL)
-		opts, err := redis.ParseURL(redisURL)
-		if err != nil {
-			log.Fatal("Invalid REDIS_URL:", err)
-		}
-		log.Printf("Parsed Redis config - Addr: %s, Username: %s", opts.Addr, opts.Username)
-		redisOpts = opts
-	} else {
-		log.Printf("No REDIS_URL found, using default: %s", redisAddr)
+	flag.StringVar(&storeKind, "store", storeKind, "State backend: redis or memory (env SIGNALER_STORE)")
+	flag.BoolVar(&sfuEnabled, "sfu", sfuFromEnv(), "Forward mesh rooms through the server instead of peer to peer (env SIGNALER_SFU)")
+	flag.Parse()
+	loadInviteKey()
+	adminToken = os.Getenv("SIGNALER_ADMIN_TOKEN")
+	if sfuEnabled {
+		sfuAPI = newSFUAPI()
 	}
 
-	rdb = redis.NewClient(redisOpts)
-
-	// Test Redis connection immediately
-	log.Println("Testing Redis connection...")
-	if err := rdb.Ping(ctx).Err(); err != nil {
-		log.Printf("❌ Redis connection failed: %v", err)
-		log.Printf("Redis config: Addr=%s, Username=%s", redisOpts.Addr, redisOpts.Username)
-	} else {
-		log.Println("✅ Redis connection successful!")
+	var err error
+	store, err = newStore(storeKind)
+	if err != nil {
+		log.Fatal("Invalid store: ", err)
 	}
 
 	mux := http.NewServeMux()
 
 	// Health check endpoint
 	mux.HandleFunc("GET /health", func(w http.ResponseWriter, r *http.Request) {
-		// Check Redis connection
-		if err := rdb.Ping(ctx).Err(); err != nil {
-			http.Error(w, "Redis unavailable", http.StatusServiceUnavailable)
+		// Check the store (Redis) connection
+		if err := store.Ping(ctx); err != nil {
+			http.Error(w, storeKind+" store unavailable", http.StatusServiceUnavailable)
 			return
 		}
-		writeJSON(w, map[string]string{"status": "healthy", "service": "snapshell-signaler"})
+		writeJSON(w, map[string]string{"status": "healthy", "service": "snapshell-signaler", "store": storeKind})
 	})
 
 	// Root endpoint with service info
@@ -431,23 +395,44 @@ func main() {
 		writeJSON(w, map[string]string{
 			"service":   "SnapShell WebRTC Signaling Server",
 			"version":   "1.1.0",
-			"endpoints": "/room/{id}/join, /room/{id}/offer, /room/{id}/answer, /room/{id}/ice",
+			"endpoints": "/room/{id}/join, /room/{id}/invite, /room/{id}/leave, /room/{id}/heartbeat, /room/{id}/offer, /room/{id}/answer, /room/{id}/sdp, /room/{id}/ice, /room/{id}/signal, /room/{id}/events, /room/{id}/ws, /call/?room={id}, /admin/rooms",
 		})
 	})
 
+	// Browser client: join a room without the CLI at /call/?room=<id>
+	web, err := fs.Sub(webClient, "web")
+	if err != nil {
+		log.Fatal(err)
+	}
+	mux.Handle("GET /call/", http.StripPrefix("/call/", http.FileServer(http.FS(web))))
 	mux.HandleFunc("POST /room/{id}/join", joinRoom)
+	mux.HandleFunc("POST /room/{id}/invite", postInvite)
+	mux.HandleFunc("POST /room/{id}/leave", postLeave)
+	mux.HandleFunc("POST /room/{id}/heartbeat", postHeartbeat)
 	mux.HandleFunc("POST /room/{id}/offer", postOffer)
 	mux.HandleFunc("GET /room/{id}/offer", getOffer)
 	mux.HandleFunc("POST /room/{id}/answer", postAnswer)
 	mux.HandleFunc("GET /room/{id}/answer", getAnswer)
+	mux.HandleFunc("POST /room/{id}/sdp", postSDP)
+	mux.HandleFunc("GET /room/{id}/sdp", getSDP)
 	mux.HandleFunc("POST /room/{id}/ice", postICE)
 	mux.HandleFunc("GET /room/{id}/ice", streamICE)
+	mux.HandleFunc("POST /room/{id}/signal", postSignal)
+	mux.HandleFunc("GET /room/{id}/events", streamEvents)
+	mux.Handle("GET /room/{id}/ws", websocket.Server{Handler: roomWS})
 	mux.HandleFunc("GET /ice", getICEServers)
+	mux.HandleFunc("GET /admin/rooms", getRooms)
+	mux.HandleFunc("GET /admin/rooms/{id}", getRoom)
 
 	addr := ":8080"
 	if port := os.Getenv("PORT"); port != "" {
 		addr = ":" + port
 	}
-	log.Println("signaler (redis) listening on", addr)
+	mode := storeKind
+	if sfuEnabled {
+		mode += ", sfu"
+	}
+	go reapRooms()
+	log.Printf("signaler (%s) listening on %s", mode, addr)
 	log.Fatal(http.ListenAndServe(addr, mux))
 }
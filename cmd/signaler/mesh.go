@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	sig "github.com/saswatsam786/snapshell/internal/signal"
+)
+
+// maxMeshPeers caps a mesh room; every member uploads its video once per
+// other member. Through the SFU each uploads it once.
+const (
+	maxMeshPeers  = 8
+	maxSFUPeers   = 32
+	maxSFUViewers = 256
+)
+
+// Mesh rooms: every member joins as a peer and keeps one connection to each
+// other peer. The server only relays the offers, answers and candidates of
+// each pair, addressed with To; sig.MeshOfferer decides which side of a pair
+// offers, so a pair never collides. Viewers are offered a link by every
+// peer, or by both sides of a two-person call, and never talk to each other.
+
+// POST /room/{id}/signal?clientId=...
+// Body: {"type":"offer"|"answer"|"candidate","to":<clientId>,"sdp"|"candidate":...}
+func postSignal(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	clientID, err := authorize(r, id)
+	if err != nil {
+		fail(w, err)
+		return
+	}
+	var m sig.Message
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+		http.Error(w, "bad message", 400)
+		return
+	}
+	if err := relay(id, clientID, m); err != nil {
+		fail(w, err)
+		return
+	}
+	writeJSON(w, map[string]string{"ok": "1"})
+}
+
+// relay forwards a pair's offer, answer or candidate from one member of a
+// mesh room to another, or between a side of a two-person call and a
+// viewer, through the room's event log
+func relay(id, from string, m sig.Message) error {
+	if m.To == "" || m.To == from {
+		return &roomError{http.StatusBadRequest, "bad recipient"}
+	}
+	roles, _ := store.HashGetAll(ctx, kRoles(id))
+	fromRole, toRole := roles[from], roles[m.To]
+	if !meshRole(fromRole) && !callRole(fromRole) {
+		return errForbidden
+	}
+	switch {
+	case toRole == sig.RoleViewer && fromRole == sig.RoleViewer:
+		return &roomError{http.StatusBadRequest, "viewers do not connect to each other"}
+	case callRole(fromRole) && callRole(toRole):
+		return &roomError{http.StatusBadRequest, "the sides of a call signal through its offer and answer"}
+	case callRole(fromRole) && toRole != sig.RoleViewer, callRole(toRole) && fromRole != sig.RoleViewer:
+		return &roomError{http.StatusNotFound, "no such peer"}
+	case !meshRole(toRole) && !callRole(toRole) && toRole != sig.RoleSFU:
+		return &roomError{http.StatusNotFound, "no such peer"}
+	}
+	out := sig.Message{Type: m.Type, ClientID: from, To: m.To}
+	switch m.Type {
+	case sig.MsgOffer:
+		if offerer(from, fromRole, m.To, toRole) != from {
+			return &roomError{http.StatusConflict, "the other peer offers"}
+		}
+		fallthrough
+	case sig.MsgAnswer:
+		if m.SDP == "" {
+			return &roomError{http.StatusBadRequest, "bad sdp"}
+		}
+		out.SDP = m.SDP
+	case sig.MsgCandidate:
+		if m.Candidate == "" {
+			return &roomError{http.StatusBadRequest, "bad candidate"}
+		}
+		out.Candidate = m.Candidate
+	default:
+		return &roomError{http.StatusBadRequest, "bad message type"}
+	}
+	publishEvent(id, out)
+	return nil
+}
+
+// offerer is who offers in a pair: everyone to the SFU, peers and the
+// sides of a call to viewers, and of two peers the one sig.MeshOfferer picks
+func offerer(a, aRole, b, bRole string) string {
+	switch {
+	case bRole == sig.RoleSFU, bRole == sig.RoleViewer:
+		return a
+	case aRole == sig.RoleViewer:
+		return b
+	}
+	return sig.MeshOfferer(a, b)
+}
+
+// meshRole reports whether role belongs to a mesh room's members, who get
+// only the signals addressed to them
+func meshRole(role string) bool {
+	return role == sig.RolePeer || role == sig.RoleViewer
+}
+
+// callRole reports whether role is a side of a two-person call
+func callRole(role string) bool {
+	return role == "offer" || role == "answer"
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+
+	sig "github.com/saswatsam786/snapshell/internal/signal"
+)
+
+// Room operations shared by the REST handlers and the WebSocket. Each one
+// records what it changed in the room's event log and publishes it, so
+// clients on any transport hear about it and event streams can resume.
+
+func kEvents(id string) string { return "room:" + id + ":events" } // list of roomEvent JSON, ID = position
+func chRoom(id string) string  { return "chan:" + id + ":events" } // pubsub of roomEvent JSON
+
+// roomEvent is one entry of a room's event log
+type roomEvent struct {
+	ID  int         `json:"id"`
+	Msg sig.Message `json:"msg"`
+}
+
+// publishMu keeps events published in log order
+var publishMu sync.Mutex
+
+// roomError is a failed operation with the HTTP status it maps to
+type roomError struct {
+	code int
+	msg  string
+}
+
+func (e *roomError) Error() string { return e.msg }
+
+var (
+	errForbidden = &roomError{http.StatusForbidden, "forbidden"}
+	errServer    = &roomError{http.StatusInternalServerError, "server"}
+)
+
+// fail writes err as an HTTP error
+func fail(w http.ResponseWriter, err error) {
+	if e, ok := err.(*roomError); ok {
+		http.Error(w, e.msg, e.code)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+func publishEvent(id string, m sig.Message) {
+	publishMu.Lock()
+	defer publishMu.Unlock()
+	b, _ := json.Marshal(m)
+	n, err := store.Append(ctx, kEvents(id), string(b), ttl)
+	if err != nil {
+		return
+	}
+	b, _ = json.Marshal(roomEvent{ID: n, Msg: m})
+	store.Publish(ctx, chRoom(id), string(b))
+}
+
+// message is the event as pushed to a client. Messages addressed to one
+// peer carry their event ID so a client can skip them when replayed.
+func (ev roomEvent) message() sig.Message {
+	m := ev.Msg
+	if m.To != "" {
+		m.ID = ev.ID
+	}
+	return m
+}
+
+// roomEvents returns the logged events after ID after
+func roomEvents(id string, after int) []roomEvent {
+	vals, _ := store.Range(ctx, kEvents(id), after)
+	out := make([]roomEvent, 0, len(vals))
+	for i, v := range vals {
+		var m sig.Message
+		if json.Unmarshal([]byte(v), &m) == nil {
+			out = append(out, roomEvent{ID: after + i + 1, Msg: m})
+		}
+	}
+	return out
+}
+
+// lastEventID is the ID of the newest logged event
+func lastEventID(id string) int {
+	n, _ := store.Len(ctx, kEvents(id))
+	return n
+}
+
+func otherSide(role string) string {
+	if role == "offer" {
+		return "answer"
+	}
+	return "offer"
+}
+
+// join returns clientID's role in room id, assigning a free one: first
+// offer, then answer. Asking for sig.RolePeer joins a mesh room instead,
+// where every member is a peer; the two kinds of room do not mix. Viewers
+// watch either kind of room and count toward neither limit.
+//
+// A new member must be admitted (see admit) and gets a secret; joining
+// again takes that secret.
+func join(id, clientID, want string, c credentials) (role, secret string, err error) {
+	rolesKey := kRoles(id)
+	roles, _ := store.HashGetAll(ctx, rolesKey)
+
+	// already joined?
+	if role, ok := roles[clientID]; ok {
+		if checkSecret(id, clientID, c.Secret) != nil {
+			return "", "", &roomError{http.StatusForbidden, "client ID already in the room"}
+		}
+		refreshRoom(id)
+		return role, c.Secret, nil
+	}
+	if err := admit(id, roles, c); err != nil {
+		return "", "", err
+	}
+
+	// assign role: first -> offer, second -> answer, else full
+	haveOffer, haveAnswer, peers, viewers := false, false, 0, 0
+	for _, role := range roles {
+		if role == "offer" {
+			haveOffer = true
+		}
+		if role == "answer" {
+			haveAnswer = true
+		}
+		if role == sig.RolePeer {
+			peers++
+		}
+		if role == sig.RoleViewer {
+			viewers++
+		}
+	}
+	switch want {
+	case sig.RolePeer:
+		if haveOffer || haveAnswer {
+			return "", "", &roomError{http.StatusConflict, "room is a two-person call"}
+		}
+		limit := maxMeshPeers
+		if sfuEnabled {
+			limit = maxSFUPeers
+		}
+		if peers >= limit {
+			return "", "", &roomError{http.StatusConflict, "room full"}
+		}
+		role = sig.RolePeer
+	case sig.RoleViewer:
+		// without the SFU every peer uploads to every viewer; the sides of
+		// a two-person call always do
+		limit := maxMeshPeers
+		if sfuEnabled && !haveOffer && !haveAnswer {
+			limit = maxSFUViewers
+		}
+		if viewers >= limit {
+			return "", "", &roomError{http.StatusConflict, "too many viewers"}
+		}
+		role = sig.RoleViewer
+	case "":
+		if peers > 0 {
+			return "", "", &roomError{http.StatusConflict, "room is a mesh call; join with --mesh"}
+		}
+		if viewers > maxMeshPeers {
+			return "", "", &roomError{http.StatusConflict, "too many viewers for a two-person call"}
+		}
+		if haveOffer && haveAnswer {
+			return "", "", &roomError{http.StatusConflict, "room full"}
+		}
+		role = "offer"
+		if haveOffer {
+			role = "answer"
+		}
+	default:
+		return "", "", &roomError{http.StatusBadRequest, "unknown role " + want}
+	}
+
+	if sfuEnabled && role == sig.RolePeer {
+		// the SFU is in the room before its first peer
+		if err := startSFU(id); err != nil {
+			log.Printf("sfu %s: %v", id, err)
+			return "", "", errServer
+		}
+	}
+	if secret, err = issueSecret(id, clientID); err != nil {
+		return "", "", err
+	}
+	if err := store.HashSet(ctx, rolesKey, clientID, role, ttl); err != nil {
+		return "", "", &roomError{http.StatusInternalServerError, "server error"}
+	}
+	recordJoin(id, clientID)
+	publishEvent(id, sig.Message{Type: sig.MsgPresence, ClientID: clientID, Role: role, Event: "joined"})
+	return role, secret, nil
+}
+
+// checkRole fails unless clientID holds role in room id
+func checkRole(id, clientID, role string) error {
+	got, _ := store.HashGet(ctx, kRoles(id), clientID)
+	if got != role {
+		return errForbidden
+	}
+	return nil
+}
+
+func setOffer(id, clientID, sdp string) error {
+	if err := checkRole(id, clientID, "offer"); err != nil {
+		return err
+	}
+	if err := store.Set(ctx, kOfferSDP(id), sdp, ttl); err != nil {
+		return errServer
+	}
+	// reset answer's backlog because it will consume fresh ICE from offer
+	store.Del(ctx, kICEList(id, "offer"))
+	// a new offer starts a new session: it needs a new answer, and
+	// renegotiation from the previous one no longer applies
+	store.Del(ctx, kAnswerSDP(id), kSDPList(id, "offer"), kSDPList(id, "answer"))
+	setPhase(id, clientID, sig.PhaseOffered)
+	publishEvent(id, sig.Message{Type: sig.MsgOffer, Role: "offer", SDP: sdp})
+	return nil
+}
+
+func setAnswer(id, clientID, sdp string) error {
+	if err := checkRole(id, clientID, "answer"); err != nil {
+		return err
+	}
+	if err := store.Set(ctx, kAnswerSDP(id), sdp, ttl); err != nil {
+		return errServer
+	}
+	// reset offer's backlog because it will consume fresh ICE from answer
+	store.Del(ctx, kICEList(id, "answer"))
+	setPhase(id, clientID, sig.PhaseAnswered)
+	publishEvent(id, sig.Message{Type: sig.MsgAnswer, Role: "answer", SDP: sdp})
+	return nil
+}
+
+// addDescription appends a renegotiation description from role from and
+// returns its sequence number
+func addDescription(id, from, clientID, typ, sdp string) (int, error) {
+	if from != "offer" && from != "answer" {
+		return 0, &roomError{http.StatusBadRequest, "from must be offer|answer"}
+	}
+	if err := checkRole(id, clientID, from); err != nil {
+		return 0, err
+	}
+	if sdp == "" || (typ != "offer" && typ != "answer") {
+		return 0, &roomError{http.StatusBadRequest, "bad description"}
+	}
+	b, _ := json.Marshal(descReq{Type: typ, SDP: sdp})
+	n, err := store.Append(ctx, kSDPList(id, from), string(b), ttl)
+	if err != nil {
+		return 0, errServer
+	}
+	publishEvent(id, sig.Message{Type: sig.MsgDescription, Role: from, SDPType: typ, SDP: sdp, Seq: n})
+	return n, nil
+}
+
+// addICE stores a candidate from role from and sends it to the other side
+func addICE(id, from, clientID, cand string) error {
+	if from != "offer" && from != "answer" {
+		return &roomError{http.StatusBadRequest, "from must be offer|answer"}
+	}
+	if err := checkRole(id, clientID, from); err != nil {
+		return err
+	}
+	if cand == "" {
+		return &roomError{http.StatusBadRequest, "bad candidate"}
+	}
+	// store in sender backlog (replayed to late subscribers) and publish to
+	// the opposite side
+	if _, err := store.Append(ctx, kICEList(id, from), cand, ttl); err != nil {
+		return errServer
+	}
+	publishEvent(id, sig.Message{Type: sig.MsgCandidate, Role: from, Candidate: cand})
+	return nil
+}
@@ -0,0 +1,724 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	sig "github.com/saswatsam786/snapshell/internal/signal"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+	"golang.org/x/net/context"
+)
+
+// SFU mode (-sfu): a mesh room gets one more member, sig.SFUID, run by the
+// signaler itself. Peers connect to it alone and send their frames once;
+// it forwards every peer's "ascii" messages to the other peers and the
+// viewers on channels labelled "ascii:<peer>", and media tracks as tracks
+// with the peer as stream ID. A peer's upload is the same however many
+// watch. Each receiver has its own slot per sender holding the newest
+// frame it has not taken yet, so a slow receiver skips frames instead of
+// holding back the rest.
+
+// sfuEnabled is set by -sfu or SIGNALER_SFU
+var sfuEnabled bool
+
+// Per receiver and sender: frames go out while the channel's buffer is
+// below sfuBufferedHigh, the newest one waits otherwise and is sent when
+// the buffer drains below sfuBufferedLow
+const (
+	sfuBufferedHigh = 128 * 1024
+	sfuBufferedLow  = 32 * 1024
+)
+
+var (
+	sfuMu    sync.Mutex
+	sfuRooms = map[string]*sfuRoom{}
+	sfuAPI   *webrtc.API
+)
+
+// sfuRoom is the SFU of one room
+type sfuRoom struct {
+	id     string
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	members map[string]string // peers and viewers in the room, connected or not, by role
+	peers   map[string]*sfuPeer
+	tracks  map[string][]*sfuTrack // by publishing peer
+}
+
+// sfuTrack is a peer's media track as forwarded to the others
+type sfuTrack struct {
+	local *webrtc.TrackLocalStaticRTP
+	from  *sfuPeer
+	ssrc  webrtc.SSRC
+}
+
+// sfuPeer is the SFU's connection to one peer
+type sfuPeer struct {
+	id     string
+	pc     *webrtc.PeerConnection
+	viewer bool // receives only
+
+	mu        sync.Mutex
+	connected bool
+	remoteSet bool
+	cands     []webrtc.ICECandidateInit // until the remote description is set
+	ctrl      *webrtc.DataChannel
+	viewport  sfuViewport // the peer's tile size
+	sentVP    sfuViewport // the frame size last asked of the peer
+	out       map[string]*sfuOut
+	senders   map[string][]*webrtc.RTPSender // forwarded tracks, by publisher
+	// renegotiation after tracks were added: one offer at a time
+	negotiating, again bool
+}
+
+// sfuOut is one sender's frames on the way to one receiver
+type sfuOut struct {
+	dc *webrtc.DataChannel
+
+	mu      sync.Mutex
+	open    bool
+	pending []byte // the newest frame not sent yet
+}
+
+type sfuViewport struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// sfuControl is the part of the peers' control channel messages the SFU
+// speaks (internal/webrtc's ControlMessage)
+type sfuControl struct {
+	Type     string       `json:"type"`
+	Hello    *sfuHello    `json:"hello,omitempty"`
+	Viewport *sfuViewport `json:"viewport,omitempty"`
+}
+
+type sfuHello struct {
+	Version      int      `json:"version"`
+	Capabilities []string `json:"capabilities"`
+}
+
+// newSFUAPI sets up pion for the SFU. SFU_PUBLIC_IP announces the server's
+// public address when it sits behind 1:1 NAT.
+func newSFUAPI() *webrtc.API {
+	var se webrtc.SettingEngine
+	if ip := os.Getenv("SFU_PUBLIC_IP"); ip != "" {
+		if net.ParseIP(ip) == nil {
+			log.Fatal("Invalid SFU_PUBLIC_IP: ", ip)
+		}
+		se.SetNAT1To1IPs([]string{ip}, webrtc.ICECandidateTypeHost)
+	}
+	return webrtc.NewAPI(webrtc.WithSettingEngine(se))
+}
+
+// startSFU makes sure room id has its SFU, starting one here unless the
+// room has one already (possibly on another signaler sharing the store)
+func startSFU(id string) error {
+	sfuMu.Lock()
+	defer sfuMu.Unlock()
+	if sfuRooms[id] != nil {
+		return nil
+	}
+	if r, _ := store.HashGet(ctx, kRoles(id), sig.SFUID); r == sig.RoleSFU {
+		return nil
+	}
+
+	rctx, cancel := context.WithCancel(ctx)
+	// subscribe before joining so no signal for the SFU falls in between
+	ch, err := store.Subscribe(rctx, chRoom(id))
+	if err != nil {
+		cancel()
+		return err
+	}
+	if err := store.HashSet(ctx, kRoles(id), sig.SFUID, sig.RoleSFU, ttl); err != nil {
+		cancel()
+		return err
+	}
+	recordJoin(id, sig.SFUID)
+	s := &sfuRoom{
+		id: id, ctx: rctx, cancel: cancel,
+		members: map[string]string{},
+		peers:   map[string]*sfuPeer{},
+		tracks:  map[string][]*sfuTrack{},
+	}
+	// viewers may have come before the first peer
+	roles, _ := store.HashGetAll(ctx, kRoles(id))
+	for cid, role := range roles {
+		if meshRole(role) {
+			s.members[cid] = role
+		}
+	}
+	sfuRooms[id] = s
+	publishEvent(id, sig.Message{Type: sig.MsgPresence, ClientID: sig.SFUID, Role: sig.RoleSFU, Event: "joined"})
+	log.Printf("sfu %s: started", id)
+	go s.run(ch)
+	return nil
+}
+
+// run handles the room's events until the SFU closes
+func (s *sfuRoom) run(ch <-chan string) {
+	// the room's roles expire with the SFU's entry when nobody rejoins
+	check := time.NewTicker(time.Minute)
+	defer check.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-check.C:
+			if r, _ := store.HashGet(ctx, kRoles(s.id), sig.SFUID); r != sig.RoleSFU {
+				s.close()
+			}
+		case e, ok := <-ch:
+			if !ok {
+				return
+			}
+			var ev roomEvent
+			if json.Unmarshal([]byte(e), &ev) == nil {
+				s.handle(ev.Msg)
+			}
+		}
+	}
+}
+
+func (s *sfuRoom) handle(m sig.Message) {
+	switch {
+	case m.Type == sig.MsgPresence && meshRole(m.Role):
+		s.mu.Lock()
+		if m.Event == "joined" {
+			s.members[m.ClientID] = m.Role
+		} else {
+			delete(s.members, m.ClientID)
+		}
+		empty := len(s.members) == 0
+		s.mu.Unlock()
+		if m.Event == "left" {
+			s.removePeer(m.ClientID)
+			if empty {
+				s.close()
+			}
+		}
+	case m.To == sig.SFUID:
+		var err error
+		switch m.Type {
+		case sig.MsgOffer:
+			err = s.answer(m.ClientID, m.SDP)
+		case sig.MsgAnswer:
+			err = s.answered(m.ClientID, m.SDP)
+		case sig.MsgCandidate:
+			s.candidate(m.ClientID, m.Candidate)
+		}
+		if err != nil {
+			log.Printf("sfu %s: %s from %s: %v", s.id, m.Type, m.ClientID, err)
+		}
+	}
+}
+
+// close leaves the room and stops every connection
+func (s *sfuRoom) close() {
+	sfuMu.Lock()
+	if sfuRooms[s.id] == s {
+		delete(sfuRooms, s.id)
+	}
+	sfuMu.Unlock()
+	s.cancel()
+
+	s.mu.Lock()
+	peers := s.peers
+	s.peers = map[string]*sfuPeer{}
+	s.mu.Unlock()
+	for _, p := range peers {
+		_ = p.pc.Close()
+	}
+	store.HashDel(ctx, kRoles(s.id), sig.SFUID)
+	store.HashDel(ctx, kJoined(s.id), sig.SFUID)
+	store.HashDel(ctx, kPhase(s.id), sig.SFUID)
+	publishEvent(s.id, sig.Message{Type: sig.MsgPresence, ClientID: sig.SFUID, Role: sig.RoleSFU, Event: "left"})
+	log.Printf("sfu %s: closed", s.id)
+}
+
+// send signals a peer through the room's event log, as relay would
+func (s *sfuRoom) send(to string, m sig.Message) {
+	m.ClientID, m.To = sig.SFUID, to
+	publishEvent(s.id, m)
+}
+
+// answer accepts a peer's offer. Peers only answer once connected, so an
+// offer means the peer started over.
+func (s *sfuRoom) answer(from, sdp string) error {
+	p, err := s.newPeer(from)
+	if err != nil {
+		return err
+	}
+	if err := p.pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: sdp}); err != nil {
+		return err
+	}
+	p.remoteReady()
+	answer, err := p.pc.CreateAnswer(nil)
+	if err != nil {
+		return err
+	}
+	if err := p.pc.SetLocalDescription(answer); err != nil {
+		return err
+	}
+	s.send(from, sig.Message{Type: sig.MsgAnswer, SDP: answer.SDP})
+	return nil
+}
+
+// answered applies a peer's answer to our renegotiation offer
+func (s *sfuRoom) answered(from, sdp string) error {
+	s.mu.Lock()
+	p := s.peers[from]
+	s.mu.Unlock()
+	if p == nil {
+		return nil
+	}
+	err := p.pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: sdp})
+	p.mu.Lock()
+	p.negotiating = false
+	again := p.again
+	p.again = false
+	p.mu.Unlock()
+	if again {
+		go s.negotiate(p)
+	}
+	return err
+}
+
+func (s *sfuRoom) candidate(from, b64 string) {
+	s.mu.Lock()
+	p := s.peers[from]
+	s.mu.Unlock()
+	raw, err := base64.StdEncoding.DecodeString(b64)
+	if p == nil || err != nil {
+		return
+	}
+	var init webrtc.ICECandidateInit
+	if json.Unmarshal(raw, &init) != nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.remoteSet {
+		p.cands = append(p.cands, init)
+		return
+	}
+	_ = p.pc.AddICECandidate(init)
+}
+
+func (p *sfuPeer) remoteReady() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.remoteSet {
+		return
+	}
+	p.remoteSet = true
+	for _, init := range p.cands {
+		_ = p.pc.AddICECandidate(init)
+	}
+	p.cands = nil
+}
+
+// newPeer creates the connection to a peer, replacing an earlier one
+func (s *sfuRoom) newPeer(id string) (*sfuPeer, error) {
+	pc, err := sfuAPI.NewPeerConnection(webrtc.Configuration{
+		ICEServers:    []webrtc.ICEServer{{URLs: []string{"stun:stun.l.google.com:19302"}}},
+		BundlePolicy:  webrtc.BundlePolicyMaxBundle,
+		RTCPMuxPolicy: webrtc.RTCPMuxPolicyRequire,
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	viewer := s.members[id] == sig.RoleViewer
+	s.mu.Unlock()
+	p := &sfuPeer{id: id, pc: pc, viewer: viewer, out: map[string]*sfuOut{}, senders: map[string][]*webrtc.RTPSender{}}
+
+	pc.OnICECandidate(func(c *webrtc.ICECandidate) {
+		// nil is end-of-candidates, sent as an empty candidate
+		init := webrtc.ICECandidateInit{}
+		if c != nil {
+			init = c.ToJSON()
+		}
+		b, _ := json.Marshal(init)
+		s.send(id, sig.Message{Type: sig.MsgCandidate, Candidate: base64.StdEncoding.EncodeToString(b)})
+	})
+	pc.OnDataChannel(func(dc *webrtc.DataChannel) {
+		switch dc.Label() {
+		case "control":
+			s.attachControl(p, dc)
+		case "ascii":
+			if viewer {
+				return
+			}
+			dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+				s.forward(id, msg.Data)
+			})
+		}
+	})
+	pc.OnTrack(func(remote *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		if !viewer {
+			s.publishTrack(p, remote)
+		}
+	})
+	pc.OnConnectionStateChange(func(st webrtc.PeerConnectionState) {
+		switch st {
+		case webrtc.PeerConnectionStateConnected:
+			s.connected(p)
+		case webrtc.PeerConnectionStateFailed:
+			s.removePeer(id)
+		}
+	})
+
+	s.mu.Lock()
+	old := s.peers[id]
+	s.peers[id] = p
+	s.mu.Unlock()
+	if old != nil {
+		s.unlink(old)
+		_ = old.pc.Close()
+	}
+	return p, nil
+}
+
+// connected opens the frame channels between a newly connected peer and
+// every other connected one, and sends it the tracks already published
+func (s *sfuRoom) connected(p *sfuPeer) {
+	p.mu.Lock()
+	p.connected = true
+	p.mu.Unlock()
+	log.Printf("sfu %s: %s connected", s.id, p.id)
+	setPhase(s.id, sig.SFUID, sig.PhaseConnected)
+
+	s.mu.Lock()
+	var others []*sfuPeer
+	for _, q := range s.peers {
+		if q != p && q.isConnected() {
+			others = append(others, q)
+		}
+	}
+	var tracks []*sfuTrack
+	for src, ts := range s.tracks {
+		if src != p.id {
+			tracks = append(tracks, ts...)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, q := range others {
+		if !q.viewer {
+			p.openOut(q.id)
+		}
+		if !p.viewer {
+			q.openOut(p.id)
+		}
+	}
+	if len(tracks) > 0 {
+		for _, t := range tracks {
+			s.addTrack(p, t)
+		}
+		s.negotiate(p)
+	}
+	s.viewportsChanged()
+}
+
+func (p *sfuPeer) isConnected() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.connected
+}
+
+// openOut creates the channel carrying src's frames to p
+func (p *sfuPeer) openOut(src string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.out[src] != nil {
+		return
+	}
+	dc, err := p.pc.CreateDataChannel("ascii:"+src, nil)
+	if err != nil {
+		return
+	}
+	o := &sfuOut{dc: dc}
+	dc.SetBufferedAmountLowThreshold(sfuBufferedLow)
+	dc.OnOpen(func() {
+		o.mu.Lock()
+		o.open = true
+		o.flushLocked()
+		o.mu.Unlock()
+	})
+	dc.OnBufferedAmountLow(func() {
+		o.mu.Lock()
+		o.flushLocked()
+		o.mu.Unlock()
+	})
+	p.out[src] = o
+}
+
+// push sends a frame now if the receiver keeps up, and otherwise keeps it
+// in place of the one still waiting
+func (o *sfuOut) push(frame []byte) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.pending = frame
+	if o.open && o.dc.BufferedAmount() < sfuBufferedHigh {
+		o.flushLocked()
+	}
+}
+
+func (o *sfuOut) flushLocked() {
+	if o.pending == nil || !o.open {
+		return
+	}
+	if err := o.dc.Send(o.pending); err == nil {
+		o.pending = nil
+	}
+}
+
+// forward hands a frame from src to every other peer's slot for src
+func (s *sfuRoom) forward(src string, frame []byte) {
+	s.mu.Lock()
+	outs := make([]*sfuOut, 0, len(s.peers))
+	for _, p := range s.peers {
+		p.mu.Lock()
+		if o := p.out[src]; o != nil {
+			outs = append(outs, o)
+		}
+		p.mu.Unlock()
+	}
+	s.mu.Unlock()
+	for _, o := range outs {
+		o.push(frame)
+	}
+}
+
+// attachControl answers a peer's hello and follows its tile size
+func (s *sfuRoom) attachControl(p *sfuPeer, dc *webrtc.DataChannel) {
+	dc.OnOpen(func() {
+		b, _ := json.Marshal(sfuControl{Type: "hello", Hello: &sfuHello{
+			Version: 1, Capabilities: []string{"ascii", "viewport", "timestamps"},
+		}})
+		_ = dc.Send(b)
+		p.mu.Lock()
+		p.ctrl = dc
+		p.mu.Unlock()
+		s.viewportsChanged()
+	})
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		var m sfuControl
+		if json.Unmarshal(msg.Data, &m) != nil {
+			return
+		}
+		switch m.Type {
+		case "viewport":
+			if m.Viewport != nil {
+				p.mu.Lock()
+				p.viewport = *m.Viewport
+				p.mu.Unlock()
+				s.viewportsChanged()
+			}
+		case "bye":
+			s.removePeer(p.id)
+		}
+	})
+}
+
+// viewportsChanged asks each peer for frames that fit the smallest tile it
+// has on the screens of the others and the viewers
+func (s *sfuRoom) viewportsChanged() {
+	s.mu.Lock()
+	peers := make([]*sfuPeer, 0, len(s.peers))
+	for _, p := range s.peers {
+		peers = append(peers, p)
+	}
+	s.mu.Unlock()
+
+	sizes := make([]sfuViewport, len(peers))
+	for i, p := range peers {
+		p.mu.Lock()
+		sizes[i] = p.viewport
+		p.mu.Unlock()
+	}
+	for i, p := range peers {
+		if p.viewer {
+			continue
+		}
+		var want sfuViewport
+		for j, v := range sizes {
+			if j == i || v.Width == 0 {
+				continue
+			}
+			if want.Width == 0 || v.Width*v.Height < want.Width*want.Height {
+				want = v
+			}
+		}
+		p.mu.Lock()
+		ctrl := p.ctrl
+		if ctrl == nil || want.Width == 0 || want == p.sentVP {
+			p.mu.Unlock()
+			continue
+		}
+		p.sentVP = want
+		p.mu.Unlock()
+		b, _ := json.Marshal(sfuControl{Type: "viewport", Viewport: &want})
+		_ = ctrl.Send(b)
+	}
+}
+
+// publishTrack forwards a peer's media track to every other peer
+func (s *sfuRoom) publishTrack(p *sfuPeer, remote *webrtc.TrackRemote) {
+	local, err := webrtc.NewTrackLocalStaticRTP(remote.Codec().RTPCodecCapability, remote.ID(), p.id)
+	if err != nil {
+		log.Printf("sfu %s: track from %s: %v", s.id, p.id, err)
+		return
+	}
+	t := &sfuTrack{local: local, from: p, ssrc: remote.SSRC()}
+	s.mu.Lock()
+	s.tracks[p.id] = append(s.tracks[p.id], t)
+	var others []*sfuPeer
+	for _, q := range s.peers {
+		if q != p && q.isConnected() {
+			others = append(others, q)
+		}
+	}
+	s.mu.Unlock()
+	log.Printf("sfu %s: %s publishes %s", s.id, p.id, remote.Kind())
+
+	for _, q := range others {
+		s.addTrack(q, t)
+		go s.negotiate(q)
+	}
+
+	// the local track writes to every receiver without waiting, so one that
+	// falls behind loses packets and asks for a keyframe
+	go func() {
+		for {
+			pkt, _, err := remote.ReadRTP()
+			if err != nil {
+				return
+			}
+			_ = local.WriteRTP(pkt)
+		}
+	}()
+}
+
+// addTrack sends a forwarded track to p and passes its keyframe requests
+// on to the publisher
+func (s *sfuRoom) addTrack(p *sfuPeer, t *sfuTrack) {
+	sender, err := p.pc.AddTrack(t.local)
+	if err != nil {
+		return
+	}
+	p.mu.Lock()
+	p.senders[t.from.id] = append(p.senders[t.from.id], sender)
+	p.mu.Unlock()
+	t.keyframe()
+	go func() {
+		for {
+			pkts, _, err := sender.ReadRTCP()
+			if err != nil {
+				return
+			}
+			for _, pkt := range pkts {
+				switch pkt.(type) {
+				case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+					t.keyframe()
+				}
+			}
+		}
+	}()
+}
+
+func (t *sfuTrack) keyframe() {
+	if t.local.Kind() == webrtc.RTPCodecTypeVideo {
+		_ = t.from.pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(t.ssrc)}})
+	}
+}
+
+// negotiate offers p the tracks added since its last description. The
+// peer offered first, so it only ever answers ours.
+func (s *sfuRoom) negotiate(p *sfuPeer) {
+	p.mu.Lock()
+	if p.negotiating {
+		p.again = true
+		p.mu.Unlock()
+		return
+	}
+	p.negotiating = true
+	p.mu.Unlock()
+
+	offer, err := p.pc.CreateOffer(nil)
+	if err == nil {
+		err = p.pc.SetLocalDescription(offer)
+	}
+	if err != nil {
+		log.Printf("sfu %s: renegotiate %s: %v", s.id, p.id, err)
+		p.mu.Lock()
+		p.negotiating = false
+		p.mu.Unlock()
+		return
+	}
+	s.send(p.id, sig.Message{Type: sig.MsgOffer, SDP: offer.SDP})
+}
+
+// removePeer closes a peer's connection and its frame channels on the
+// others
+func (s *sfuRoom) removePeer(id string) {
+	s.mu.Lock()
+	p := s.peers[id]
+	delete(s.peers, id)
+	delete(s.tracks, id)
+	s.mu.Unlock()
+	if p == nil {
+		return
+	}
+	s.unlink(p)
+	_ = p.pc.Close()
+	log.Printf("sfu %s: %s gone", s.id, id)
+	s.viewportsChanged()
+}
+
+// unlink closes the channels and tracks carrying p's frames and media to
+// the others
+func (s *sfuRoom) unlink(p *sfuPeer) {
+	s.mu.Lock()
+	peers := make([]*sfuPeer, 0, len(s.peers))
+	for _, q := range s.peers {
+		peers = append(peers, q)
+	}
+	s.mu.Unlock()
+	for _, q := range peers {
+		q.mu.Lock()
+		if o := q.out[p.id]; o != nil {
+			delete(q.out, p.id)
+			_ = o.dc.Close()
+		}
+		senders := q.senders[p.id]
+		delete(q.senders, p.id)
+		q.mu.Unlock()
+		for _, sender := range senders {
+			_ = q.pc.RemoveTrack(sender)
+		}
+		if len(senders) > 0 {
+			go s.negotiate(q)
+		}
+	}
+}
+
+// sfuFromEnv reads SIGNALER_SFU (1, true, on)
+func sfuFromEnv() bool {
+	switch strings.ToLower(os.Getenv("SIGNALER_SFU")) {
+	case "1", "true", "on", "yes":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// ErrNotFound is returned by Store.Get for a missing or expired key
+var ErrNotFound = errors.New("not found")
+
+// Store is the signaler's state: per-room role hashes, SDPs that expire,
+// append-only lists (ICE backlogs, renegotiation descriptions) and pub/sub
+// channels for live candidates. Keys and channels are built by the k*/ch*
+// helpers in main.go. Writes that take a ttl (re)set the key's expiry; a
+// ttl of 0 keeps the key until it is deleted.
+type Store interface {
+	Ping(ctx context.Context) error
+
+	// Hashes: room roles
+	HashGetAll(ctx context.Context, key string) (map[string]string, error)
+	HashGet(ctx context.Context, key, field string) (string, error) // "" if missing
+	HashSet(ctx context.Context, key, field, value string, ttl time.Duration) error
+	HashDel(ctx context.Context, key string, fields ...string) error
+
+	// Strings: SDPs and room passwords
+	Get(ctx context.Context, key string) (string, error) // ErrNotFound if missing
+	Set(ctx context.Context, key, value string, ttl time.Duration) error
+	SetNX(ctx context.Context, key, value string, ttl time.Duration) (bool, error) // false if key exists
+
+	// Lists: ICE backlogs and description logs
+	Append(ctx context.Context, key, value string, ttl time.Duration) (int, error) // new length
+	Range(ctx context.Context, key string, from int) ([]string, error)             // from is 0-based
+	Len(ctx context.Context, key string) (int, error)                              // 0 if missing
+
+	Expire(ctx context.Context, key string, ttl time.Duration) error
+	Del(ctx context.Context, keys ...string) error
+
+	// Publish delivers msg to current subscribers of channel only
+	Publish(ctx context.Context, channel, msg string) error
+	// Subscribe streams messages published to channel until ctx ends, then
+	// closes the returned channel
+	Subscribe(ctx context.Context, channel string) (<-chan string, error)
+}
+
+// newStore opens the backend named by kind: "redis" or "memory"
+func newStore(kind string) (Store, error) {
+	switch kind {
+	case "redis", "":
+		return newRedisStore()
+	case "memory":
+		return newMemoryStore(), nil
+	}
+	return nil, errors.New("unknown store " + kind + " (want redis or memory)")
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// subscriberBuffer is how many messages a slow subscriber may fall behind
+// before the memory store drops messages for it
+const subscriberBuffer = 256
+
+// memoryStore keeps everything in this process: no dependencies, but state
+// is lost on restart and cannot be shared between instances
+type memoryStore struct {
+	mu   sync.Mutex
+	keys map[string]*memEntry
+	subs map[string]map[chan string]struct{}
+}
+
+// memEntry holds one key's value; only the field for its kind is used
+type memEntry struct {
+	str     string
+	hash    map[string]string
+	list    []string
+	expires time.Time // zero: never
+}
+
+func newMemoryStore() *memoryStore {
+	s := &memoryStore{keys: map[string]*memEntry{}, subs: map[string]map[chan string]struct{}{}}
+	go s.sweep()
+	return s
+}
+
+// sweep drops expired keys now and then; lookups ignore them meanwhile
+func (s *memoryStore) sweep() {
+	for range time.Tick(time.Minute) {
+		now := time.Now()
+		s.mu.Lock()
+		for k, e := range s.keys {
+			if e.expired(now) {
+				delete(s.keys, k)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (e *memEntry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && now.After(e.expires)
+}
+
+// getLocked returns the live entry for key, creating it if create is set
+func (s *memoryStore) getLocked(key string, create bool) *memEntry {
+	e := s.keys[key]
+	if e != nil && e.expired(time.Now()) {
+		delete(s.keys, key)
+		e = nil
+	}
+	if e == nil && create {
+		e = &memEntry{}
+		s.keys[key] = e
+	}
+	return e
+}
+
+func expiry(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(ttl)
+}
+
+func (s *memoryStore) Ping(ctx context.Context) error { return nil }
+
+func (s *memoryStore) HashGetAll(ctx context.Context, key string) (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := map[string]string{}
+	if e := s.getLocked(key, false); e != nil {
+		for f, v := range e.hash {
+			out[f] = v
+		}
+	}
+	return out, nil
+}
+
+func (s *memoryStore) HashGet(ctx context.Context, key, field string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e := s.getLocked(key, false); e != nil {
+		return e.hash[field], nil
+	}
+	return "", nil
+}
+
+func (s *memoryStore) HashSet(ctx context.Context, key, field, value string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.getLocked(key, true)
+	if e.hash == nil {
+		e.hash = map[string]string{}
+	}
+	e.hash[field] = value
+	e.expires = expiry(ttl)
+	return nil
+}
+
+func (s *memoryStore) HashDel(ctx context.Context, key string, fields ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.getLocked(key, false)
+	if e == nil {
+		return nil
+	}
+	for _, f := range fields {
+		delete(e.hash, f)
+	}
+	if len(e.hash) == 0 {
+		delete(s.keys, key)
+	}
+	return nil
+}
+
+func (s *memoryStore) Get(ctx context.Context, key string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.getLocked(key, false)
+	if e == nil {
+		return "", ErrNotFound
+	}
+	return e.str, nil
+}
+
+func (s *memoryStore) Set(ctx context.Context, key, value string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[key] = &memEntry{str: value, expires: expiry(ttl)}
+	return nil
+}
+
+func (s *memoryStore) SetNX(ctx context.Context, key, value string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.getLocked(key, false) != nil {
+		return false, nil
+	}
+	s.keys[key] = &memEntry{str: value, expires: expiry(ttl)}
+	return true, nil
+}
+
+func (s *memoryStore) Append(ctx context.Context, key, value string, ttl time.Duration) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.getLocked(key, true)
+	e.list = append(e.list, value)
+	e.expires = expiry(ttl)
+	return len(e.list), nil
+}
+
+func (s *memoryStore) Range(ctx context.Context, key string, from int) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.getLocked(key, false)
+	if e == nil || from >= len(e.list) {
+		return nil, nil
+	}
+	return append([]string(nil), e.list[from:]...), nil
+}
+
+func (s *memoryStore) Len(ctx context.Context, key string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.getLocked(key, false)
+	if e == nil {
+		return 0, nil
+	}
+	return len(e.list), nil
+}
+
+func (s *memoryStore) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e := s.getLocked(key, false); e != nil {
+		e.expires = expiry(ttl)
+	}
+	return nil
+}
+
+func (s *memoryStore) Del(ctx context.Context, keys ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, k := range keys {
+		delete(s.keys, k)
+	}
+	return nil
+}
+
+func (s *memoryStore) Publish(ctx context.Context, channel, msg string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ch := range s.subs[channel] {
+		select {
+		case ch <- msg:
+		default:
+			log.Printf("memory store: subscriber of %s is behind, dropping message", channel)
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) Subscribe(ctx context.Context, channel string) (<-chan string, error) {
+	ch := make(chan string, subscriberBuffer)
+	s.mu.Lock()
+	if s.subs[channel] == nil {
+		s.subs[channel] = map[chan string]struct{}{}
+	}
+	s.subs[channel][ch] = struct{}{}
+	s.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		s.mu.Lock()
+		delete(s.subs[channel], ch)
+		if len(s.subs[channel]) == 0 {
+			delete(s.subs, channel)
+		}
+		s.mu.Unlock()
+		close(ch)
+	}()
+	return ch, nil
+}
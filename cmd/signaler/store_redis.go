@@ -0,0 +1,161 @@
+package main
+
+import (
+	"log"
+	"os"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/net/context"
+)
+
+// redisStore keeps state in Redis so several signaler instances can share
+// rooms and it survives restarts
+type redisStore struct {
+	rdb *redis.Client
+}
+
+// newRedisStore connects using REDIS_URL, or REDIS_ADDR, or localhost
+func newRedisStore() (*redisStore, error) {
+	// REDIS_URL like: redis://:password@host:6379/0  (or leave empty for localhost)
+	redisAddr := "127.0.0.1:6379"
+	if env := os.Getenv("REDIS_ADDR"); env != "" {
+		redisAddr = env
+	}
+
+	redisOpts := &redis.Options{Addr: redisAddr}
+
+	// Support full Redis URL format
+	if redisURL := os.Getenv("REDIS_URL"); redisURL != "" {
+		log.Printf("Using REDIS_URL: %s", redisURL)
+		opts, err := redis.ParseURL(redisURL)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Parsed Redis config - Addr: %s, Username: %s", opts.Addr, opts.Username)
+		redisOpts = opts
+	} else {
+		log.Printf("No REDIS_URL found, using default: %s", redisAddr)
+	}
+
+	s := &redisStore{rdb: redis.NewClient(redisOpts)}
+
+	// Test Redis connection immediately
+	log.Println("Testing Redis connection...")
+	if err := s.Ping(ctx); err != nil {
+		log.Printf("❌ Redis connection failed: %v", err)
+		log.Printf("Redis config: Addr=%s, Username=%s", redisOpts.Addr, redisOpts.Username)
+	} else {
+		log.Println("✅ Redis connection successful!")
+	}
+	return s, nil
+}
+
+func (s *redisStore) Ping(ctx context.Context) error {
+	return s.rdb.Ping(ctx).Err()
+}
+
+func (s *redisStore) HashGetAll(ctx context.Context, key string) (map[string]string, error) {
+	return s.rdb.HGetAll(ctx, key).Result()
+}
+
+func (s *redisStore) HashGet(ctx context.Context, key, field string) (string, error) {
+	v, err := s.rdb.HGet(ctx, key, field).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return v, err
+}
+
+func (s *redisStore) HashSet(ctx context.Context, key, field, value string, ttl time.Duration) error {
+	if err := s.rdb.HSet(ctx, key, field, value).Err(); err != nil {
+		return err
+	}
+	if ttl <= 0 {
+		return nil
+	}
+	return s.rdb.Expire(ctx, key, ttl).Err()
+}
+
+func (s *redisStore) HashDel(ctx context.Context, key string, fields ...string) error {
+	return s.rdb.HDel(ctx, key, fields...).Err()
+}
+
+func (s *redisStore) Get(ctx context.Context, key string) (string, error) {
+	v, err := s.rdb.Get(ctx, key).Result()
+	if err == redis.Nil {
+		return "", ErrNotFound
+	}
+	return v, err
+}
+
+func (s *redisStore) Set(ctx context.Context, key, value string, ttl time.Duration) error {
+	return s.rdb.Set(ctx, key, value, ttl).Err()
+}
+
+func (s *redisStore) SetNX(ctx context.Context, key, value string, ttl time.Duration) (bool, error) {
+	return s.rdb.SetNX(ctx, key, value, ttl).Result()
+}
+
+func (s *redisStore) Append(ctx context.Context, key, value string, ttl time.Duration) (int, error) {
+	n, err := s.rdb.RPush(ctx, key, value).Result()
+	if err != nil {
+		return 0, err
+	}
+	if ttl > 0 {
+		s.rdb.Expire(ctx, key, ttl)
+	}
+	return int(n), nil
+}
+
+func (s *redisStore) Range(ctx context.Context, key string, from int) ([]string, error) {
+	return s.rdb.LRange(ctx, key, int64(from), -1).Result()
+}
+
+func (s *redisStore) Len(ctx context.Context, key string) (int, error) {
+	n, err := s.rdb.LLen(ctx, key).Result()
+	return int(n), err
+}
+
+func (s *redisStore) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	return s.rdb.Expire(ctx, key, ttl).Err()
+}
+
+func (s *redisStore) Del(ctx context.Context, keys ...string) error {
+	return s.rdb.Del(ctx, keys...).Err()
+}
+
+func (s *redisStore) Publish(ctx context.Context, channel, msg string) error {
+	return s.rdb.Publish(ctx, channel, msg).Err()
+}
+
+func (s *redisStore) Subscribe(ctx context.Context, channel string) (<-chan string, error) {
+	sub := s.rdb.Subscribe(ctx, channel)
+	// wait for the subscription so nothing published after we return is lost
+	if _, err := sub.Receive(ctx); err != nil {
+		sub.Close()
+		return nil, err
+	}
+	out := make(chan string)
+	go func() {
+		defer close(out)
+		defer sub.Close()
+		ch := sub.Channel()
+		for {
+			select {
+			case m, ok := <-ch:
+				if !ok {
+					return
+				}
+				select {
+				case out <- m.Payload:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
@@ -0,0 +1,359 @@
+// SnapShell browser peer: speaks the signaler's /room/{id}/* API, exchanges
+// ASCII frames on the "ascii" data channel and answers the control channel.
+"use strict";
+
+const RAMP = " .:-=+*#%@";
+const FPS = 10;
+const COLS = 100;
+const ROWS = 40;
+
+const $ = (id) => document.getElementById(id);
+const clientId = "web-" + Math.random().toString(36).slice(2, 12);
+let pc, role, ascii, control, chat;
+// issued on join; proves our clientId to the endpoints that change the room
+let secret = "";
+
+function status(s) {
+  $("status").textContent = s;
+}
+
+async function api(method, path, body) {
+  const headers = body ? { "Content-Type": "application/json" } : {};
+  if (secret) headers["X-Client-Secret"] = secret;
+  const res = await fetch(path, {
+    method,
+    headers,
+    body: body ? JSON.stringify(body) : undefined,
+  });
+  if (res.status === 404) return null;
+  if (!res.ok) {
+    const err = new Error(`${method} ${path}: ${res.status} ${(await res.text()).trim()}`);
+    err.status = res.status;
+    throw err;
+  }
+  return res.json();
+}
+
+// joinRoom joins with the invite token from the link, asking for the room
+// password if the room has one and there is no token
+async function joinRoom(base) {
+  const token = params.get("token") || "";
+  let password = "";
+  for (;;) {
+    try {
+      return await api("POST", `${base}/join`, { clientId, token, password });
+    } catch (err) {
+      if (err.status !== 401) throw err;
+      password = prompt("This room has a password:");
+      if (password === null) throw new Error("room has a password");
+    }
+  }
+}
+
+// Candidates travel as base64 JSON, the same encoding the Go client uses
+const encode = (obj) => btoa(JSON.stringify(obj));
+const decode = (s) => JSON.parse(atob(s));
+
+async function join(room) {
+  const base = `/room/${encodeURIComponent(room)}`;
+  const joined = await joinRoom(base);
+  role = joined.role;
+  secret = joined.secret || "";
+  status(`joined as ${role}`);
+  keepMembership(base);
+
+  const ice = (await api("GET", "/ice")) || { ice_servers: [] };
+  pc = new RTCPeerConnection({ iceServers: ice.ice_servers });
+
+  // Candidates are trickled as they are gathered. Ours wait until our SDP is
+  // posted (posting it clears our backlog on the server); the peer's wait
+  // until its SDP (of the same ICE generation) is set. A null candidate
+  // becomes end-of-candidates.
+  const postICE = (c) =>
+    api("POST", `${base}/ice?from=${role}&clientId=${clientId}`, { candidate: encode(c) }).catch(() => {});
+  let localQueue = [];
+  let remoteQueue = [];
+  const ufrag = (sdp) => (sdp.match(/a=ice-ufrag:(\S+)/) || [])[1];
+  const matches = (c) => !c.usernameFragment || c.usernameFragment === ufrag(pc.remoteDescription.sdp);
+  pc.onicecandidate = (e) => {
+    const c = e.candidate ? e.candidate.toJSON() : { candidate: "" };
+    if (!c.usernameFragment && pc.localDescription) c.usernameFragment = ufrag(pc.localDescription.sdp);
+    if (localQueue) localQueue.push(c);
+    else postICE(c);
+  };
+  const localReady = () => {
+    localQueue.forEach(postICE);
+    localQueue = null;
+  };
+  const remoteReady = () => {
+    remoteQueue.filter(matches).forEach((c) => pc.addIceCandidate(c).catch(() => {}));
+    remoteQueue = [];
+  };
+  pc.ondatachannel = (e) => attach(e.channel);
+
+  // The peer's SDPs, descriptions and candidates are pushed on the room's
+  // event stream; EventSource resumes it with Last-Event-ID after a drop. It
+  // cannot set headers, so the secret goes in the query
+  const events = new EventSource(`${base}/events?to=${role}&clientId=${clientId}&secret=${encodeURIComponent(secret)}`);
+  events.addEventListener("candidate", (e) => {
+    const c = decode(e.data);
+    if (pc.remoteDescription && matches(c)) pc.addIceCandidate(c).catch(() => {});
+    else remoteQueue.push(c);
+  });
+  const sdps = {};
+  const waiters = {};
+  for (const type of ["offer", "answer"]) {
+    events.addEventListener(type, (e) => {
+      sdps[type] = JSON.parse(e.data).sdp;
+      if (waiters[type]) waiters[type](sdps[type]);
+    });
+  }
+  const waitSDP = (type) => (sdps[type] ? Promise.resolve(sdps[type]) : new Promise((r) => (waiters[type] = r)));
+
+  const sendOffer = async () => {
+    await pc.setLocalDescription(await pc.createOffer());
+    await api("POST", `${base}/offer?clientId=${clientId}`, { sdp: pc.localDescription.sdp });
+    localReady();
+  };
+  const answerOffer = async (sdp) => {
+    await pc.setRemoteDescription({ type: "offer", sdp });
+    remoteReady();
+    await pc.setLocalDescription(await pc.createAnswer());
+    await api("POST", `${base}/answer?clientId=${clientId}`, { sdp: pc.localDescription.sdp });
+    localReady();
+  };
+
+  // After the initial exchange either side renegotiates over /sdp with the
+  // perfect negotiation pattern (the answerer is polite and rolls back on
+  // glare, the offerer ignores colliding offers)
+  const polite = role === "answer";
+  let negotiating = false;
+  let makingOffer = false;
+  const sendDescription = () =>
+    api("POST", `${base}/sdp?from=${role}&clientId=${clientId}`, {
+      type: pc.localDescription.type,
+      sdp: pc.localDescription.sdp,
+    });
+  pc.onnegotiationneeded = async () => {
+    if (!negotiating) return;
+    try {
+      makingOffer = true;
+      await pc.setLocalDescription();
+      await sendDescription();
+    } catch (err) {
+      console.warn("negotiation:", err);
+    } finally {
+      makingOffer = false;
+    }
+  };
+  const onDescription = async (d) => {
+    const collision = d.type === "offer" && (makingOffer || pc.signalingState !== "stable");
+    if (collision && !polite) return;
+    await pc.setRemoteDescription(d);
+    remoteReady();
+    if (d.type === "offer") {
+      await pc.setLocalDescription();
+      await sendDescription();
+    }
+  };
+  // descriptions are applied one at a time, once the initial exchange is done
+  let negotiate;
+  let pending = new Promise((r) => (negotiate = r)).then(() => (negotiating = true));
+  let seen = 0;
+  events.addEventListener("description", (e) => {
+    const d = JSON.parse(e.data);
+    if (d.seq <= seen) return; // replayed after a reconnect
+    seen = d.seq;
+    pending = pending
+      .then(() => onDescription({ type: d.type, sdp: d.sdp }))
+      .catch((err) => console.warn("negotiation:", err));
+  });
+
+  // After a drop the offerer restarts ICE (renegotiating as above), the same
+  // as the Go client: 5s grace, 10s per attempt, 45s in total
+  let connected = false;
+  let reconnecting = false;
+  const reconnect = async () => {
+    reconnecting = true;
+    const deadline = Date.now() + 45000;
+    const lost = () => pc.connectionState !== "connected" && Date.now() < deadline;
+    if (role === "offer") {
+      await sleep(5000);
+      while (lost()) {
+        pc.restartIce();
+        for (let i = 0; i < 10 && lost(); i++) await sleep(1000);
+      }
+    }
+    while (lost()) await sleep(700);
+    reconnecting = false;
+    if (pc.connectionState !== "connected") {
+      status(`${role}: connection lost`);
+      pc.close();
+    }
+  };
+  pc.onconnectionstatechange = () => {
+    const state = pc.connectionState;
+    if (state === "connected") connected = true;
+    status(`${role}: ${reconnecting && state !== "connected" ? "reconnecting…" : state}`);
+    if (connected && !reconnecting && (state === "disconnected" || state === "failed")) reconnect();
+  };
+
+  if (role === "offer") {
+    attach(pc.createDataChannel("control"));
+    attach(pc.createDataChannel("chat"));
+    attach(pc.createDataChannel("ascii"));
+    await sendOffer();
+    await pc.setRemoteDescription({ type: "answer", sdp: await waitSDP("answer") });
+    remoteReady();
+  } else {
+    await answerOffer(await waitSDP("offer"));
+    // a Go offerer that cannot connect over relays restarts with all candidates
+    setTimeout(() => connected || reconnecting || reconnect(), 8000);
+  }
+  negotiate();
+}
+
+const sleep = (ms) => new Promise((r) => setTimeout(r, ms));
+
+// keepMembership sends a heartbeat every 10s so the server knows we are
+// still here, and leaves the room when the page goes away
+function keepMembership(base) {
+  const q = `clientId=${clientId}`;
+  setInterval(() => api("POST", `${base}/heartbeat?${q}`).catch(() => {}), 10000);
+  addEventListener("pagehide", () => {
+    // keepalive lets the request outlive the page
+    fetch(`${base}/leave?${q}`, { method: "POST", headers: { "X-Client-Secret": secret }, keepalive: true });
+  });
+}
+
+function attach(dc) {
+  switch (dc.label) {
+    case "control":
+      control = dc;
+      dc.onopen = () => {
+        sendControl({ type: "hello", hello: { version: 1, capabilities: ["ascii", "viewport"] } });
+        sendControl({ type: "viewport", viewport: { width: COLS, height: ROWS } });
+      };
+      dc.onmessage = (e) => {
+        const m = JSON.parse(e.data);
+        if (m.type === "ping") sendControl({ type: "pong", ping: m.ping });
+        if (m.type === "bye") status("peer hung up");
+      };
+      break;
+    case "chat":
+      chat = dc;
+      dc.onmessage = (e) => say(JSON.parse(e.data).text, false);
+      break;
+    case "ascii":
+      ascii = dc;
+      dc.onmessage = (e) => ($("remote").innerHTML = ansiToHTML(e.data));
+      dc.onopen = startCamera;
+      break;
+  }
+}
+
+function sendControl(m) {
+  if (control && control.readyState === "open") control.send(JSON.stringify(m));
+}
+
+function say(text, mine) {
+  const line = document.createElement("div");
+  line.className = mine ? "me" : "";
+  line.textContent = `[${new Date().toLocaleTimeString()}] ${mine ? "you" : "peer"}: ${text}`;
+  $("chat").append(line);
+  $("chat").scrollTop = $("chat").scrollHeight;
+}
+
+// Frames from the Go client may carry 256-color or truecolor SGR escapes
+function ansiToHTML(text) {
+  const esc = (s) => s.replace(/&/g, "&amp;").replace(/</g, "&lt;").replace(/>/g, "&gt;");
+  let out = "";
+  let open = false;
+  for (const part of text.split(/(\x1b\[[0-9;]*m)/)) {
+    const m = part.match(/^\x1b\[([0-9;]*)m$/);
+    if (!m) {
+      out += esc(part);
+      continue;
+    }
+    if (open) out += "</span>";
+    open = false;
+    const p = m[1].split(";").map(Number);
+    let color = null;
+    if (p[0] === 38 && p[1] === 2) color = `rgb(${p[2]},${p[3]},${p[4]})`;
+    if (p[0] === 38 && p[1] === 5) color = xterm256(p[2]);
+    if (color) {
+      out += `<span style="color:${color}">`;
+      open = true;
+    }
+  }
+  return open ? out + "</span>" : out;
+}
+
+function xterm256(n) {
+  if (n >= 232) {
+    const v = 8 + (n - 232) * 10;
+    return `rgb(${v},${v},${v})`;
+  }
+  if (n < 16) return "#ccc";
+  n -= 16;
+  const c = (v) => (v ? 55 + v * 40 : 0);
+  return `rgb(${c(Math.floor(n / 36))},${c(Math.floor(n / 6) % 6)},${c(n % 6)})`;
+}
+
+async function startCamera() {
+  let stream;
+  try {
+    stream = await navigator.mediaDevices.getUserMedia({ video: { width: 640, height: 480 } });
+  } catch (err) {
+    status(`camera unavailable: ${err.message}`);
+    return;
+  }
+  const cam = $("cam");
+  cam.srcObject = stream;
+  const canvas = $("grab");
+  canvas.width = COLS;
+  canvas.height = ROWS;
+  const g = canvas.getContext("2d", { willReadFrequently: true });
+
+  setInterval(() => {
+    if (!ascii || ascii.readyState !== "open" || cam.readyState < 2) return;
+    g.drawImage(cam, 0, 0, COLS, ROWS);
+    const px = g.getImageData(0, 0, COLS, ROWS).data;
+    let frame = "";
+    for (let y = 0; y < ROWS; y++) {
+      for (let x = 0; x < COLS; x++) {
+        const i = (y * COLS + x) * 4;
+        const gray = 0.299 * px[i] + 0.587 * px[i + 1] + 0.114 * px[i + 2];
+        frame += RAMP[Math.floor((gray * (RAMP.length - 1)) / 255)];
+      }
+      frame += "\n";
+    }
+    $("local").textContent = frame;
+    ascii.send(frame);
+  }, 1000 / FPS);
+}
+
+$("join").onclick = () => {
+  const room = $("room").value.trim();
+  if (!room) return;
+  const q = new URLSearchParams({ room });
+  if (params.get("token")) q.set("token", params.get("token"));
+  history.replaceState(null, "", `?${q}`);
+  $("join").disabled = true;
+  join(room).catch((err) => {
+    status(err.message);
+    $("join").disabled = false;
+  });
+};
+
+$("say").onsubmit = (e) => {
+  e.preventDefault();
+  const text = $("msg").value.trim();
+  if (!text || !chat || chat.readyState !== "open") return;
+  chat.send(JSON.stringify({ text, sent: Date.now() }));
+  say(text, true);
+  $("msg").value = "";
+};
+
+const params = new URLSearchParams(location.search);
+if (params.get("room")) $("room").value = params.get("room");
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+
+	sig "github.com/saswatsam786/snapshell/internal/signal"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/websocket"
+)
+
+// GET /room/{id}/ws?clientId=...
+// One connection carries a client's whole signaling: it sends join, offer,
+// answer, candidate and description requests (each acked with its ID) and
+// gets the peer's SDPs, candidates, descriptions and presence pushed. Every
+// join replays what the peer sent so far, so a reconnecting client catches
+// up. Closing the socket is not leaving: a client keeps its role until it
+// sends leave or its heartbeats stop, and a blip in signaling should not
+// tear down its calls. Only a client that never sent a heartbeat leaves
+// the room when its socket closes, as the reaper would not remove it. In a
+// mesh room the offers, answers and candidates carry To and are relayed to
+// that peer.
+func roomWS(ws *websocket.Conn) {
+	id := ws.Request().PathValue("id")
+	clientID := ws.Request().URL.Query().Get("clientId")
+	wctx, cancel := context.WithCancel(ws.Request().Context())
+	defer cancel()
+
+	send := func(m sig.Message) {
+		_ = websocket.JSON.Send(ws, m)
+	}
+	var once sync.Once
+	role := ""
+
+	for {
+		var m sig.Message
+		if err := websocket.JSON.Receive(ws, &m); err != nil {
+			break
+		}
+		ack := sig.Message{Type: sig.MsgAck, ID: m.ID}
+		var err error
+		switch {
+		case role == "" && m.Type != sig.MsgJoin:
+			// the join that opened the connection proves the clientId
+			err = errForbidden
+		case m.To != "":
+			err = relay(id, clientID, m)
+		case m.Type == sig.MsgJoin:
+			if clientID == "" {
+				ack.Error = "missing clientId"
+				break
+			}
+			cred := credentials{Password: m.Password, Token: m.Token, Secret: m.Secret}
+			if ack.Role, ack.Secret, err = join(id, clientID, m.Role, cred); err != nil {
+				break
+			}
+			role = ack.Role
+			// subscribe before the replay so nothing falls in between
+			once.Do(func() { err = forwardRoom(wctx, id, clientID, role, send) })
+			if err == nil {
+				replayRoom(id, clientID, role, send)
+			}
+		case m.Type == sig.MsgOffer:
+			err = setOffer(id, clientID, m.SDP)
+		case m.Type == sig.MsgAnswer:
+			err = setAnswer(id, clientID, m.SDP)
+		case m.Type == sig.MsgCandidate:
+			err = addICE(id, m.Role, clientID, m.Candidate)
+		case m.Type == sig.MsgDescription:
+			ack.Seq, err = addDescription(id, m.Role, clientID, m.SDPType, m.SDP)
+		case m.Type == sig.MsgHeartbeat:
+			err = heartbeat(id, clientID, m.Phase)
+		case m.Type == sig.MsgLeave:
+			if err = leave(id, clientID); err == nil {
+				// announced; the socket closing is not news any more
+				role = ""
+			}
+		default:
+			ack.Error = "unknown message type " + m.Type
+		}
+		if err != nil {
+			ack.Error = err.Error()
+		}
+		send(ack)
+	}
+
+	if seen, _ := store.HashGet(ctx, kSeen(id), clientID); role != "" && seen == "" {
+		leave(id, clientID)
+	}
+}
+
+// forwardRoom pushes the room's events meant for the client until ctx ends
+func forwardRoom(ctx context.Context, id, clientID, role string, send func(sig.Message)) error {
+	events, err := store.Subscribe(ctx, chRoom(id))
+	if err != nil {
+		return errServer
+	}
+	go func() {
+		for e := range events {
+			var ev roomEvent
+			if json.Unmarshal([]byte(e), &ev) == nil && forRole(ev.Msg, clientID, role) {
+				send(ev.message())
+			}
+		}
+	}()
+	return nil
+}
+
+// forRole reports whether a room event concerns the client with role
+func forRole(m sig.Message, clientID, role string) bool {
+	if m.To != "" || (meshRole(role) && m.Type != sig.MsgPresence) {
+		return m.To == clientID
+	}
+	switch m.Type {
+	case sig.MsgOffer, sig.MsgAnswer, sig.MsgDescription, sig.MsgCandidate:
+		return m.Role != role
+	case sig.MsgPresence:
+		return m.ClientID != clientID
+	}
+	return false
+}
+
+// replayRoom sends what was relayed to the client and, to a side of a
+// two-person call, what the peer of role has sent so far
+func replayRoom(id, clientID, role string, send func(sig.Message)) {
+	peer := otherSide(role)
+	roles, _ := store.HashGetAll(ctx, kRoles(id))
+	// the SFU first, so mesh peers know to use it before seeing the others
+	members := make([]string, 0, len(roles))
+	for cid := range roles {
+		if cid != clientID {
+			members = append(members, cid)
+		}
+	}
+	sort.Slice(members, func(i, j int) bool {
+		if (roles[members[i]] == sig.RoleSFU) != (roles[members[j]] == sig.RoleSFU) {
+			return roles[members[i]] == sig.RoleSFU
+		}
+		return members[i] < members[j]
+	})
+	for _, cid := range members {
+		send(sig.Message{Type: sig.MsgPresence, ClientID: cid, Role: roles[cid], Event: "joined"})
+	}
+	for _, ev := range roomEvents(id, 0) {
+		if ev.Msg.To == clientID {
+			send(ev.message())
+		}
+	}
+	if meshRole(role) {
+		return
+	}
+	sdpKey := kOfferSDP(id)
+	if peer == "answer" {
+		sdpKey = kAnswerSDP(id)
+	}
+	if sdp, err := store.Get(ctx, sdpKey); err == nil {
+		send(sig.Message{Type: peer, Role: peer, SDP: sdp})
+	}
+	descs, _ := store.Range(ctx, kSDPList(id, peer), 0)
+	for i, v := range descs {
+		var d descReq
+		if json.Unmarshal([]byte(v), &d) == nil {
+			send(sig.Message{Type: sig.MsgDescription, Role: peer, SDPType: d.Type, SDP: d.SDP, Seq: i + 1})
+		}
+	}
+	cands, _ := store.Range(ctx, kICEList(id, peer), 0)
+	for _, c := range cands {
+		send(sig.Message{Type: sig.MsgCandidate, Role: peer, Candidate: c})
+	}
+}
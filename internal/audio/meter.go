@@ -0,0 +1,161 @@
+package audio
+
+import (
+	"math"
+	"math/cmplx"
+	"sync"
+	"time"
+)
+
+const (
+	// fftSize is the analysis window; 20ms frames (960 samples) are zero padded
+	fftSize = 1024
+
+	// speakingLevel is the normalised level above which someone counts as
+	// talking, and speakingHold keeps the indicator on between words
+	speakingLevel = 0.25
+	speakingHold  = 400 * time.Millisecond
+
+	// decay is applied per frame so bars fall smoothly instead of flickering
+	decay = 0.85
+
+	// dB range mapped onto 0..1
+	floorDB = -60.0
+)
+
+// Meter turns PCM frames into a smoothed level and spectrum for display
+type Meter struct {
+	bands int
+
+	mu       sync.Mutex
+	level    float64
+	spectrum []float64
+	spoke    time.Time
+}
+
+// NewMeter creates a meter that reports bands log-spaced frequency bands
+func NewMeter(bands int) *Meter {
+	return &Meter{bands: bands, spectrum: make([]float64, bands)}
+}
+
+// Feed analyses one frame of mono PCM at SampleRate
+func (m *Meter) Feed(pcm []int16) {
+	if len(pcm) == 0 {
+		return
+	}
+	level := normDB(rms(pcm))
+	spec := spectrum(pcm, m.bands)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.level = math.Max(level, m.level*decay)
+	for i, v := range spec {
+		m.spectrum[i] = math.Max(v, m.spectrum[i]*decay)
+	}
+	if level > speakingLevel {
+		m.spoke = time.Now()
+	}
+}
+
+// Level returns the smoothed level in 0..1
+func (m *Meter) Level() float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.level
+}
+
+// Spectrum returns a copy of the smoothed band magnitudes in 0..1
+func (m *Meter) Spectrum() []float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]float64(nil), m.spectrum...)
+}
+
+// Speaking reports whether the level was above the speech threshold recently
+func (m *Meter) Speaking() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return time.Since(m.spoke) < speakingHold
+}
+
+func rms(pcm []int16) float64 {
+	var sum float64
+	for _, s := range pcm {
+		v := float64(s) / 32768
+		sum += v * v
+	}
+	return math.Sqrt(sum / float64(len(pcm)))
+}
+
+// normDB maps an amplitude in 0..1 onto 0..1 over floorDB..0 dBFS
+func normDB(a float64) float64 {
+	if a <= 0 {
+		return 0
+	}
+	db := 20 * math.Log10(a)
+	return math.Max(0, math.Min(1, (db-floorDB)/-floorDB))
+}
+
+// spectrum computes the magnitude of pcm in bands log-spaced bands between
+// roughly 60Hz and 12kHz, where almost all speech energy lies
+func spectrum(pcm []int16, bands int) []float64 {
+	buf := make([]complex128, fftSize)
+	n := len(pcm)
+	if n > fftSize {
+		n = fftSize
+	}
+	for i := 0; i < n; i++ {
+		// Hann window to reduce leakage between bands
+		w := 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(n-1))
+		buf[i] = complex(float64(pcm[i])/32768*w, 0)
+	}
+	fft(buf)
+
+	out := make([]float64, bands)
+	binHz := float64(SampleRate) / fftSize
+	lo, hi := 60.0, 12000.0
+	for b := 0; b < bands; b++ {
+		f0 := lo * math.Pow(hi/lo, float64(b)/float64(bands))
+		f1 := lo * math.Pow(hi/lo, float64(b+1)/float64(bands))
+		i0, i1 := int(f0/binHz), int(f1/binHz)
+		if i1 <= i0 {
+			i1 = i0 + 1
+		}
+		var peak float64
+		for i := i0; i < i1 && i < fftSize/2; i++ {
+			peak = math.Max(peak, cmplx.Abs(buf[i]))
+		}
+		// Scale so a full-scale sine in one bin reads as 0 dB
+		out[b] = normDB(peak * 4 / float64(n))
+	}
+	return out
+}
+
+// fft is an in-place iterative radix-2 Cooley-Tukey transform; len(a) must
+// be a power of two
+func fft(a []complex128) {
+	n := len(a)
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+		if i < j {
+			a[i], a[j] = a[j], a[i]
+		}
+	}
+	for size := 2; size <= n; size <<= 1 {
+		w := cmplx.Exp(complex(0, -2*math.Pi/float64(size)))
+		for start := 0; start < n; start += size {
+			wk := complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				u := a[start+k]
+				v := a[start+k+size/2] * wk
+				a[start+k] = u + v
+				a[start+k+size/2] = u - v
+				wk *= w
+			}
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package audio
+
+import (
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"github.com/pion/webrtc/v4/pkg/media/oggreader"
+)
+
+// oggSource sends the Opus packets of an Ogg file without re-encoding. The
+// file should have one packet per page, e.g. from
+// ffmpeg -i in.wav -c:a libopus -page_duration 20000 out.ogg
+type oggSource struct {
+	f       *os.File
+	r       *oggreader.OggReader
+	granule uint64
+	next    time.Time
+}
+
+func openOgg(path string) (Source, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r, _, err := oggreader.NewWith(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &oggSource{f: f, r: r, next: time.Now()}, nil
+}
+
+func (s *oggSource) ReadPacket() ([]byte, []int16, time.Duration, error) {
+	for {
+		page, hdr, err := s.r.ParseNextPage()
+		if err == io.EOF {
+			// Loop: restart from the headers
+			if _, err := s.f.Seek(0, io.SeekStart); err != nil {
+				return nil, nil, 0, err
+			}
+			if s.r, _, err = oggreader.NewWith(s.f); err != nil {
+				return nil, nil, 0, err
+			}
+			s.granule = 0
+			continue
+		}
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		// Skip the OpusTags page and anything without audio
+		if hdr.GranulePosition <= s.granule {
+			continue
+		}
+		samples := hdr.GranulePosition - s.granule
+		s.granule = hdr.GranulePosition
+		if len(page) == 0 {
+			continue
+		}
+		dur := time.Duration(samples) * time.Second / SampleRate
+		if dur <= 0 || dur > time.Second {
+			return nil, nil, 0, errors.New("bad Ogg granule position")
+		}
+
+		// Pace playback to real time
+		s.next = s.next.Add(dur)
+		time.Sleep(time.Until(s.next))
+		return page, nil, dur, nil
+	}
+}
+
+func (s *oggSource) Close() error {
+	return s.f.Close()
+}
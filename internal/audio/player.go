@@ -0,0 +1,120 @@
+package audio
+
+import (
+	"errors"
+	"io"
+	"os/exec"
+	"sync"
+
+	"gopkg.in/hraban/opus.v2"
+)
+
+// Player decodes Opus packets and plays them on the default output device
+// through pacat (PulseAudio) or aplay (ALSA). Without either tool it still
+// decodes so PCM consumers keep working.
+type Player struct {
+	dec *opus.Decoder
+	pcm []int16
+	raw []byte
+
+	mu    sync.Mutex
+	out   io.WriteCloser
+	cmd   *exec.Cmd
+	muted bool
+	onPCM func([]int16)
+}
+
+// NewPlayer starts the output device. A missing output tool is reported as
+// an error alongside a usable, silent Player.
+func NewPlayer() (*Player, error) {
+	dec, err := opus.NewDecoder(SampleRate, Channels)
+	if err != nil {
+		return nil, err
+	}
+	p := &Player{
+		dec: dec,
+		pcm: make([]int16, SampleRate*120/1000*Channels), // max Opus frame is 120ms
+	}
+
+	var cmd *exec.Cmd
+	if _, err := exec.LookPath("pacat"); err == nil {
+		cmd = exec.Command("pacat", "--playback", "--format=s16le", "--rate=48000", "--channels=1", "--latency-msec=60")
+	} else if _, err := exec.LookPath("aplay"); err == nil {
+		cmd = exec.Command("aplay", "-q", "-f", "S16_LE", "-r", "48000", "-c", "1", "-t", "raw")
+	} else {
+		return p, errors.New("no playback tool found: install PulseAudio (pacat) or ALSA utils (aplay)")
+	}
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return p, err
+	}
+	if err := cmd.Start(); err != nil {
+		return p, err
+	}
+	p.cmd, p.out = cmd, in
+	return p, nil
+}
+
+// OnPCM registers f to receive every decoded frame, muted or not
+func (p *Player) OnPCM(f func([]int16)) {
+	p.mu.Lock()
+	p.onPCM = f
+	p.mu.Unlock()
+}
+
+// SetMuted stops or resumes output without stopping decoding
+func (p *Player) SetMuted(muted bool) {
+	p.mu.Lock()
+	p.muted = muted
+	p.mu.Unlock()
+}
+
+// Muted reports whether output is muted
+func (p *Player) Muted() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.muted
+}
+
+// Play decodes one Opus packet and writes it to the output device
+func (p *Player) Play(packet []byte) error {
+	n, err := p.dec.Decode(packet, p.pcm)
+	if err != nil {
+		return err
+	}
+	pcm := p.pcm[:n*Channels]
+
+	p.mu.Lock()
+	out, muted, onPCM := p.out, p.muted, p.onPCM
+	p.mu.Unlock()
+
+	if onPCM != nil {
+		onPCM(pcm)
+	}
+	if out == nil || muted {
+		return nil
+	}
+	if cap(p.raw) < len(pcm)*2 {
+		p.raw = make([]byte, len(pcm)*2)
+	}
+	raw := p.raw[:len(pcm)*2]
+	for i, s := range pcm {
+		raw[2*i] = byte(s)
+		raw[2*i+1] = byte(uint16(s) >> 8)
+	}
+	_, err = out.Write(raw)
+	return err
+}
+
+// Close stops the output device
+func (p *Player) Close() error {
+	p.mu.Lock()
+	out, cmd := p.out, p.cmd
+	p.out = nil
+	p.mu.Unlock()
+	if out == nil {
+		return nil
+	}
+	out.Close()
+	return cmd.Wait()
+}
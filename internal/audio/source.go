@@ -0,0 +1,175 @@
+package audio
+
+import (
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/hraban/opus.v2"
+)
+
+const (
+	// SampleRate is the rate used for capture, encoding and playback
+	SampleRate = 48000
+	// Channels is mono: enough for voice and half the bandwidth of stereo
+	Channels = 1
+	// FrameDuration is the amount of audio in each Opus packet
+	FrameDuration = 20 * time.Millisecond
+
+	maxPacket = 4000 // recommended max Opus packet size
+)
+
+// Source produces Opus packets paced in real time
+type Source interface {
+	// ReadPacket blocks until the next packet is due and returns it along
+	// with the PCM it was encoded from (nil when the source is already Opus)
+	ReadPacket() (packet []byte, pcm []int16, dur time.Duration, err error)
+	Close() error
+}
+
+// OpenSource opens "mic" for the default capture device or a .wav, .ogg or
+// .opus file, which is looped so calls can be tested without hardware
+func OpenSource(spec string) (Source, error) {
+	if spec == "mic" {
+		return openMic()
+	}
+	switch strings.ToLower(filepath.Ext(spec)) {
+	case ".wav":
+		return openWAV(spec)
+	case ".ogg", ".opus":
+		return openOgg(spec)
+	}
+	return nil, errors.New("audio source must be \"mic\" or a .wav/.ogg/.opus file")
+}
+
+// pcmSource encodes raw signed 16-bit little-endian PCM read from r
+type pcmSource struct {
+	r        io.Reader
+	enc      *opus.Encoder
+	rate     int
+	channels int
+	pcm      []int16
+	raw      []byte
+	buf      []byte
+	tick     *time.Ticker // paces file playback; nil for live devices
+	close    func() error
+}
+
+func newPCMSource(r io.Reader, rate, channels int, paced bool, close func() error) (*pcmSource, error) {
+	enc, err := opus.NewEncoder(rate, channels, opus.AppVoIP)
+	if err != nil {
+		return nil, err
+	}
+	n := rate * int(FrameDuration/time.Millisecond) / 1000 * channels
+	s := &pcmSource{
+		r:        r,
+		enc:      enc,
+		rate:     rate,
+		channels: channels,
+		pcm:      make([]int16, n),
+		raw:      make([]byte, n*2),
+		buf:      make([]byte, maxPacket),
+		close:    close,
+	}
+	if paced {
+		s.tick = time.NewTicker(FrameDuration)
+	}
+	return s, nil
+}
+
+func (s *pcmSource) ReadPacket() ([]byte, []int16, time.Duration, error) {
+	if s.tick != nil {
+		<-s.tick.C
+	}
+	if _, err := io.ReadFull(s.r, s.raw); err != nil {
+		return nil, nil, 0, err
+	}
+	for i := range s.pcm {
+		s.pcm[i] = int16(uint16(s.raw[2*i]) | uint16(s.raw[2*i+1])<<8)
+	}
+	n, err := s.enc.Encode(s.pcm, s.buf)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	return append([]byte(nil), s.buf[:n]...), s.pcm, FrameDuration, nil
+}
+
+func (s *pcmSource) Close() error {
+	if s.tick != nil {
+		s.tick.Stop()
+	}
+	if s.close != nil {
+		return s.close()
+	}
+	return nil
+}
+
+// openMic records from the default PulseAudio device with parec, or the
+// default ALSA device with arecord when PulseAudio is not available
+func openMic() (Source, error) {
+	var cmd *exec.Cmd
+	rate := "48000"
+	if _, err := exec.LookPath("parec"); err == nil {
+		cmd = exec.Command("parec", "--format=s16le", "--rate="+rate, "--channels=1", "--latency-msec=20")
+	} else if _, err := exec.LookPath("arecord"); err == nil {
+		cmd = exec.Command("arecord", "-q", "-f", "S16_LE", "-r", rate, "-c", "1", "-t", "raw")
+	} else {
+		return nil, errors.New("no capture tool found: install PulseAudio (parec) or ALSA utils (arecord)")
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return newPCMSource(out, SampleRate, Channels, false, func() error {
+		cmd.Process.Kill()
+		return cmd.Wait()
+	})
+}
+
+// loopReader rewinds f to start whenever it reaches end (or limit bytes
+// past start) so file sources play forever
+type loopReader struct {
+	f     *os.File
+	start int64
+	limit int64 // 0 means until EOF
+	pos   int64
+}
+
+func (l *loopReader) Read(p []byte) (int, error) {
+	if l.limit > 0 && l.pos >= l.limit {
+		if err := l.rewind(); err != nil {
+			return 0, err
+		}
+	}
+	if l.limit > 0 && int64(len(p)) > l.limit-l.pos {
+		p = p[:l.limit-l.pos]
+	}
+	n, err := l.f.Read(p)
+	l.pos += int64(n)
+	if err == io.EOF {
+		if n > 0 {
+			return n, nil
+		}
+		if l.pos == 0 {
+			return 0, io.ErrUnexpectedEOF
+		}
+		if err := l.rewind(); err != nil {
+			return 0, err
+		}
+		return l.Read(p)
+	}
+	return n, err
+}
+
+func (l *loopReader) rewind() error {
+	l.pos = 0
+	_, err := l.f.Seek(l.start, io.SeekStart)
+	return err
+}
@@ -0,0 +1,77 @@
+package audio
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// openWAV opens a 16-bit PCM WAV file. Opus accepts 8, 12, 16, 24 and 48kHz
+// input directly so no resampling is needed for those rates.
+func openWAV(path string) (Source, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var riff [12]byte
+	if _, err := io.ReadFull(f, riff[:]); err != nil || string(riff[0:4]) != "RIFF" || string(riff[8:12]) != "WAVE" {
+		f.Close()
+		return nil, errors.New("not a WAV file")
+	}
+
+	var (
+		format, channels, bits uint16
+		rate                   uint32
+	)
+	for {
+		var hdr [8]byte
+		if _, err := io.ReadFull(f, hdr[:]); err != nil {
+			f.Close()
+			return nil, errors.New("WAV file has no data chunk")
+		}
+		id, size := string(hdr[0:4]), int64(binary.LittleEndian.Uint32(hdr[4:8]))
+
+		switch id {
+		case "fmt ":
+			var fmtChunk [16]byte
+			if size < 16 {
+				f.Close()
+				return nil, errors.New("short WAV fmt chunk")
+			}
+			if _, err := io.ReadFull(f, fmtChunk[:]); err != nil {
+				f.Close()
+				return nil, err
+			}
+			format = binary.LittleEndian.Uint16(fmtChunk[0:2])
+			channels = binary.LittleEndian.Uint16(fmtChunk[2:4])
+			rate = binary.LittleEndian.Uint32(fmtChunk[4:8])
+			bits = binary.LittleEndian.Uint16(fmtChunk[14:16])
+			if _, err := f.Seek(size-16+size%2, io.SeekCurrent); err != nil {
+				f.Close()
+				return nil, err
+			}
+		case "data":
+			if format != 1 || bits != 16 || (channels != 1 && channels != 2) {
+				f.Close()
+				return nil, fmt.Errorf("unsupported WAV: format %d, %d bits, %d channels (need 16-bit PCM mono/stereo)", format, bits, channels)
+			}
+			switch rate {
+			case 8000, 12000, 16000, 24000, 48000:
+			default:
+				f.Close()
+				return nil, fmt.Errorf("unsupported WAV sample rate %d", rate)
+			}
+			start, _ := f.Seek(0, io.SeekCurrent)
+			r := &loopReader{f: f, start: start, limit: size}
+			return newPCMSource(r, int(rate), int(channels), true, f.Close)
+		default:
+			if _, err := f.Seek(size+size%2, io.SeekCurrent); err != nil {
+				f.Close()
+				return nil, err
+			}
+		}
+	}
+}
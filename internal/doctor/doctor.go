@@ -0,0 +1,288 @@
+// Package doctor checks everything a call depends on (signaling server,
+// ICE servers, camera, terminal and helper tools) and reports what works.
+package doctor
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/saswatsam786/snapshell/internal/capture"
+	"github.com/saswatsam786/snapshell/internal/render"
+	sig "github.com/saswatsam786/snapshell/internal/signal"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// gatherTimeout bounds candidate gathering against one ICE server
+const gatherTimeout = 10 * time.Second
+
+type Status string
+
+const (
+	Pass Status = "pass"
+	Warn Status = "warn" // works, but a feature will be missing
+	Fail Status = "fail"
+)
+
+// Check is one line of the report
+type Check struct {
+	Name   string `json:"name"`
+	Status Status `json:"status"`
+	Detail string `json:"detail"`
+}
+
+// Report is the result of Run
+type Report struct {
+	Server string  `json:"server"`
+	Checks []Check `json:"checks"`
+	OK     bool    `json:"ok"` // no check failed
+}
+
+func (r *Report) add(name string, status Status, format string, args ...any) {
+	r.Checks = append(r.Checks, Check{Name: name, Status: status, Detail: fmt.Sprintf(format, args...)})
+	if status == Fail {
+		r.OK = false
+	}
+}
+
+// Run performs every check against the signaling server at server
+func Run(server string) Report {
+	r := Report{Server: server, OK: true}
+	sg := sig.New(strings.TrimRight(server, "/"), "", "")
+	sg.HC.Timeout = 10 * time.Second
+
+	start := time.Now()
+	if err := sg.Health(); err != nil {
+		r.add("signaler", Fail, "%v", err)
+	} else {
+		r.add("signaler", Pass, "healthy, store reachable (%dms)", time.Since(start).Milliseconds())
+	}
+
+	ice, err := sg.FetchICEServers()
+	switch {
+	case err != nil:
+		r.add("ice servers", Fail, "GET /ice: %v", err)
+		ice = []webrtc.ICEServer{{URLs: []string{"stun:stun.l.google.com:19302"}}}
+	case len(ice) == 0:
+		r.add("ice servers", Warn, "signaler returned none; calls fall back to public STUN")
+		ice = []webrtc.ICEServer{{URLs: []string{"stun:stun.l.google.com:19302"}}}
+	default:
+		r.add("ice servers", Pass, "%d from /ice", len(ice))
+	}
+
+	r.checkHost()
+	r.checkICE(ice)
+	r.checkCamera()
+	r.checkTerminal()
+	r.checkTools()
+	return r
+}
+
+// checkHost gathers without servers: local interfaces only
+func (r *Report) checkHost() {
+	found, err := gather(nil)
+	switch {
+	case err != nil:
+		r.add("host candidates", Fail, "%v", err)
+	case found[webrtc.ICECandidateTypeHost] == 0:
+		r.add("host candidates", Fail, "no usable network interface")
+	default:
+		r.add("host candidates", Pass, "%d", found[webrtc.ICECandidateTypeHost])
+	}
+}
+
+// checkICE gathers against every ICE server URL on its own and expects a
+// server reflexive candidate from STUN and a relay candidate from TURN
+func (r *Report) checkICE(ice []webrtc.ICEServer) {
+	var servers []webrtc.ICEServer
+	for _, s := range ice {
+		for _, url := range s.URLs {
+			servers = append(servers, webrtc.ICEServer{URLs: []string{url}, Username: s.Username, Credential: s.Credential})
+		}
+	}
+	checks := make([]Check, len(servers))
+	var wg sync.WaitGroup
+	for i, s := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			checks[i] = checkServer(s)
+		}()
+	}
+	wg.Wait()
+	hasRelay := false
+	for _, c := range checks {
+		r.add(c.Name, c.Status, "%s", c.Detail)
+		if c.Status == Pass && strings.HasPrefix(c.Name, "turn") {
+			hasRelay = true
+		}
+	}
+	if !hasRelay {
+		r.add("relay", Warn, "no working TURN server; peers behind strict NATs will not connect (--ice-policy relay fails)")
+	}
+}
+
+func checkServer(s webrtc.ICEServer) Check {
+	url := s.URLs[0]
+	want, what := webrtc.ICECandidateTypeSrflx, "STUN"
+	if strings.HasPrefix(url, "turn:") || strings.HasPrefix(url, "turns:") {
+		want, what = webrtc.ICECandidateTypeRelay, "TURN (credentials ok)"
+	}
+	name := url
+	if i := strings.Index(name, "?"); i >= 0 {
+		name = name[:i] + " (" + name[i+1:] + ")"
+	}
+
+	found, err := gather([]webrtc.ICEServer{s})
+	if err != nil {
+		return Check{Name: name, Status: Fail, Detail: err.Error()}
+	}
+	var got []string
+	for _, t := range []webrtc.ICECandidateType{webrtc.ICECandidateTypeHost, webrtc.ICECandidateTypeSrflx, webrtc.ICECandidateTypeRelay} {
+		if found[t] > 0 {
+			got = append(got, fmt.Sprintf("%s×%d", t, found[t]))
+		}
+	}
+	if found[want] == 0 {
+		return Check{Name: name, Status: Fail, Detail: fmt.Sprintf("no %s candidate within %s (got %s)", want, gatherTimeout, strings.Join(got, " "))}
+	}
+	return Check{Name: name, Status: Pass, Detail: fmt.Sprintf("%s works: %s", what, strings.Join(got, " "))}
+}
+
+// gather collects local candidates for a throwaway offer and counts them
+// by type
+func gather(servers []webrtc.ICEServer) (map[webrtc.ICECandidateType]int, error) {
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{ICEServers: servers})
+	if err != nil {
+		return nil, err
+	}
+	defer pc.Close()
+	if _, err := pc.CreateDataChannel("doctor", nil); err != nil {
+		return nil, err
+	}
+
+	var mu sync.Mutex
+	found := map[webrtc.ICECandidateType]int{}
+	done := make(chan struct{})
+	pc.OnICECandidate(func(c *webrtc.ICECandidate) {
+		if c == nil {
+			close(done)
+			return
+		}
+		mu.Lock()
+		found[c.Typ]++
+		mu.Unlock()
+	})
+
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := pc.SetLocalDescription(offer); err != nil {
+		return nil, err
+	}
+	select {
+	case <-done:
+	case <-time.After(gatherTimeout):
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	out := make(map[webrtc.ICECandidateType]int, len(found))
+	for t, n := range found {
+		out[t] = n
+	}
+	return out, nil
+}
+
+func (r *Report) checkCamera() {
+	cam, err := capture.OpenWebCam()
+	if err != nil {
+		r.add("camera", Fail, "%v", err)
+		return
+	}
+	defer cam.Close()
+	frame, err := cam.ReadFrame()
+	if err != nil {
+		r.add("camera", Fail, "opened but %v (in use, or no permission?)", err)
+		return
+	}
+	defer frame.Close()
+	r.add("camera", Pass, "%dx%d frames", frame.Cols(), frame.Rows())
+}
+
+func (r *Report) checkTerminal() {
+	info, err := os.Stdout.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		r.add("terminal", Warn, "stdout is not a terminal")
+	} else {
+		width, height := render.GetTerminalSize()
+		r.add("terminal", Pass, "%dx%d, TERM=%s", width, height, os.Getenv("TERM"))
+	}
+
+	term, colorterm := os.Getenv("TERM"), os.Getenv("COLORTERM")
+	switch {
+	case colorterm == "truecolor" || colorterm == "24bit":
+		r.add("colors", Pass, "truecolor (-color truecolor)")
+	case strings.Contains(term, "256color"):
+		r.add("colors", Pass, "256 colors (-color 256)")
+	default:
+		r.add("colors", Warn, "no 256 color support detected; use the default -color gray")
+	}
+
+	if _, err := exec.LookPath("stty"); err != nil {
+		r.add("input line", Warn, "stty not found; chat and commands are disabled")
+	} else {
+		r.add("input line", Pass, "stty available")
+	}
+}
+
+// checkTools looks for the external programs optional features run
+func (r *Report) checkTools() {
+	tools := []struct {
+		name, feature string
+		any           []string
+	}{
+		{"video track", "-video-track", []string{"ffmpeg"}},
+		{"microphone", "-audio mic", []string{"parec", "arecord"}},
+		{"speaker", "peer audio", []string{"pacat", "aplay"}},
+	}
+	for _, t := range tools {
+		found := ""
+		for _, bin := range t.any {
+			if _, err := exec.LookPath(bin); err == nil {
+				found = bin
+				break
+			}
+		}
+		if found == "" {
+			r.add(t.name, Warn, "%s not found; %s unavailable", strings.Join(t.any, " or "), t.feature)
+		} else {
+			r.add(t.name, Pass, "%s", found)
+		}
+	}
+}
+
+// Print writes the report as a checklist
+func (r Report) Print(w io.Writer) {
+	fmt.Fprintf(w, "🩺 SnapShell doctor — %s\n\n", r.Server)
+	width := 0
+	for _, c := range r.Checks {
+		width = max(width, len(c.Name))
+	}
+	icons := map[Status]string{Pass: "✅", Warn: "⚠️ ", Fail: "❌"}
+	for _, c := range r.Checks {
+		fmt.Fprintf(w, "%s %-*s  %s\n", icons[c.Status], width, c.Name, c.Detail)
+	}
+	fmt.Fprintln(w)
+	if r.OK {
+		fmt.Fprintln(w, "All required checks passed.")
+	} else {
+		fmt.Fprintln(w, "Some checks failed; calls are likely to fail until they are fixed.")
+	}
+}
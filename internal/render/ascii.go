@@ -62,12 +62,22 @@ func getTerminalSize() (width, height int) {
 	return width, height
 }
 
-// convertToASCII converts a grayscale pixel value to an ASCII character
-func convertToASCII(pixelValue byte) string {
+// Charsets are the character ramps a frame can be drawn with, dark to light
+var Charsets = map[string][]string{
 	// Basic ASCII characters from dark to light
-	asciiChars := []string{" ", ".", ":", "-", "=", "+", "*", "#", "%", "@"}
+	"standard": {" ", ".", ":", "-", "=", "+", "*", "#", "%", "@"},
+	"blocks":   {" ", "░", "▒", "▓", "█"},
+	"detailed": strings.Split(" .'`^\",:;Il!i><~+_-?][}{1)(|\\/tfjrxnuvczXYUJCLQ0OZmwqpdbkhao*#MW&8%B@$", ""),
+}
+
+// convertToASCII converts a grayscale pixel value to a character of the
+// given ramp, or the standard ramp when asciiChars is empty
+func convertToASCII(pixelValue byte, asciiChars []string) string {
+	if len(asciiChars) == 0 {
+		asciiChars = Charsets["standard"]
+	}
 
-	// Map pixel value (0-255) to ASCII character index (0-9)
+	// Map pixel value (0-255) to a character index in the ramp
 	charIndex := int(pixelValue) * (len(asciiChars) - 1) / 255
 	if charIndex >= len(asciiChars) {
 		charIndex = len(asciiChars) - 1
@@ -76,19 +86,52 @@ func convertToASCII(pixelValue byte) string {
 	return asciiChars[charIndex]
 }
 
-// ConvertFrameToASCII converts a frame to ASCII art with proper scaling
-func ConvertFrameToASCII(frame gocv.Mat) string {
-	// Convert to grayscale for better ASCII representation
-	gray := gocv.NewMat()
-	defer gray.Close()
-	gocv.CvtColor(frame, &gray, gocv.ColorBGRToGray)
+// ColorMode controls how much color information is emitted per character
+type ColorMode int
 
-	// Get terminal dimensions
-	termWidth, termHeight := getTerminalSize()
+const (
+	ColorNone ColorMode = iota // plain grayscale ramp
+	Color256                   // xterm 256-color palette
+	ColorTrue                  // 24-bit truecolor
+)
 
-	// Calculate scaling factors to fit the image in terminal
-	// Terminal characters are typically 2:1 aspect ratio (height:width)
-	charAspectRatio := 2.0
+func (c ColorMode) String() string {
+	switch c {
+	case Color256:
+		return "256"
+	case ColorTrue:
+		return "truecolor"
+	default:
+		return "gray"
+	}
+}
+
+// ParseColorMode parses "gray", "256" or "truecolor"
+func ParseColorMode(s string) (ColorMode, bool) {
+	switch s {
+	case "gray", "none", "":
+		return ColorNone, true
+	case "256":
+		return Color256, true
+	case "truecolor", "true", "24bit":
+		return ColorTrue, true
+	}
+	return ColorNone, false
+}
+
+// Quality describes the geometry and color depth of a rendered frame
+type Quality struct {
+	Width  int // target width in characters
+	Height int // target height in characters
+	Color  ColorMode
+	// Charset is the ramp to draw with; nil means Charsets["standard"]
+	Charset []string
+}
+
+// TerminalQuality returns the default quality for the current terminal:
+// full size, no color
+func TerminalQuality() Quality {
+	termWidth, termHeight := getTerminalSize()
 
 	// Adjust target size based on terminal size for better quality
 	targetWidth := termWidth
@@ -103,6 +146,34 @@ func ConvertFrameToASCII(frame gocv.Mat) string {
 		targetHeight = termHeight - 1
 	}
 
+	return Quality{Width: targetWidth, Height: targetHeight, Color: ColorNone}
+}
+
+// ConvertFrameToASCII converts a frame to ASCII art with proper scaling
+func ConvertFrameToASCII(frame gocv.Mat) string {
+	return ConvertFrameToASCIIWithQuality(frame, TerminalQuality())
+}
+
+// ConvertFrameToASCIIWithQuality converts a frame to ASCII art that fits
+// within q.Width x q.Height characters, colored according to q.Color
+func ConvertFrameToASCIIWithQuality(frame gocv.Mat, q Quality) string {
+	// Convert to grayscale for better ASCII representation
+	gray := gocv.NewMat()
+	defer gray.Close()
+	gocv.CvtColor(frame, &gray, gocv.ColorBGRToGray)
+
+	// Calculate scaling factors to fit the image in the target size
+	// Terminal characters are typically 2:1 aspect ratio (height:width)
+	charAspectRatio := 2.0
+
+	targetWidth, targetHeight := q.Width, q.Height
+	if targetWidth < 1 {
+		targetWidth = 1
+	}
+	if targetHeight < 1 {
+		targetHeight = 1
+	}
+
 	scaleX := float64(gray.Cols()) / float64(targetWidth)
 	scaleY := float64(gray.Rows()) / (float64(targetHeight) * charAspectRatio)
 
@@ -120,26 +191,57 @@ func ConvertFrameToASCII(frame gocv.Mat) string {
 	// Calculate new dimensions
 	newWidth := int(float64(gray.Cols()) / scale)
 	newHeight := int(float64(gray.Rows()) / scale)
+	size := image.Point{X: newWidth, Y: newHeight}
 
 	// Resize the image to fit terminal
 	resized := gocv.NewMat()
 	defer resized.Close()
-	gocv.Resize(gray, &resized, image.Point{X: newWidth, Y: newHeight}, 0, 0, gocv.InterpolationLinear)
+	gocv.Resize(gray, &resized, size, 0, 0, gocv.InterpolationLinear)
+
+	// Color modes need the resized BGR pixels as well
+	colored := gocv.NewMat()
+	defer colored.Close()
+	if q.Color != ColorNone && frame.Channels() == 3 {
+		gocv.Resize(frame, &colored, size, 0, 0, gocv.InterpolationLinear)
+	}
 
 	var result strings.Builder
 
 	// Convert frame to ASCII
 	for y := 0; y < resized.Rows(); y++ {
+		lastColor := ""
 		for x := 0; x < resized.Cols(); x++ {
 			// Get pixel value
 			pixelValue := resized.GetUCharAt(y, x)
 
+			if !colored.Empty() {
+				// Only emit an escape when the color actually changes
+				bgr := colored.GetVecbAt(y, x)
+				if c := colorEscape(q.Color, bgr[2], bgr[1], bgr[0]); c != lastColor {
+					result.WriteString(c)
+					lastColor = c
+				}
+			}
+
 			// Convert to ASCII
-			asciiChar := convertToASCII(pixelValue)
+			asciiChar := convertToASCII(pixelValue, q.Charset)
 			result.WriteString(asciiChar)
 		}
+		if lastColor != "" {
+			result.WriteString("\033[0m")
+		}
 		result.WriteString("\n")
 	}
 
 	return result.String()
 }
+
+// colorEscape returns the ANSI foreground escape for an RGB pixel
+func colorEscape(mode ColorMode, r, g, b uint8) string {
+	if mode == ColorTrue {
+		return "\033[38;2;" + strconv.Itoa(int(r)) + ";" + strconv.Itoa(int(g)) + ";" + strconv.Itoa(int(b)) + "m"
+	}
+	// Map onto the 6x6x6 color cube of the xterm 256-color palette
+	idx := 16 + 36*(int(r)*5/255) + 6*(int(g)*5/255) + int(b)*5/255
+	return "\033[38;5;" + strconv.Itoa(idx) + "m"
+}
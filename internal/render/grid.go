@@ -0,0 +1,137 @@
+package render
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// videoAspect is the width:height of a 4:3 frame in terminal cells, which
+// are about twice as tall as they are wide
+const videoAspect = 4.0 / 3.0 * 2
+
+// Tile is one participant in a grid: its latest frame and a label
+type Tile struct {
+	Label string
+	// Frame is ASCII lines as sent by ConvertFrameToASCIIWithQuality,
+	// possibly with color escapes; empty until the first frame arrives
+	Frame string
+}
+
+// GridLayout picks the columns and rows for n tiles that leave the largest
+// frames in a width x height area, and the size of each frame (a tile less
+// its label row and a column of spacing)
+func GridLayout(n, width, height int) (cols, rows, frameW, frameH int) {
+	if n < 1 {
+		n = 1
+	}
+	best := -1.0
+	for c := 1; c <= n; c++ {
+		r := (n + c - 1) / c
+		w, h := width/c-1, height/r-1
+		if w < 1 || h < 1 {
+			continue
+		}
+		// the area a 4:3 frame covers once fitted into w x h
+		fw, fh := float64(w), float64(h)
+		if fw > fh*videoAspect {
+			fw = fh * videoAspect
+		} else {
+			fh = fw / videoAspect
+		}
+		if area := fw * fh; area > best {
+			best, cols, rows, frameW, frameH = area, c, r, w, h
+		}
+	}
+	if best < 0 {
+		return n, 1, 1, 1
+	}
+	return cols, rows, frameW, frameH
+}
+
+// ComposeGrid lays tiles out row by row in a width x height area. Each frame
+// is centered in its tile and cropped if it is larger; the label goes on the
+// row below it.
+func ComposeGrid(tiles []Tile, width, height int) string {
+	cols, rows, frameW, frameH := GridLayout(len(tiles), width, height)
+
+	var b strings.Builder
+	for r := 0; r < rows; r++ {
+		row := tiles[r*cols : min((r+1)*cols, len(tiles))]
+		cells := make([][]string, len(row))
+		for i, t := range row {
+			cells[i] = fitFrame(t.Frame, frameW, frameH)
+		}
+		for y := 0; y < frameH; y++ {
+			for _, cell := range cells {
+				b.WriteString(cell[y])
+				b.WriteByte(' ')
+			}
+			b.WriteString("\033[K\n")
+		}
+		for _, t := range row {
+			label := Truncate(t.Label, frameW)
+			pad := frameW - len([]rune(label))
+			b.WriteString("\033[7m" + label + "\033[0m" + strings.Repeat(" ", pad+1))
+		}
+		b.WriteString("\033[K\n")
+	}
+	// wipe what a grid with more rows left below
+	b.WriteString("\033[J")
+	return b.String()
+}
+
+// fitFrame returns frame as exactly h lines of w visible columns
+func fitFrame(frame string, w, h int) []string {
+	lines := strings.Split(strings.TrimRight(frame, "\n"), "\n")
+	if frame == "" {
+		lines = nil
+	}
+	if len(lines) > h {
+		skip := (len(lines) - h) / 2
+		lines = lines[skip : skip+h]
+	}
+	top := (h - len(lines)) / 2
+	blank := strings.Repeat(" ", w)
+
+	out := make([]string, h)
+	for y := range out {
+		i := y - top
+		if i < 0 || i >= len(lines) {
+			out[y] = blank
+			continue
+		}
+		out[y] = fitLine(lines[i], w)
+	}
+	return out
+}
+
+// fitLine crops or pads a line to w visible columns, centering short ones;
+// color escapes are kept and reset at the end
+func fitLine(line string, w int) string {
+	var b strings.Builder
+	visible, colored := 0, false
+	for i := 0; i < len(line); {
+		if line[i] == '\033' {
+			end := strings.IndexByte(line[i:], 'm')
+			if end < 0 {
+				break
+			}
+			b.WriteString(line[i : i+end+1])
+			colored = true
+			i += end + 1
+			continue
+		}
+		if visible == w {
+			break
+		}
+		_, size := utf8.DecodeRuneInString(line[i:])
+		b.WriteString(line[i : i+size])
+		i += size
+		visible++
+	}
+	if colored {
+		b.WriteString("\033[0m")
+	}
+	left := (w - visible) / 2
+	return strings.Repeat(" ", left) + b.String() + strings.Repeat(" ", w-visible-left)
+}
@@ -0,0 +1,201 @@
+package render
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// RawMode switches the terminal to character-at-a-time input without echo
+// and returns a function that restores the previous settings. Output
+// processing and Ctrl+C are left alone so frames and signals still work.
+func RawMode() (restore func(), err error) {
+	get := exec.Command("stty", "-g")
+	get.Stdin = os.Stdin
+	saved, err := get.Output()
+	if err != nil {
+		return nil, errors.New("stdin is not a terminal")
+	}
+
+	set := exec.Command("stty", "-icanon", "-echo", "min", "1")
+	set.Stdin = os.Stdin
+	if err := set.Run(); err != nil {
+		return nil, err
+	}
+
+	return func() {
+		cmd := exec.Command("stty", strings.TrimSpace(string(saved)))
+		cmd.Stdin = os.Stdin
+		cmd.Run()
+	}, nil
+}
+
+// LineEditor is a single input line with cursor movement and history.
+// Feed it raw bytes from stdin; it returns lines as they are submitted.
+type LineEditor struct {
+	mu      sync.Mutex
+	prompt  string
+	buf     []rune
+	pos     int
+	history []string
+	histPos int    // index into history while browsing, len(history) otherwise
+	pending []byte // incomplete escape sequence or UTF-8 rune
+}
+
+// NewLineEditor creates an empty editor that shows prompt before the text
+func NewLineEditor(prompt string) *LineEditor {
+	return &LineEditor{prompt: prompt}
+}
+
+// Feed processes input bytes and returns any lines submitted with Enter
+func (e *LineEditor) Feed(b []byte) []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var lines []string
+	data := append(e.pending, b...)
+	e.pending = nil
+
+	for len(data) > 0 {
+		c := data[0]
+		switch {
+		case c == 0x1b: // escape sequence
+			n, ok := e.escape(data)
+			if !ok {
+				e.pending = append([]byte(nil), data...)
+				return lines
+			}
+			data = data[n:]
+			continue
+		case c == '\r' || c == '\n':
+			if line := string(e.buf); strings.TrimSpace(line) != "" {
+				lines = append(lines, line)
+				e.history = append(e.history, line)
+			}
+			e.buf, e.pos = nil, 0
+			e.histPos = len(e.history)
+		case c == 0x7f || c == 0x08: // backspace
+			if e.pos > 0 {
+				e.buf = append(e.buf[:e.pos-1], e.buf[e.pos:]...)
+				e.pos--
+			}
+		case c == 0x01: // Ctrl+A
+			e.pos = 0
+		case c == 0x05: // Ctrl+E
+			e.pos = len(e.buf)
+		case c == 0x15: // Ctrl+U
+			e.buf = append([]rune(nil), e.buf[e.pos:]...)
+			e.pos = 0
+		case c == 0x0b: // Ctrl+K
+			e.buf = e.buf[:e.pos]
+		case c < 0x20:
+			// ignore other control characters
+		default:
+			if !utf8.FullRune(data) {
+				e.pending = append([]byte(nil), data...)
+				return lines
+			}
+			r, size := utf8.DecodeRune(data)
+			e.insert(r)
+			data = data[size:]
+			continue
+		}
+		data = data[1:]
+	}
+	return lines
+}
+
+// escape handles an ANSI escape sequence at the start of data and returns
+// how many bytes it consumed, or false if the sequence is incomplete
+func (e *LineEditor) escape(data []byte) (int, bool) {
+	if len(data) < 3 {
+		return 0, false
+	}
+	if data[1] != '[' && data[1] != 'O' {
+		return 1, true
+	}
+	switch data[2] {
+	case 'A': // up
+		if e.histPos > 0 {
+			e.histPos--
+			e.setText(e.history[e.histPos])
+		}
+	case 'B': // down
+		if e.histPos < len(e.history)-1 {
+			e.histPos++
+			e.setText(e.history[e.histPos])
+		} else {
+			e.histPos = len(e.history)
+			e.setText("")
+		}
+	case 'C': // right
+		if e.pos < len(e.buf) {
+			e.pos++
+		}
+	case 'D': // left
+		if e.pos > 0 {
+			e.pos--
+		}
+	case 'H':
+		e.pos = 0
+	case 'F':
+		e.pos = len(e.buf)
+	case '3': // delete: ESC [ 3 ~
+		if len(data) < 4 {
+			return 0, false
+		}
+		if e.pos < len(e.buf) {
+			e.buf = append(e.buf[:e.pos], e.buf[e.pos+1:]...)
+		}
+		return 4, true
+	}
+	return 3, true
+}
+
+func (e *LineEditor) insert(r rune) {
+	e.buf = append(e.buf, 0)
+	copy(e.buf[e.pos+1:], e.buf[e.pos:])
+	e.buf[e.pos] = r
+	e.pos++
+}
+
+func (e *LineEditor) setText(s string) {
+	e.buf = []rune(s)
+	e.pos = len(e.buf)
+}
+
+// Render returns the prompt and text with the cursor shown in reverse
+// video, scrolled so the cursor stays within width columns
+func (e *LineEditor) Render(width int) string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	avail := width - len([]rune(e.prompt)) - 1
+	if avail < 1 {
+		avail = 1
+	}
+	start := 0
+	if e.pos >= avail {
+		start = e.pos - avail + 1
+	}
+	end := start + avail
+	if end > len(e.buf) {
+		end = len(e.buf)
+	}
+
+	var b strings.Builder
+	b.WriteString(e.prompt)
+	b.WriteString(string(e.buf[start:e.pos]))
+	cursor := " "
+	if e.pos < len(e.buf) {
+		cursor = string(e.buf[e.pos])
+	}
+	b.WriteString("\033[7m" + cursor + "\033[0m")
+	if e.pos+1 <= end {
+		b.WriteString(string(e.buf[e.pos+1 : end]))
+	}
+	return b.String()
+}
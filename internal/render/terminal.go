@@ -6,6 +6,7 @@ import (
 	"os/exec"
 	"runtime"
 	"strconv"
+	"strings"
 )
 
 // ClearTerminal clears the terminal screen
@@ -59,3 +60,82 @@ func GetTerminalSize() (width, height int) {
 
 	return width, height
 }
+
+// DrawStatusBar draws text in reverse video on the bottom row of the
+// terminal without disturbing the current cursor position
+func DrawStatusBar(text string) {
+	DrawBottomLine(0, "\033[7m "+text+" \033[0m")
+}
+
+// DrawBottomLine draws text on the row offset lines above the bottom of the
+// terminal (0 is the last row) without disturbing the cursor position
+func DrawBottomLine(offset int, text string) {
+	// Save cursor, jump to the last row (terminals clamp 999), move up,
+	// clear the row, print and restore the cursor
+	up := ""
+	if offset > 0 {
+		up = fmt.Sprintf("\033[%dA", offset)
+	}
+	fmt.Printf("\0337\033[999;1H%s\033[2K%s\0338", up, text)
+}
+
+// TerminalWidth returns the width of the terminal in columns
+func TerminalWidth() int {
+	width, _ := getTerminalSize()
+	return width
+}
+
+// Truncate shortens s to at most width runes so it never wraps
+func Truncate(s string, width int) string {
+	r := []rune(s)
+	if width < 1 || len(r) <= width {
+		return s
+	}
+	if width == 1 {
+		return "…"
+	}
+	return string(r[:width-1]) + "…"
+}
+
+// ProgressBar renders done/total as a bar of width cells
+func ProgressBar(done, total int64, width int) string {
+	filled := width
+	if total > 0 {
+		filled = int(done * int64(width) / total)
+	}
+	if filled > width {
+		filled = width
+	}
+	return "[" + strings.Repeat("█", filled) + strings.Repeat("·", width-filled) + "]"
+}
+
+// DrawAt draws text starting at the 1-based row and column without
+// disturbing the cursor position
+func DrawAt(row, col int, text string) {
+	fmt.Printf("\0337\033[%d;%dH%s\0338", row, col, text)
+}
+
+// bars are the eighth-block characters used for vertical meters
+var bars = []rune(" ▁▂▃▄▅▆▇█")
+
+// BarRows renders values in 0..1 as vertical bars height rows tall, one
+// column per value; row 0 is the top
+func BarRows(values []float64, height int) []string {
+	rows := make([]string, height)
+	for r := 0; r < height; r++ {
+		fromBottom := height - 1 - r
+		line := make([]rune, len(values))
+		for i, v := range values {
+			fill := int(v*float64(height*8)) - fromBottom*8
+			if fill < 0 {
+				fill = 0
+			}
+			if fill > 8 {
+				fill = 8
+			}
+			line[i] = bars[fill]
+		}
+		rows[r] = string(line)
+	}
+	return rows
+}
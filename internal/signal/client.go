@@ -5,7 +5,12 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/pion/webrtc/v4"
 )
@@ -15,34 +20,188 @@ type Client struct {
 	Room     string // meeting ID
 	ClientID string // uuid or random string
 	HC       *http.Client
+
+	// Creds admit us to a protected room; Join stores the secret the
+	// server issues in it
+	Creds Credentials
+
+	opening sync.Mutex // held while the event stream starts, outside mu
+
+	mu       sync.Mutex
+	role     string     // set by Join
+	want     string     // the role asked for, to join again with
+	phase    string     // sent with heartbeats
+	room     *roomState // fed by the event stream
+	stop     func()     // ends the event stream
+	noEvents bool       // the server has no /events; poll instead
+
+	beat sync.Once     // starts the heartbeats on the first join
+	quit chan struct{} // closed by Leave and Close
+	done sync.Once
 }
 
 func New(base, room, clientID string) *Client {
-	return &Client{Base: base, Room: room, ClientID: clientID, HC: &http.Client{}}
+	return &Client{Base: base, Room: room, ClientID: clientID, HC: &http.Client{}, room: newRoomState(), quit: make(chan struct{})}
+}
+
+// Health checks the signaling server and its Redis connection
+func (c *Client) Health() error {
+	resp, err := c.HC.Get(c.Base + "/health")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+		return fmt.Errorf("health status %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
 }
 
 func (c *Client) Join() (string, error) {
-	body, _ := json.Marshal(map[string]string{"clientId": c.ClientID})
+	return c.JoinAs("")
+}
+
+// JoinAs joins asking for role; a mesh peer follows the event stream from
+// then on, since that is where the other peers' signals arrive
+func (c *Client) JoinAs(role string) (string, error) {
+	creds := c.credentials()
+	body, _ := json.Marshal(map[string]string{
+		"clientId": c.ClientID, "role": role,
+		"password": creds.Password, "token": creds.Token, "secret": creds.Secret,
+	})
 	resp, err := c.HC.Post(c.Base+"/room/"+c.Room+"/join", "application/json", bytes.NewReader(body))
 	if err != nil {
 		return "", err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
-		return "", fmt.Errorf("join status %s", resp.Status)
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+		return "", fmt.Errorf("join status %s: %s", resp.Status, bytes.TrimSpace(msg))
 	}
 	var v struct {
-		Role string `json:"role"`
+		Role   string `json:"role"`
+		Secret string `json:"secret"`
 	}
 	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
 		return "", err
 	}
+	c.mu.Lock()
+	c.role, c.want = v.Role, role
+	if v.Secret != "" {
+		c.Creds.Secret = v.Secret
+	}
+	c.mu.Unlock()
+	if v.Role == RolePeer || v.Role == RoleViewer {
+		c.events()
+	}
+	c.beat.Do(func() { go keepAlive(c.quit, c.heartbeat) })
 	return v.Role, nil
 }
 
+// heartbeat posts to /room/{id}/heartbeat and joins again if the server
+// expired us meanwhile. It returns false against servers without
+// heartbeats, and when that join fails.
+func (c *Client) heartbeat() bool {
+	c.mu.Lock()
+	body, _ := json.Marshal(map[string]string{"phase": c.phase})
+	c.mu.Unlock()
+	resp, err := c.post("/heartbeat?clientId="+url.QueryEscape(c.ClientID), body)
+	if err != nil {
+		return true
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return false
+	case http.StatusGone:
+		c.mu.Lock()
+		want := c.want
+		c.mu.Unlock()
+		if _, err := c.JoinAs(want); err != nil {
+			c.room.expire(errRejoin(err))
+			return false
+		}
+	}
+	return true
+}
+
+// SetPhase sends a heartbeat with the new phase right away
+func (c *Client) SetPhase(phase string) {
+	c.mu.Lock()
+	c.phase = phase
+	joined := c.role != ""
+	c.mu.Unlock()
+	if joined {
+		go c.heartbeat()
+	}
+}
+
+// Leave posts to /room/{id}/leave and stops the heartbeats
+func (c *Client) Leave() error {
+	c.done.Do(func() { close(c.quit) })
+	resp, err := c.post("/leave?clientId="+url.QueryEscape(c.ClientID), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("leave failed: %s", resp.Status)
+	}
+	return nil
+}
+
+// credentials returns Creds, which Join updates
+func (c *Client) credentials() Credentials {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Creds
+}
+
+// post sends body to a room endpoint that changes the room, with the
+// secret that proves our client ID
+func (c *Client) post(path string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest("POST", c.Base+"/room/"+c.Room+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Client-Secret", c.credentials().Secret)
+	return c.HC.Do(req)
+}
+
+// get reads a room endpoint as our client ID; the room's SDPs and
+// candidates are for its members only
+func (c *Client) get(path string) (*http.Response, error) {
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	req, err := http.NewRequest("GET", c.Base+"/room/"+c.Room+path+sep+"clientId="+url.QueryEscape(c.ClientID), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Client-Secret", c.credentials().Secret)
+	return c.HC.Do(req)
+}
+
+// SendSignal posts a mesh signal to /room/{id}/signal
+func (c *Client) SendSignal(m Message) error {
+	body, _ := json.Marshal(m)
+	resp, err := c.post("/signal?clientId="+c.ClientID, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("post %s failed: %s", m.Type, resp.Status)
+	}
+	return nil
+}
+
 func (c *Client) PostOffer(sdp string) error {
 	body, _ := json.Marshal(map[string]string{"sdp": sdp})
-	resp, err := c.HC.Post(c.Base+"/room/"+c.Room+"/offer?clientId="+c.ClientID, "application/json", bytes.NewReader(body))
+	resp, err := c.post("/offer?clientId="+c.ClientID, body)
 	if err != nil {
 		return err
 	}
@@ -54,7 +213,7 @@ func (c *Client) PostOffer(sdp string) error {
 }
 
 func (c *Client) GetOffer() (string, bool, error) {
-	resp, err := c.HC.Get(c.Base + "/room/" + c.Room + "/offer")
+	resp, err := c.get("/offer")
 	if err != nil {
 		return "", false, err
 	}
@@ -73,7 +232,7 @@ func (c *Client) GetOffer() (string, bool, error) {
 
 func (c *Client) PostAnswer(sdp string) error {
 	body, _ := json.Marshal(map[string]string{"sdp": sdp})
-	resp, err := c.HC.Post(c.Base+"/room/"+c.Room+"/answer?clientId="+c.ClientID, "application/json", bytes.NewReader(body))
+	resp, err := c.post("/answer?clientId="+c.ClientID, body)
 	if err != nil {
 		return err
 	}
@@ -85,7 +244,7 @@ func (c *Client) PostAnswer(sdp string) error {
 }
 
 func (c *Client) GetAnswer() (string, bool, error) {
-	resp, err := c.HC.Get(c.Base + "/room/" + c.Room + "/answer")
+	resp, err := c.get("/answer")
 	if err != nil {
 		return "", false, err
 	}
@@ -102,9 +261,49 @@ func (c *Client) GetAnswer() (string, bool, error) {
 	return v.SDP, true, nil
 }
 
+// Description is a session description sent after the initial offer/answer
+type Description struct {
+	Seq  int    `json:"seq"`
+	Type string `json:"type"`
+	SDP  string `json:"sdp"`
+}
+
+// PostDescription sends a renegotiation offer or answer as role from
+func (c *Client) PostDescription(from, typ, sdp string) error {
+	body, _ := json.Marshal(map[string]string{"type": typ, "sdp": sdp})
+	resp, err := c.post("/sdp?from="+from+"&clientId="+c.ClientID, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("post description failed: %s", resp.Status)
+	}
+	return nil
+}
+
+// GetDescriptions returns the descriptions role from sent after seq, in order
+func (c *Client) GetDescriptions(from string, after int) ([]Description, error) {
+	resp, err := c.get(fmt.Sprintf("/sdp?from=%s&after=%d", from, after))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("get descriptions failed: %s", resp.Status)
+	}
+	var v struct {
+		Descriptions []Description `json:"descriptions"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		return nil, err
+	}
+	return v.Descriptions, nil
+}
+
 func (c *Client) PostICE(from, candB64 string) error {
 	body, _ := json.Marshal(map[string]string{"candidate": candB64})
-	resp, err := c.HC.Post(c.Base+"/room/"+c.Room+"/ice?from="+from+"&clientId="+c.ClientID, "application/json", bytes.NewReader(body))
+	resp, err := c.post("/ice?from="+from+"&clientId="+c.ClientID, body)
 	if err != nil {
 		return err
 	}
@@ -115,9 +314,18 @@ func (c *Client) PostICE(from, candB64 string) error {
 	return nil
 }
 
-// Subscribe ICE (SSE) to="offer" or "answer"
-func (c *Client) SubscribeICE(to string, onCand func(string)) (*http.Response, error) {
-	resp, err := c.HC.Get(c.Base + "/room/" + c.Room + "/ice?to=" + to)
+// Subscribe ICE (SSE) to="offer" or "answer"; closing the result ends
+// the subscription. Uses the room event stream for our own role, /ice
+// otherwise.
+func (c *Client) SubscribeICE(to string, onCand func(string)) (io.Closer, error) {
+	c.mu.Lock()
+	own := to == c.role
+	c.mu.Unlock()
+	if room := c.events(); room != nil && own {
+		id := room.subscribeICE(onCand)
+		return closerFunc(func() error { room.unsubscribeICE(id); return nil }), nil
+	}
+	resp, err := c.get("/ice?to=" + to)
 	if err != nil {
 		return nil, err
 	}
@@ -135,7 +343,64 @@ func (c *Client) SubscribeICE(to string, onCand func(string)) (*http.Response, e
 		}
 		resp.Body.Close()
 	}()
-	return resp, nil
+	return resp.Body, nil
+}
+
+// Invite asks the server for a token that admits its holder to the room
+// for valid. A room with a password needs Creds.Password, or our secret
+// from joining it.
+func (c *Client) Invite(valid time.Duration) (token string, expires time.Time, err error) {
+	body, _ := json.Marshal(map[string]string{"password": c.credentials().Password, "ttl": valid.String()})
+	resp, err := c.post("/invite?clientId="+url.QueryEscape(c.ClientID), body)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+		return "", time.Time{}, fmt.Errorf("invite status %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	var v struct {
+		Token   string    `json:"token"`
+		Expires time.Time `json:"expires"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		return "", time.Time{}, err
+	}
+	return v.Token, v.Expires, nil
+}
+
+// Rooms lists the server's active rooms, or just Room if set, with the
+// admin token the server was started with
+func (c *Client) Rooms(adminToken string) ([]RoomInfo, error) {
+	path := "/admin/rooms"
+	if c.Room != "" {
+		path += "/" + url.PathEscape(c.Room)
+	}
+	req, err := http.NewRequest("GET", c.Base+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	resp, err := c.HC.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+		return nil, fmt.Errorf("rooms status %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	if c.Room != "" {
+		var room RoomInfo
+		err := json.NewDecoder(resp.Body).Decode(&room)
+		return []RoomInfo{room}, err
+	}
+	var v struct {
+		Rooms []RoomInfo `json:"rooms"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&v)
+	return v.Rooms, err
 }
 
 func (c *Client) FetchICEServers() ([]webrtc.ICEServer, error) {
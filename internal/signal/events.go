@@ -0,0 +1,180 @@
+package signal
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// errNoEvents means the server predates /room/{id}/events
+var errNoEvents = fmt.Errorf("server has no event stream")
+
+// events returns the room state fed by GET /room/{id}/events, starting the
+// stream on first use. It returns nil before Join and when the server has
+// no stream, and callers then poll. The stream is opened without holding
+// c.mu, so heartbeats do not wait on it.
+func (c *Client) events() *roomState {
+	c.opening.Lock()
+	defer c.opening.Unlock()
+	c.mu.Lock()
+	started, role, secret, noEvents := c.stop != nil, c.role, c.Creds.Secret, c.noEvents
+	c.mu.Unlock()
+	if started {
+		return c.room
+	}
+	if role == "" || noEvents {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	resp, err := c.openEvents(ctx, role, secret, "")
+	if err != nil {
+		cancel()
+		if err == errNoEvents {
+			c.mu.Lock()
+			c.noEvents = true
+			c.mu.Unlock()
+		}
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.quit:
+		// closed while the stream was opening
+		cancel()
+		resp.Body.Close()
+		return nil
+	default:
+	}
+	c.stop = cancel
+	go c.followEvents(ctx, role, resp)
+	return c.room
+}
+
+// openEvents connects to the room's event stream for role, resuming after
+// lastID if set
+func (c *Client) openEvents(ctx context.Context, role, secret, lastID string) (*http.Response, error) {
+	q := url.Values{"to": {role}, "clientId": {c.ClientID}}
+	req, err := http.NewRequestWithContext(ctx, "GET", c.Base+"/room/"+c.Room+"/events?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("X-Client-Secret", secret)
+	if lastID != "" {
+		req.Header.Set("Last-Event-ID", lastID)
+	}
+	resp, err := c.HC.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case 200:
+		return resp, nil
+	case 404, 405:
+		resp.Body.Close()
+		return nil, errNoEvents
+	default:
+		resp.Body.Close()
+		return nil, fmt.Errorf("events status %s", resp.Status)
+	}
+}
+
+// followEvents reads the stream and reconnects after it drops, resuming
+// with the last event ID seen, until ctx ends
+func (c *Client) followEvents(ctx context.Context, role string, resp *http.Response) {
+	peer := "offer"
+	if role == "offer" {
+		peer = "answer"
+	}
+	lastID := ""
+	for {
+		lastID = readEvents(resp.Body, lastID, func(name, data string) {
+			c.room.applyEvent(peer, name, data)
+		})
+		resp.Body.Close()
+
+		for backoff := time.Second; ; backoff = min(2*backoff, 10*time.Second) {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			// a join after a 410 may have changed both
+			c.mu.Lock()
+			role, secret := c.role, c.Creds.Secret
+			c.mu.Unlock()
+			var err error
+			if resp, err = c.openEvents(ctx, role, secret, lastID); err == nil {
+				break
+			}
+		}
+	}
+}
+
+// readEvents parses an SSE stream, calling on for each event, and returns
+// the last ID it carried
+func readEvents(r io.Reader, lastID string, on func(name, data string)) string {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1<<20) // SDPs arrive on one line
+	id, name, data := lastID, "", ""
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case line == "":
+			// an event without data still moves the ID on
+			lastID = id
+			if data != "" {
+				on(name, data)
+			}
+			name, data = "", ""
+		case strings.HasPrefix(line, "id: "):
+			id = line[4:]
+		case strings.HasPrefix(line, "event: "):
+			name = line[7:]
+		case strings.HasPrefix(line, "data: "):
+			data = line[6:]
+		}
+	}
+	return lastID
+}
+
+// applyEvent updates the state with a named event sent by peer
+func (s *roomState) applyEvent(peer, name, data string) {
+	switch name {
+	case "signal":
+		var m Message
+		if json.Unmarshal([]byte(data), &m) == nil {
+			s.signalMessage(m)
+		}
+	case "candidate":
+		s.candidate(data)
+	case "offer", "answer":
+		var v struct {
+			SDP string `json:"sdp"`
+		}
+		if json.Unmarshal([]byte(data), &v) == nil {
+			s.setSDP(name, v.SDP)
+		}
+	case "description":
+		var d Description
+		if json.Unmarshal([]byte(data), &d) == nil {
+			s.description(peer, d)
+		}
+	case "peer-joined", "peer-left":
+		var v struct {
+			ClientID string `json:"clientId"`
+			Role     string `json:"role"`
+		}
+		if json.Unmarshal([]byte(data), &v) == nil {
+			s.presenceEvent(v.ClientID, v.Role, strings.TrimPrefix(name, "peer-"))
+		}
+	}
+}
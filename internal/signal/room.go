@@ -0,0 +1,312 @@
+package signal
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// roomState is what a client has heard from the room over a push transport
+// (the WebSocket or the event stream). New subscribers get the candidates
+// and descriptions heard so far first, like the server's backlogs.
+// Callbacks never run with mu held.
+type roomState struct {
+	mu            sync.Mutex
+	offer, answer string
+	// changed is closed and replaced whenever offer or answer is set
+	changed chan struct{}
+	cands   []string
+	descs   map[string][]Description // by sender role
+
+	nextSub  int
+	iceSubs  map[int]func(string)
+	descSubs map[int]*descSub
+	presence func(clientID, role, event string)
+	members  map[string]string // clientID -> last presence event, to skip replays
+	roles    map[string]string // clientID -> role, of the members in the room
+
+	// mesh signals: handled in order, kept until there is a handler
+	signal     func(Message)
+	signals    []Message
+	lastSignal int // event ID of the newest, to skip replays
+
+	// expired hears why we lost our place in the room; lost keeps the
+	// reason until there is a handler
+	expired func(error)
+	lost    error
+
+	// queue holds presence and signal callbacks, run in order off the
+	// reading goroutine
+	queue      []func()
+	delivering bool
+}
+
+// descSub queues descriptions for receiveDescriptions, whose callback may
+// itself send requests and so cannot run on the reading goroutine
+type descSub struct {
+	from string
+	ch   chan Description
+}
+
+func newRoomState() *roomState {
+	return &roomState{
+		changed:  make(chan struct{}),
+		descs:    map[string][]Description{},
+		iceSubs:  map[int]func(string){},
+		descSubs: map[int]*descSub{},
+		members:  map[string]string{},
+		roles:    map[string]string{},
+	}
+}
+
+func (s *roomState) setSDP(typ, sdp string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if typ == MsgOffer {
+		s.offer = sdp
+	} else {
+		s.answer = sdp
+	}
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func (s *roomState) candidate(c string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, seen := range s.cands {
+		if seen == c {
+			return
+		}
+	}
+	s.cands = append(s.cands, c)
+	for _, f := range s.iceSubs {
+		go f(c)
+	}
+}
+
+// description queues d for subscribers to from; replays repeat what they
+// have seen and are skipped
+func (s *roomState) description(from string, d Description) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if h := s.descs[from]; len(h) > 0 && d.Seq <= h[len(h)-1].Seq {
+		return
+	}
+	s.descs[from] = append(s.descs[from], d)
+	for _, sub := range s.descSubs {
+		if sub.from == from {
+			sub.queue(d)
+		}
+	}
+}
+
+func (sub *descSub) queue(d Description) {
+	select {
+	case sub.ch <- d:
+	default:
+		// a receiver 64 descriptions behind has bigger problems
+	}
+}
+
+func (s *roomState) presenceEvent(clientID, role, event string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.members[clientID] == event {
+		return
+	}
+	s.members[clientID] = event
+	if event == "joined" {
+		s.roles[clientID] = role
+	} else {
+		delete(s.roles, clientID)
+	}
+	if f := s.presence; f != nil {
+		s.deliverLocked(func() { f(clientID, role, event) })
+	}
+}
+
+// signalMessage hands a mesh signal to the handler
+func (s *roomState) signalMessage(m Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if m.ID != 0 {
+		if m.ID <= s.lastSignal {
+			return
+		}
+		s.lastSignal = m.ID
+	}
+	f := s.signal
+	if f == nil {
+		s.signals = append(s.signals, m)
+		return
+	}
+	s.deliverLocked(func() { f(m) })
+}
+
+func (s *roomState) onSignal(f func(Message)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.signal = f
+	for _, m := range s.signals {
+		s.deliverLocked(func() { f(m) })
+	}
+	s.signals = nil
+}
+
+// expire reports, once, that the server expired us and we could not join
+// again
+func (s *roomState) expire(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lost != nil {
+		return
+	}
+	s.lost = err
+	if f := s.expired; f != nil {
+		s.deliverLocked(func() { f(err) })
+	}
+}
+
+func (s *roomState) onExpired(f func(error)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expired = f
+	if err := s.lost; err != nil {
+		s.deliverLocked(func() { f(err) })
+	}
+}
+
+// deliverLocked runs f after the callbacks queued before it
+func (s *roomState) deliverLocked(f func()) {
+	s.queue = append(s.queue, f)
+	if s.delivering {
+		return
+	}
+	s.delivering = true
+	go func() {
+		for {
+			s.mu.Lock()
+			if len(s.queue) == 0 {
+				s.delivering = false
+				s.mu.Unlock()
+				return
+			}
+			f := s.queue[0]
+			s.queue = s.queue[1:]
+			s.mu.Unlock()
+			f()
+		}
+	}()
+}
+
+// onPresence sets the presence handler; a handler set after joining first
+// hears of the members already in the room, the SFU first as on join
+func (s *roomState) onPresence(f func(clientID, role, event string)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.presence = f
+	ids := make([]string, 0, len(s.roles))
+	for id := range s.roles {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if (s.roles[ids[i]] == RoleSFU) != (s.roles[ids[j]] == RoleSFU) {
+			return s.roles[ids[i]] == RoleSFU
+		}
+		return ids[i] < ids[j]
+	})
+	for _, id := range ids {
+		role := s.roles[id]
+		s.deliverLocked(func() { f(id, role, "joined") })
+	}
+}
+
+// waitSDP blocks until the offer (typ MsgOffer) or answer is known
+func (s *roomState) waitSDP(ctx context.Context, typ string) (string, error) {
+	for {
+		s.mu.Lock()
+		sdp, changed := s.answer, s.changed
+		if typ == MsgOffer {
+			sdp = s.offer
+		}
+		s.mu.Unlock()
+		if sdp != "" {
+			return sdp, nil
+		}
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+func (s *roomState) subscribeICE(f func(string)) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextSub++
+	s.iceSubs[s.nextSub] = f
+	backlog := append([]string(nil), s.cands...)
+	go func() {
+		for _, c := range backlog {
+			f(c)
+		}
+	}()
+	return s.nextSub
+}
+
+func (s *roomState) unsubscribeICE(id int) {
+	s.mu.Lock()
+	delete(s.iceSubs, id)
+	s.mu.Unlock()
+}
+
+// receiveDescriptions calls on with descriptions from role from, in
+// order, until ctx ends
+func (s *roomState) receiveDescriptions(ctx context.Context, from string, on func(Description)) {
+	s.mu.Lock()
+	s.nextSub++
+	id := s.nextSub
+	sub := &descSub{from: from, ch: make(chan Description, 64)}
+	for _, d := range s.descs[from] {
+		sub.queue(d)
+	}
+	s.descSubs[id] = sub
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.descSubs, id)
+		s.mu.Unlock()
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case d := <-sub.ch:
+			on(d)
+		}
+	}
+}
+
+// apply updates the state with a message pushed by the server
+func (s *roomState) apply(m Message) {
+	if m.To != "" {
+		s.signalMessage(m)
+		return
+	}
+	switch m.Type {
+	case MsgOffer, MsgAnswer:
+		s.setSDP(m.Type, m.SDP)
+	case MsgCandidate:
+		s.candidate(m.Candidate)
+	case MsgDescription:
+		s.description(m.Role, Description{Seq: m.Seq, Type: m.SDPType, SDP: m.SDP})
+	case MsgPresence:
+		s.presenceEvent(m.ClientID, m.Role, m.Event)
+	}
+}
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error { return f() }
@@ -0,0 +1,283 @@
+package signal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// pollInterval is how often the REST client asks for SDPs it waits for
+// when the server has no event stream
+const pollInterval = 700 * time.Millisecond
+
+// heartbeatInterval is how often a joined client tells the server it is
+// still there; the server expires members after 30s without one
+const heartbeatInterval = 10 * time.Second
+
+// Signaler is one client's connection to a room on the signaling server.
+// Client speaks the REST API and follows the room's SSE event stream;
+// WSClient keeps a WebSocket open. Both have offers, answers, candidates
+// and presence pushed to them.
+type Signaler interface {
+	Join() (string, error)
+	// JoinAs joins asking for a role; RolePeer joins a mesh room and
+	// RoleViewer watches one
+	JoinAs(role string) (string, error)
+	FetchICEServers() ([]webrtc.ICEServer, error)
+
+	PostOffer(sdp string) error
+	PostAnswer(sdp string) error
+	PostICE(from, candB64 string) error
+	PostDescription(from, typ, sdp string) error
+
+	// WaitOffer and WaitAnswer block until the peer's SDP is available or
+	// ctx ends
+	WaitOffer(ctx context.Context) (string, error)
+	WaitAnswer(ctx context.Context) (string, error)
+
+	// SubscribeICE calls onCand with every candidate sent to role to,
+	// starting with the ones sent before, until the returned Closer is closed
+	SubscribeICE(to string, onCand func(string)) (io.Closer, error)
+	// ReceiveDescriptions calls on with the renegotiation descriptions role
+	// from sends, in order, until ctx ends
+	ReceiveDescriptions(ctx context.Context, from string, on func(Description))
+
+	// OnPresence is called, in order, when another member joins or leaves
+	// the room; set after joining, it first hears of who is there already
+	OnPresence(f func(clientID, role, event string))
+
+	// SendSignal sends the mesh peer m.To an offer, answer or candidate;
+	// OnSignal is called, in order, with the ones peers send us. Set the
+	// handlers before joining so nothing replayed on join is missed.
+	SendSignal(m Message) error
+	OnSignal(f func(Message))
+
+	// SetPhase records how far our connection got (a Phase*); heartbeats
+	// report it for the signaler's admin view
+	SetPhase(phase string)
+
+	// OnExpired is called if the server expired us, say after a network
+	// outage longer than its heartbeat timeout, and joining again failed;
+	// we are no longer in the room and heartbeats have stopped
+	OnExpired(f func(error))
+
+	// Leave gives up our role at once, ending a two-person call's session.
+	// Until then heartbeats keep it; without them the server expires it.
+	Leave() error
+	Close() error
+}
+
+// Connect opens a WebSocket to the room, falling back to the REST API when
+// the server does not offer one
+func Connect(base, room, clientID string, creds Credentials) Signaler {
+	rest := New(base, room, clientID)
+	rest.Creds = creds
+	ws, err := DialWS(rest)
+	if err != nil {
+		return rest
+	}
+	return ws
+}
+
+// Message is sent both ways on the room WebSocket. Requests from the client
+// carry an ID that the server's ack repeats; everything else is pushed by
+// the server.
+type Message struct {
+	Type      string `json:"type"`
+	ID        int    `json:"id,omitempty"`
+	ClientID  string `json:"clientId,omitempty"`
+	To        string `json:"to,omitempty"`   // mesh: the peer a signal is for
+	Role      string `json:"role,omitempty"` // joined role in an ack; requested in a join; sender otherwise
+	SDP       string `json:"sdp,omitempty"`
+	SDPType   string `json:"sdpType,omitempty"` // description: offer|answer
+	Seq       int    `json:"seq,omitempty"`     // description order per sender
+	Candidate string `json:"candidate,omitempty"`
+	Event     string `json:"event,omitempty"` // presence: joined|left
+	Phase     string `json:"phase,omitempty"` // heartbeat: how far our connection got
+	Error     string `json:"error,omitempty"` // failed request
+
+	// join: what admits us to a protected room, and the secret of an
+	// earlier join with our client ID; the ack carries the secret issued
+	Password string `json:"password,omitempty"`
+	Token    string `json:"token,omitempty"`
+	Secret   string `json:"secret,omitempty"`
+}
+
+// Credentials admit a client to a room. A room with a password takes the
+// password or an invite token from the signaler's invite endpoint; the
+// secret is issued by the server on join and proves the client ID from
+// then on, including to a later join with the same ID.
+type Credentials struct {
+	Password string
+	Token    string
+	Secret   string
+}
+
+// Message types
+const (
+	MsgJoin        = "join"
+	MsgAck         = "ack"
+	MsgOffer       = "offer"
+	MsgAnswer      = "answer"
+	MsgCandidate   = "candidate"
+	MsgDescription = "description"
+	MsgPresence    = "presence"
+	MsgHeartbeat   = "heartbeat"
+	MsgLeave       = "leave"
+)
+
+// Connection phases of a room member. The server sets the first three as
+// it sees them; clients report the others with their heartbeats.
+const (
+	PhaseJoined       = "joined"
+	PhaseOffered      = "offered"
+	PhaseAnswered     = "answered"
+	PhaseConnected    = "connected"
+	PhaseReconnecting = "reconnecting"
+)
+
+// RoomInfo is a room as listed by the signaler's admin API
+type RoomInfo struct {
+	ID       string       `json:"id"`
+	Created  time.Time    `json:"created"`
+	Password bool         `json:"password"`
+	Members  []MemberInfo `json:"members"`
+}
+
+// MemberInfo is one member of a room, in the order they joined
+type MemberInfo struct {
+	ClientID string     `json:"clientId"`
+	Role     string     `json:"role"`
+	Joined   time.Time  `json:"joined"`
+	Phase    string     `json:"phase"`
+	LastSeen *time.Time `json:"lastSeen,omitempty"` // nil for clients that send no heartbeats
+}
+
+// Mesh room roles. Viewers only receive: every peer offers them a link,
+// or with the signaler's SFU on, the room also has a member SFUID with
+// role RoleSFU; peers and viewers then connect to it alone and it forwards
+// the peers' frames and tracks to everyone else.
+const (
+	RolePeer   = "peer"
+	RoleViewer = "viewer"
+	RoleSFU    = "sfu"
+	SFUID      = "sfu"
+)
+
+// MeshOfferer returns which of two mesh peers sends the pair's offer, so
+// both sides agree without asking. Peers always offer to the SFU.
+func MeshOfferer(a, b string) string {
+	switch {
+	case a == SFUID:
+		return b
+	case b == SFUID, a < b:
+		return a
+	}
+	return b
+}
+
+// keepAlive calls beat at once, so the server knows from the start that we
+// send heartbeats, then every heartbeatInterval until quit is closed or
+// beat returns false
+func keepAlive(quit <-chan struct{}, beat func() bool) {
+	if !beat() {
+		return
+	}
+	tick := time.NewTicker(heartbeatInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-quit:
+			return
+		case <-tick.C:
+			if !beat() {
+				return
+			}
+		}
+	}
+}
+
+// errRejoin is why we lost our place in the room: the server expired us
+// and joining again failed with err
+func errRejoin(err error) error {
+	return fmt.Errorf("expired from the room and could not join again: %w", err)
+}
+
+// waitSDP polls get until it finds an SDP or ctx ends
+func waitSDP(ctx context.Context, get func() (string, bool, error)) (string, error) {
+	for {
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(pollInterval):
+			if sdp, ok, _ := get(); ok {
+				return sdp, nil
+			}
+		}
+	}
+}
+
+func (c *Client) WaitOffer(ctx context.Context) (string, error) {
+	if room := c.events(); room != nil {
+		return room.waitSDP(ctx, MsgOffer)
+	}
+	return waitSDP(ctx, c.GetOffer)
+}
+
+func (c *Client) WaitAnswer(ctx context.Context) (string, error) {
+	if room := c.events(); room != nil {
+		return room.waitSDP(ctx, MsgAnswer)
+	}
+	return waitSDP(ctx, c.GetAnswer)
+}
+
+// ReceiveDescriptions follows the event stream, or polls GetDescriptions
+func (c *Client) ReceiveDescriptions(ctx context.Context, from string, on func(Description)) {
+	if room := c.events(); room != nil {
+		room.receiveDescriptions(ctx, from, on)
+		return
+	}
+	seen := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(pollInterval):
+		}
+		descs, err := c.GetDescriptions(from, seen)
+		if err != nil {
+			continue
+		}
+		for _, d := range descs {
+			seen = d.Seq
+			on(d)
+		}
+	}
+}
+
+// OnPresence needs the event stream; without one it is never called
+func (c *Client) OnPresence(f func(clientID, role, event string)) {
+	c.room.onPresence(f)
+	c.events()
+}
+
+func (c *Client) OnSignal(f func(Message)) {
+	c.room.onSignal(f)
+}
+
+func (c *Client) OnExpired(f func(error)) {
+	c.room.onExpired(f)
+}
+
+func (c *Client) Close() error {
+	c.done.Do(func() { close(c.quit) })
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stop != nil {
+		c.stop()
+	}
+	return nil
+}
@@ -0,0 +1,324 @@
+package signal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"golang.org/x/net/websocket"
+)
+
+// wsRequestTimeout bounds how long a request waits for the server's ack
+const wsRequestTimeout = 10 * time.Second
+
+// WSClient signals over one WebSocket per room (/room/{id}/ws). The server
+// pushes the peer's SDPs, candidates, descriptions and presence as they
+// happen, and replays what was sent before on every join. A dropped socket
+// is redialed and rejoined in the background.
+type WSClient struct {
+	rest *Client // for the endpoints outside the room (/ice)
+	url  string
+
+	state *roomState
+
+	mu      sync.Mutex
+	conn    *websocket.Conn
+	closed  bool
+	nextID  int
+	pending map[int]chan Message
+	role    string // set by the first successful join
+	want    string // the role asked for, to rejoin with
+	phase   string // sent with heartbeats
+
+	beat sync.Once     // starts the heartbeats on the first join
+	quit chan struct{} // closed by Leave and Close
+	done sync.Once
+}
+
+// DialWS opens the room's WebSocket on the server rest talks to
+func DialWS(rest *Client) (*WSClient, error) {
+	u, err := url.Parse(rest.Base)
+	if err != nil {
+		return nil, err
+	}
+	origin := u.String()
+	switch u.Scheme {
+	case "https":
+		u.Scheme = "wss"
+	default:
+		u.Scheme = "ws"
+	}
+	u.Path = strings.TrimRight(u.Path, "/") + "/room/" + url.PathEscape(rest.Room) + "/ws"
+	u.RawQuery = url.Values{"clientId": {rest.ClientID}}.Encode()
+
+	c := &WSClient{
+		rest:    rest,
+		url:     u.String(),
+		state:   newRoomState(),
+		pending: map[int]chan Message{},
+		quit:    make(chan struct{}),
+	}
+	conn, err := c.dial(origin)
+	if err != nil {
+		return nil, err
+	}
+	c.conn = conn
+	go c.run(origin)
+	return c, nil
+}
+
+func (c *WSClient) dial(origin string) (*websocket.Conn, error) {
+	cfg, err := websocket.NewConfig(c.url, origin)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), wsRequestTimeout)
+	defer cancel()
+	return cfg.DialContext(ctx)
+}
+
+// run reads messages and redials after the connection drops until Close
+func (c *WSClient) run(origin string) {
+	for {
+		c.mu.Lock()
+		conn := c.conn
+		c.mu.Unlock()
+		for {
+			var m Message
+			if err := websocket.JSON.Receive(conn, &m); err != nil {
+				break
+			}
+			c.handle(m)
+		}
+		conn.Close()
+
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return
+		}
+		for id, ch := range c.pending {
+			close(ch)
+			delete(c.pending, id)
+		}
+		c.mu.Unlock()
+
+		for backoff := time.Second; ; backoff = min(2*backoff, 10*time.Second) {
+			time.Sleep(backoff)
+			if c.isClosed() {
+				return
+			}
+			if next, err := c.dial(origin); err == nil {
+				c.mu.Lock()
+				c.conn = next
+				rejoin, want := c.role != "", c.want
+				c.mu.Unlock()
+				if rejoin {
+					// the server replays the room on join
+					go func() {
+						if _, err := c.JoinAs(want); err != nil {
+							c.state.expire(errRejoin(err))
+						}
+					}()
+				}
+				break
+			}
+		}
+	}
+}
+
+func (c *WSClient) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+func (c *WSClient) handle(m Message) {
+	if m.Type != MsgAck {
+		c.state.apply(m)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ch, ok := c.pending[m.ID]; ok {
+		ch <- m
+		delete(c.pending, m.ID)
+	}
+}
+
+// request sends m and waits for the server's ack
+func (c *WSClient) request(m Message) (Message, error) {
+	ch := make(chan Message, 1)
+	c.mu.Lock()
+	c.nextID++
+	m.ID = c.nextID
+	c.pending[m.ID] = ch
+	conn := c.conn
+	c.mu.Unlock()
+
+	if err := websocket.JSON.Send(conn, m); err != nil {
+		c.mu.Lock()
+		delete(c.pending, m.ID)
+		c.mu.Unlock()
+		return Message{}, err
+	}
+	select {
+	case ack, ok := <-ch:
+		if !ok {
+			return Message{}, errors.New("signaling connection lost")
+		}
+		if ack.Error != "" {
+			return ack, fmt.Errorf("%s failed: %s", m.Type, ack.Error)
+		}
+		return ack, nil
+	case <-time.After(wsRequestTimeout):
+		c.mu.Lock()
+		delete(c.pending, m.ID)
+		c.mu.Unlock()
+		return Message{}, fmt.Errorf("%s: no reply from server", m.Type)
+	}
+}
+
+func (c *WSClient) Join() (string, error) {
+	return c.JoinAs("")
+}
+
+// JoinAs joins with the credentials of the REST client, which keeps the
+// secret issued for rejoining after a reconnect
+func (c *WSClient) JoinAs(role string) (string, error) {
+	creds := c.rest.credentials()
+	ack, err := c.request(Message{Type: MsgJoin, Role: role, Password: creds.Password, Token: creds.Token, Secret: creds.Secret})
+	if err != nil {
+		return "", err
+	}
+	c.rest.mu.Lock()
+	if ack.Secret != "" {
+		c.rest.Creds.Secret = ack.Secret
+	}
+	c.rest.mu.Unlock()
+	c.mu.Lock()
+	c.role, c.want = ack.Role, role
+	c.mu.Unlock()
+	c.beat.Do(func() { go keepAlive(c.quit, c.heartbeat) })
+	return ack.Role, nil
+}
+
+// heartbeat sends one over the socket and joins again if the server
+// expired us meanwhile. It returns false against servers without
+// heartbeats, and when that join fails.
+func (c *WSClient) heartbeat() bool {
+	c.mu.Lock()
+	phase := c.phase
+	c.mu.Unlock()
+	ack, err := c.request(Message{Type: MsgHeartbeat, Phase: phase})
+	switch {
+	case err == nil || ack.Type != MsgAck:
+		// a lost connection is rejoined when it is redialed
+		return true
+	case strings.HasPrefix(ack.Error, "unknown message type"):
+		return false
+	}
+	c.mu.Lock()
+	want := c.want
+	c.mu.Unlock()
+	if _, err := c.JoinAs(want); err != nil {
+		c.state.expire(errRejoin(err))
+		return false
+	}
+	return true
+}
+
+// SetPhase sends a heartbeat with the new phase right away
+func (c *WSClient) SetPhase(phase string) {
+	c.mu.Lock()
+	c.phase = phase
+	joined := c.role != ""
+	c.mu.Unlock()
+	if joined {
+		go c.heartbeat()
+	}
+}
+
+// Leave tells the server we are gone; a redialed socket no longer rejoins
+func (c *WSClient) Leave() error {
+	c.mu.Lock()
+	c.role = ""
+	c.mu.Unlock()
+	c.done.Do(func() { close(c.quit) })
+	_, err := c.request(Message{Type: MsgLeave})
+	return err
+}
+
+func (c *WSClient) FetchICEServers() ([]webrtc.ICEServer, error) {
+	return c.rest.FetchICEServers()
+}
+
+func (c *WSClient) PostOffer(sdp string) error {
+	_, err := c.request(Message{Type: MsgOffer, SDP: sdp})
+	return err
+}
+
+func (c *WSClient) PostAnswer(sdp string) error {
+	_, err := c.request(Message{Type: MsgAnswer, SDP: sdp})
+	return err
+}
+
+func (c *WSClient) PostICE(from, candB64 string) error {
+	_, err := c.request(Message{Type: MsgCandidate, Role: from, Candidate: candB64})
+	return err
+}
+
+func (c *WSClient) PostDescription(from, typ, sdp string) error {
+	_, err := c.request(Message{Type: MsgDescription, Role: from, SDPType: typ, SDP: sdp})
+	return err
+}
+
+func (c *WSClient) WaitOffer(ctx context.Context) (string, error) {
+	return c.state.waitSDP(ctx, MsgOffer)
+}
+
+func (c *WSClient) WaitAnswer(ctx context.Context) (string, error) {
+	return c.state.waitSDP(ctx, MsgAnswer)
+}
+
+// SubscribeICE delivers the candidates the server pushes to our role
+func (c *WSClient) SubscribeICE(to string, onCand func(string)) (io.Closer, error) {
+	id := c.state.subscribeICE(onCand)
+	return closerFunc(func() error { c.state.unsubscribeICE(id); return nil }), nil
+}
+
+func (c *WSClient) ReceiveDescriptions(ctx context.Context, from string, on func(Description)) {
+	c.state.receiveDescriptions(ctx, from, on)
+}
+
+func (c *WSClient) OnPresence(f func(clientID, role, event string)) {
+	c.state.onPresence(f)
+}
+
+func (c *WSClient) SendSignal(m Message) error {
+	_, err := c.request(m)
+	return err
+}
+
+func (c *WSClient) OnSignal(f func(Message)) {
+	c.state.onSignal(f)
+}
+
+func (c *WSClient) OnExpired(f func(error)) {
+	c.state.onExpired(f)
+}
+
+func (c *WSClient) Close() error {
+	c.done.Do(func() { close(c.quit) })
+	c.mu.Lock()
+	c.closed = true
+	conn := c.conn
+	c.mu.Unlock()
+	return conn.Close()
+}
@@ -0,0 +1,49 @@
+package video
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// writeIVFHeader writes the 32-byte IVF file header for a VP8 stream
+func writeIVFHeader(w io.Writer, width, height, fps int) error {
+	hdr := make([]byte, 32)
+	copy(hdr[0:4], "DKIF")
+	binary.LittleEndian.PutUint16(hdr[4:6], 0)  // version
+	binary.LittleEndian.PutUint16(hdr[6:8], 32) // header size
+	copy(hdr[8:12], "VP80")
+	binary.LittleEndian.PutUint16(hdr[12:14], uint16(width))
+	binary.LittleEndian.PutUint16(hdr[14:16], uint16(height))
+	binary.LittleEndian.PutUint32(hdr[16:20], uint32(fps)) // timebase denominator
+	binary.LittleEndian.PutUint32(hdr[20:24], 1)           // timebase numerator
+	_, err := w.Write(hdr)
+	return err
+}
+
+// writeIVFFrame writes one frame with its 12-byte IVF frame header
+func writeIVFFrame(w io.Writer, frame []byte, pts uint64) error {
+	hdr := make([]byte, 12)
+	binary.LittleEndian.PutUint32(hdr[0:4], uint32(len(frame)))
+	binary.LittleEndian.PutUint64(hdr[4:12], pts)
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+	_, err := w.Write(frame)
+	return err
+}
+
+// KeyframeSize returns the dimensions encoded in a VP8 keyframe, or false
+// if frame is not a keyframe
+func KeyframeSize(frame []byte) (width, height int, ok bool) {
+	// 3-byte frame tag (bit 0 clear for keyframes), then the start code
+	// 9d 01 2a and two 16-bit little-endian sizes whose top 2 bits are scaling
+	if len(frame) < 10 || frame[0]&0x01 != 0 {
+		return 0, 0, false
+	}
+	if frame[3] != 0x9d || frame[4] != 0x01 || frame[5] != 0x2a {
+		return 0, 0, false
+	}
+	width = int(binary.LittleEndian.Uint16(frame[6:8]) & 0x3fff)
+	height = int(binary.LittleEndian.Uint16(frame[8:10]) & 0x3fff)
+	return width, height, width > 0 && height > 0
+}
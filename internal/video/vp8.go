@@ -0,0 +1,142 @@
+package video
+
+import (
+	"errors"
+	"io"
+	"os/exec"
+	"strconv"
+
+	"github.com/pion/webrtc/v4/pkg/media/ivfreader"
+)
+
+// ErrNoFFmpeg is returned when ffmpeg, which does the VP8 work, is missing
+var ErrNoFFmpeg = errors.New("ffmpeg not found: install ffmpeg with libvpx for video track mode")
+
+// Encoder compresses raw BGR frames to VP8 with an ffmpeg subprocess
+type Encoder struct {
+	cmd *exec.Cmd
+	in  io.WriteCloser
+	out io.Reader
+	r   *ivfreader.IVFReader
+}
+
+// NewEncoder starts an encoder for width x height BGR frames at fps. The
+// first frame out is always a keyframe.
+func NewEncoder(width, height, fps, bitrateKbps int) (*Encoder, error) {
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		return nil, ErrNoFFmpeg
+	}
+	size := strconv.Itoa(width) + "x" + strconv.Itoa(height)
+	cmd := exec.Command("ffmpeg", "-hide_banner", "-loglevel", "error",
+		"-f", "rawvideo", "-pix_fmt", "bgr24", "-s", size, "-r", strconv.Itoa(fps), "-i", "-",
+		"-c:v", "libvpx", "-deadline", "realtime", "-cpu-used", "8", "-lag-in-frames", "0",
+		"-auto-alt-ref", "0", "-error-resilient", "1",
+		"-b:v", strconv.Itoa(bitrateKbps)+"k", "-g", strconv.Itoa(fps*2),
+		"-f", "ivf", "-")
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &Encoder{cmd: cmd, in: in, out: out}, nil
+}
+
+// WriteFrame queues one raw BGR frame for encoding
+func (e *Encoder) WriteFrame(bgr []byte) error {
+	_, err := e.in.Write(bgr)
+	return err
+}
+
+// ReadFrame blocks until the next VP8 frame is ready. It must be called
+// from a single goroutine.
+func (e *Encoder) ReadFrame() ([]byte, error) {
+	if e.r == nil {
+		// ffmpeg writes the IVF header with its first output
+		r, _, err := ivfreader.NewWith(e.out)
+		if err != nil {
+			return nil, err
+		}
+		e.r = r
+	}
+	frame, _, err := e.r.ParseNextFrame()
+	return frame, err
+}
+
+// Close flushes and stops the encoder
+func (e *Encoder) Close() error {
+	e.in.Close()
+	return e.cmd.Wait()
+}
+
+// Decoder turns VP8 frames back into raw BGR frames with an ffmpeg
+// subprocess
+type Decoder struct {
+	Width, Height int
+
+	cmd   *exec.Cmd
+	in    io.WriteCloser
+	out   io.Reader
+	pts   uint64
+	frame []byte
+}
+
+// NewDecoder starts a decoder for a width x height VP8 stream, as read from
+// its first keyframe with KeyframeSize
+func NewDecoder(width, height int) (*Decoder, error) {
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		return nil, ErrNoFFmpeg
+	}
+	cmd := exec.Command("ffmpeg", "-hide_banner", "-loglevel", "error",
+		"-fflags", "nobuffer", "-flags", "low_delay", "-probesize", "32", "-analyzeduration", "0",
+		"-f", "ivf", "-i", "-",
+		"-f", "rawvideo", "-pix_fmt", "bgr24", "-")
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	d := &Decoder{
+		Width:  width,
+		Height: height,
+		cmd:    cmd,
+		in:     in,
+		out:    out,
+		frame:  make([]byte, width*height*3),
+	}
+	if err := writeIVFHeader(in, width, height, 30); err != nil {
+		d.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// WriteFrame queues one VP8 frame for decoding
+func (d *Decoder) WriteFrame(vp8 []byte) error {
+	d.pts++
+	return writeIVFFrame(d.in, vp8, d.pts)
+}
+
+// ReadFrame blocks until the next decoded BGR frame is ready. The returned
+// slice is reused by the next call.
+func (d *Decoder) ReadFrame() ([]byte, error) {
+	_, err := io.ReadFull(d.out, d.frame)
+	return d.frame, err
+}
+
+// Close stops the decoder
+func (d *Decoder) Close() error {
+	d.in.Close()
+	return d.cmd.Wait()
+}
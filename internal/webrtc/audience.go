@@ -0,0 +1,219 @@
+package webrtc
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	sig "github.com/saswatsam786/snapshell/internal/signal"
+
+	"github.com/pion/webrtc/v4"
+	"gocv.io/x/gocv"
+)
+
+// audience is one side of a two-person call's links to the viewers
+// watching it. Both sides offer every viewer a link of their own, like mesh
+// peers do, and send it the frames they send each other, rendered at the
+// viewer's tile size.
+type audience struct {
+	ctx    context.Context
+	sg     sig.Signaler
+	ice    []webrtc.ICEServer
+	policy ICEPolicy
+
+	mu      sync.Mutex
+	viewers map[string]*viewerLink
+}
+
+// viewerLink is the link to one viewer
+type viewerLink struct {
+	*meshLink
+	// viewport is the viewer's tile size until the frames channel opens;
+	// guarded by meshLink.mu
+	viewport *Viewport
+}
+
+func newAudience(ctx context.Context, sg sig.Signaler, ice []webrtc.ICEServer, policy ICEPolicy) *audience {
+	// a viewer link has no renegotiation to fall back with
+	if policy != ICEPolicyRelay {
+		policy = ICEPolicyAll
+	}
+	return &audience{ctx: ctx, sg: sg, ice: ice, policy: policy, viewers: map[string]*viewerLink{}}
+}
+
+// onPresence links viewers as they join and drops them as they leave
+func (a *audience) onPresence(clientID, role, event string) {
+	if role != sig.RoleViewer {
+		return
+	}
+	if event == "left" {
+		a.drop(clientID)
+		return
+	}
+	if err := a.offer(clientID); err != nil {
+		debugLog.Printf("audience: offer %s: %v", clientID, err)
+		a.drop(clientID)
+	}
+}
+
+// onSignal applies a viewer's answer or candidate
+func (a *audience) onSignal(msg sig.Message) {
+	a.mu.Lock()
+	v := a.viewers[msg.ClientID]
+	a.mu.Unlock()
+	if v == nil {
+		return
+	}
+	switch msg.Type {
+	case sig.MsgAnswer:
+		err := v.pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: msg.SDP})
+		if err != nil {
+			debugLog.Printf("audience: answer from %s: %v", msg.ClientID, err)
+			return
+		}
+		v.tr.remoteReady()
+	case sig.MsgCandidate:
+		v.tr.addRemote(msg.Candidate)
+	}
+}
+
+// offer links a viewer that joined, replacing any earlier link
+func (a *audience) offer(id string) error {
+	pc, path, err := CreatePeerConnectionWithFallback(a.ice, a.policy)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(a.ctx)
+	v := &viewerLink{meshLink: &meshLink{id: id, pc: pc, ctx: ctx, stop: cancel}}
+	v.tr = newTrickle(pc, path, func(b64 string) error {
+		return a.sg.SendSignal(sig.Message{Type: sig.MsgCandidate, To: id, Candidate: b64})
+	})
+	pc.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
+		debugLog.Printf("audience: %s %s", id, s)
+		if s == webrtc.PeerConnectionStateFailed {
+			go a.dropLink(v)
+		}
+	})
+
+	a.mu.Lock()
+	old := a.viewers[id]
+	a.viewers[id] = v
+	a.mu.Unlock()
+	if old != nil {
+		old.close()
+	}
+
+	ctrl, err := NewControlChannel(pc)
+	if err != nil {
+		return err
+	}
+	v.mu.Lock()
+	v.ctrl = ctrl
+	v.mu.Unlock()
+	ctrl.On(ControlHello, func(msg ControlMessage) {
+		if msg.Hello != nil {
+			v.mu.Lock()
+			v.remote = *msg.Hello
+			v.mu.Unlock()
+		}
+	})
+	ctrl.On(ControlViewport, func(msg ControlMessage) {
+		if msg.Viewport == nil {
+			return
+		}
+		v.mu.Lock()
+		qc := v.qc
+		if qc == nil {
+			v.viewport = msg.Viewport
+		}
+		v.mu.Unlock()
+		if qc != nil {
+			qc.SetViewport(msg.Viewport.Width, msg.Viewport.Height)
+		}
+	})
+	ctrl.On(ControlBye, func(ControlMessage) {
+		a.dropLink(v)
+	})
+
+	dc, err := pc.CreateDataChannel("ascii", nil)
+	if err != nil {
+		return err
+	}
+	dc.OnOpen(func() {
+		qc := NewQualityController(pc, dc)
+		go qc.Run(v.ctx)
+		v.mu.Lock()
+		if v.viewport != nil {
+			qc.SetViewport(v.viewport.Width, v.viewport.Height)
+		}
+		v.ascii, v.qc = dc, qc
+		v.mu.Unlock()
+	})
+
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		return err
+	}
+	if err := pc.SetLocalDescription(offer); err != nil {
+		return err
+	}
+	if err := a.sg.SendSignal(sig.Message{Type: sig.MsgOffer, To: id, SDP: path.SDP(offer.SDP)}); err != nil {
+		return err
+	}
+	v.tr.localReady()
+	return nil
+}
+
+// sendFrame sends every viewer the frame, as mesh peers send theirs
+func (a *audience) sendFrame(frame gocv.Mat, captured time.Time) {
+	a.mu.Lock()
+	links := make([]*meshLink, 0, len(a.viewers))
+	for _, v := range a.viewers {
+		links = append(links, v.meshLink)
+	}
+	a.mu.Unlock()
+	if len(links) > 0 {
+		sendFrame(frame, captured, links)
+	}
+}
+
+// dropLink drops a viewer unless v was replaced by a newer link meanwhile
+func (a *audience) dropLink(v *viewerLink) {
+	a.mu.Lock()
+	current := a.viewers[v.id] == v
+	a.mu.Unlock()
+	if current {
+		a.drop(v.id)
+	}
+}
+
+func (a *audience) drop(id string) {
+	a.mu.Lock()
+	v := a.viewers[id]
+	delete(a.viewers, id)
+	a.mu.Unlock()
+	if v != nil {
+		debugLog.Printf("audience: dropped %s", id)
+		v.close()
+	}
+}
+
+// close says bye to every viewer before the links close
+func (a *audience) close() {
+	a.mu.Lock()
+	viewers := a.viewers
+	a.viewers = map[string]*viewerLink{}
+	a.mu.Unlock()
+	for _, v := range viewers {
+		if ctrl := v.control(); ctrl != nil {
+			_ = ctrl.SendBye("the call ended")
+		}
+	}
+	if len(viewers) > 0 {
+		// Give SCTP a moment to flush before the PeerConnections are closed
+		time.Sleep(100 * time.Millisecond)
+	}
+	for _, v := range viewers {
+		v.close()
+	}
+}
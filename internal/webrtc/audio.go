@@ -0,0 +1,142 @@
+package webrtc
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/saswatsam786/snapshell/internal/audio"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+)
+
+// setupAudio adds our Opus track when an audio source is configured; audio
+// from the peer is played by onTrack either way. It must run before the offer or
+// answer is created so the audio m-line is negotiated.
+func (c *call) setupAudio(offerer bool) error {
+	if c.opts.Audio == "" {
+		if offerer {
+			// Still offer to receive so the peer can send audio
+			_, err := c.pc.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio,
+				webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly})
+			return err
+		}
+		return nil
+	}
+
+	src, err := audio.OpenSource(c.opts.Audio)
+	if err != nil {
+		return fmt.Errorf("audio source: %w", err)
+	}
+	track, err := webrtc.NewTrackLocalStaticSample(
+		webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: audio.SampleRate, Channels: 2},
+		"audio", "snapshell")
+	if err != nil {
+		src.Close()
+		return err
+	}
+	sender, err := c.pc.AddTrack(track)
+	if err != nil {
+		src.Close()
+		return err
+	}
+
+	// Drain RTCP so pion's interceptors keep working
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			if _, _, err := sender.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	c.enableVisualizer()
+	go c.sendAudio(track, src)
+	return nil
+}
+
+// sendAudio writes packets from src to track until the call ends. While
+// muted the source keeps being read so it stays in real time.
+func (c *call) sendAudio(track *webrtc.TrackLocalStaticSample, src audio.Source) {
+	defer src.Close()
+	for c.ctx.Err() == nil {
+		packet, pcm, dur, err := src.ReadPacket()
+		if err != nil {
+			log.Println("audio:", err)
+			return
+		}
+		if c.audioMuted() {
+			continue
+		}
+		if _, local := c.meters(); local != nil && pcm != nil {
+			local.Feed(pcm)
+		}
+		if err := track.WriteSample(media.Sample{Data: packet, Duration: dur}); err != nil {
+			debugLog.Printf("audio: write: %v", err)
+		}
+	}
+}
+
+// playAudio decodes the peer's Opus track and plays it
+func (c *call) playAudio(track *webrtc.TrackRemote) {
+	player, err := audio.NewPlayer()
+	if err != nil {
+		debugLog.Printf("audio: %v", err)
+		if player == nil {
+			return
+		}
+	}
+	defer player.Close()
+
+	c.enableVisualizer()
+	remote, _ := c.meters()
+	player.OnPCM(remote.Feed)
+
+	c.mu.Lock()
+	c.player = player
+	c.mu.Unlock()
+
+	for c.ctx.Err() == nil {
+		pkt, _, err := track.ReadRTP()
+		if err != nil {
+			return
+		}
+		if len(pkt.Payload) == 0 {
+			continue
+		}
+		if err := player.Play(pkt.Payload); err != nil {
+			debugLog.Printf("audio: play: %v", err)
+		}
+	}
+}
+
+// setAudioMuted turns our microphone on or off and tells the peer
+func (c *call) setAudioMuted(muted bool) {
+	c.mu.Lock()
+	c.localMute.Audio = muted
+	s := c.localMute
+	c.mu.Unlock()
+	if ctrl := c.control(); ctrl != nil {
+		_ = ctrl.SendMute(s)
+	}
+}
+
+func (c *call) audioMuted() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.localMute.Audio
+}
+
+// toggleSpeaker mutes or unmutes playback of the peer and reports the new
+// state; false when no audio is being received
+func (c *call) toggleSpeaker() (muted, ok bool) {
+	c.mu.Lock()
+	player := c.player
+	c.mu.Unlock()
+	if player == nil {
+		return false, false
+	}
+	muted = !player.Muted()
+	player.SetMuted(muted)
+	return muted, true
+}
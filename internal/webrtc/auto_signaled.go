@@ -8,17 +8,27 @@ import (
 	"os"
 	"os/signal"
 	"strings"
+	"sync/atomic"
 	"syscall"
-	"time"
 
-	"github.com/saswatsam786/snapshell/internal/capture"
 	"github.com/saswatsam786/snapshell/internal/render"
 	sig "github.com/saswatsam786/snapshell/internal/signal"
 
 	"github.com/pion/webrtc/v4"
-	"gocv.io/x/gocv"
 )
 
+// RunSendFile joins room, takes whichever role the server assigns and sends
+// path to the peer, hanging up once the transfer is verified
+func RunSendFile(server, room, clientID, path string, creds sig.Credentials) {
+	if clientID == "" {
+		clientID = "send-" + randID()
+	}
+	if _, err := os.Stat(path); err != nil {
+		log.Fatal(err)
+	}
+	runSignaled(server, room, clientID, CallOptions{SendFile: path, Credentials: creds})
+}
+
 func randID() string {
 	const alpha = "abcdefghijklmnopqrstuvwxyz0123456789"
 	b := make([]byte, 10)
@@ -28,22 +38,75 @@ func randID() string {
 	return string(b)
 }
 
-func RunAutoOfferSignaled(server, room, clientID string) {
+// RunSignaled joins room and takes whichever role the server assigns: the
+// first member calls (offer) and the second answers. If the peer leaves
+// before the call connects it leaves too and joins again, so an answerer
+// whose caller left becomes the caller.
+func RunSignaled(server, room, clientID string, opts CallOptions) {
+	if clientID == "" {
+		clientID = "join-" + randID()
+	}
+	runSignaled(server, room, clientID, opts)
+}
+
+// RunAutoOfferSignaled is RunSignaled for -signaled-o; the server still
+// picks the role.
+//
+// Deprecated: use RunSignaled.
+func RunAutoOfferSignaled(server, room, clientID string, opts CallOptions) {
 	if clientID == "" {
 		clientID = "offer-" + randID()
 	}
+	runSignaled(server, room, clientID, opts)
+}
+
+// RunAutoAnswerSignaled is RunSignaled for -signaled-a.
+//
+// Deprecated: use RunSignaled.
+func RunAutoAnswerSignaled(server, room, clientID string, opts CallOptions) {
+	if clientID == "" {
+		clientID = "answer-" + randID()
+	}
+	runSignaled(server, room, clientID, opts)
+}
 
+func runSignaled(server, room, clientID string, opts CallOptions) {
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
-	sg := sig.New(strings.TrimRight(server, "/"), room, clientID)
-	role, err := sg.Join()
-	if err != nil {
-		log.Fatal("join:", err)
-	}
-	if role != "offer" {
-		log.Fatalf("room %s already assigned offer to someone else (you got %q). Start as -auto-a instead.", room, role)
+	for {
+		sg := sig.Connect(strings.TrimRight(server, "/"), room, clientID, opts.Credentials)
+		role, err := sg.Join()
+		if err != nil {
+			log.Fatal("join:", err)
+		}
+		var peerLeft bool
+		if role == "offer" {
+			fmt.Printf("📞 First in room %s: calling (offer)\n", room)
+			peerLeft = offerSignaled(ctx, sg, opts)
+		} else {
+			fmt.Printf("📞 Room %s has a caller: answering\n", room)
+			peerLeft = answerSignaled(ctx, sg, opts)
+		}
+		// free the role for whoever comes next, not after our heartbeats stop
+		sg.Leave()
+		sg.Close()
+		if !peerLeft || ctx.Err() != nil {
+			return
+		}
+		// A fresh join takes the role that is free now: the offer if the
+		// caller left. An emptied room is gone, and the join recreates it
+		// with our password; an invite to it is refused.
+		fmt.Println("👋 The peer left before the call connected; joining again...")
 	}
+}
+
+// offerSignaled runs a call as the offerer on sg, which has joined. It
+// returns when the call ends, reporting whether that was because the peer
+// left before it connected.
+func offerSignaled(ctx context.Context, sg sig.Signaler, opts CallOptions) bool {
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
 
 	ice, err := sg.FetchICEServers()
 
@@ -51,79 +114,90 @@ func RunAutoOfferSignaled(server, room, clientID string) {
 		ice = []webrtc.ICEServer{{URLs: []string{"stun:stun.l.google.com:19302"}}}
 	}
 
-	pc, err := CreatePeerConnectionWithFallback(ice)
+	pc, path, err := CreatePeerConnectionWithFallback(ice, opts.ICEPolicy)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer pc.Close()
 
-	pc.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
-		fmt.Printf("Connection state: %s\n", s.String())
-		if s == webrtc.PeerConnectionStateFailed ||
-			s == webrtc.PeerConnectionStateDisconnected ||
-			s == webrtc.PeerConnectionStateClosed {
-			stop()
-		}
-	})
+	c := newCall(ctx, stop, pc, opts)
+	// Viewers get a link of their own from each side
+	c.audience = newAudience(ctx, sg, ice, opts.ICEPolicy)
+	defer c.audience.close()
+	sg.OnSignal(c.audience.onSignal)
+	expired := endOnExpiry(sg, stop)
 
-	// Receive remote ASCII (peer's video)
+	// Receive remote ASCII (peer's video) and channels the peer opens mid-call
 	pc.OnDataChannel(func(dc *webrtc.DataChannel) {
+		if c.handleDataChannel(dc) {
+			return
+		}
 		dc.OnMessage(func(msg webrtc.DataChannelMessage) {
-			render.ClearTerminal()
-			fmt.Print(string(msg.Data))
+			c.showFrame(msg.Data, true)
 		})
 	})
 
+	// Control channel: typed messages (viewport, mute, bye, ...) alongside the frames
+	ctrl, err := NewControlChannel(pc)
+	if err != nil {
+		log.Fatal(err)
+	}
+	c.setControl(ctrl)
+
+	// Chat channel with the input line at the bottom of the screen
+	chat, err := NewChat(pc)
+	if err != nil {
+		log.Fatal(err)
+	}
+	c.setChat(chat)
+	defer c.stopInput()
+
 	// Local data channel: send our ASCII frames and also receive remote (if peer uses this DC)
 	dc, err := pc.CreateDataChannel("ascii", nil)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer dc.Close()
+	qc := NewQualityController(pc, dc)
+	c.setQuality(qc)
 
 	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
-		render.ClearTerminal()
-		fmt.Print(string(msg.Data))
+		c.showFrame(msg.Data, true)
 	})
 
 	// Send local webcam frames after open
 	dc.OnOpen(func() {
-		fmt.Println("✅ Data channel opened (offer). Sending...")
-		webcam, _ := capture.OpenWebCam()
-		defer webcam.Close()
-
-		webcam.SetProperty(gocv.VideoCaptureFPS, 10)
-		webcam.SetProperty(gocv.VideoCaptureFrameWidth, 640)
-		webcam.SetProperty(gocv.VideoCaptureFrameHeight, 480)
-
-		t := time.NewTicker(100 * time.Millisecond)
-		defer t.Stop()
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case <-t.C:
-				frame, err := webcam.ReadFrame()
-				if err != nil {
-					continue
-				}
-				ascii := render.ConvertFrameToASCII(frame)
-				frame.Close()
-				_ = dc.SendText(ascii)
-			}
+		if opts.SendFile != "" {
+			return
 		}
+		fmt.Println("✅ Data channel opened (offer). Sending...")
+		c.startVideo(dc, qc)
 	})
 
-	// Send local ICE to server
-	pc.OnICECandidate(func(c *webrtc.ICECandidate) {
-		if c == nil {
-			return
-		}
-		b64, _ := Encode(c.ToJSON())
-		_ = sg.PostICE("offer", b64)
+	// Media tracks must be set up before the offer
+	if err := c.setupAudio(true); err != nil {
+		log.Fatal(err)
+	}
+	if err := c.setupVideoTrack(true); err != nil {
+		log.Fatal(err)
+	}
+
+	// Trickle local ICE to the server as it is gathered
+	tr := newTrickle(pc, path, func(b64 string) error { return sg.PostICE("offer", b64) })
+
+	// After the initial exchange either side can renegotiate through the
+	// signaler; the answerer is the polite peer
+	neg := newNegotiator(pc, tr, false, func(d webrtc.SessionDescription) error {
+		return sg.PostDescription("offer", d.Type.String(), path.SDP(d.SDP))
 	})
 
-	// Offer
+	// Drops after connecting restart ICE instead of ending the call
+	rc := newReconnector(c, sg, tr, neg, path, "offer")
+	defer rc.close()
+	pc.OnConnectionStateChange(rc.onState)
+	peerLeft := followPeer(sg, c, rc, "answer")
+
+	// Offer goes out immediately; candidates follow it
 	offer, err := pc.CreateOffer(nil)
 	if err != nil {
 		log.Fatal(err)
@@ -131,169 +205,179 @@ func RunAutoOfferSignaled(server, room, clientID string) {
 	if err := pc.SetLocalDescription(offer); err != nil {
 		log.Fatal(err)
 	}
-	<-webrtc.GatheringCompletePromise(pc)
-	if err := sg.PostOffer(pc.LocalDescription().SDP); err != nil {
+	if err := sg.PostOffer(path.SDP(pc.LocalDescription().SDP)); err != nil {
 		log.Fatal(err)
 	}
+	tr.localReady()
 
 	// Subscribe to ICE destined to offer
-	sseResp, err := sg.SubscribeICE("offer", func(cand string) {
-		var init webrtc.ICECandidateInit
-		if err := Decode(cand, &init); err == nil {
-			_ = pc.AddICECandidate(init)
-		}
-	})
-	if err != nil {
+	if err := rc.subscribe(); err != nil {
 		log.Fatal(err)
 	}
-	defer sseResp.Body.Close()
 
 	// Wait for answer
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-time.After(700 * time.Millisecond):
-			if sdp, ok, _ := sg.GetAnswer(); ok {
-				ans := webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: sdp}
-				if err := pc.SetRemoteDescription(ans); err != nil {
-					log.Fatal(err)
-				}
-				fmt.Println("✅ Remote answer set")
-				goto RUN
-			}
-		}
+	sdp, err := sg.WaitAnswer(ctx)
+	if err != nil {
+		return peerLeft()
+	}
+	ans := webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: sdp}
+	if err := pc.SetRemoteDescription(ans); err != nil {
+		log.Fatal(err)
 	}
+	tr.remoteReady()
+	neg.start()
+	go neg.receive(ctx, sg, "answer")
+	rc.armFallback()
+	fmt.Println("✅ Remote answer set")
 
-RUN:
 	<-ctx.Done()
+	c.hangup()
+	expired()
+	c.reportLatency()
+	return peerLeft()
 }
 
-func RunAutoAnswerSignaled(server, room, clientID string) {
-	if clientID == "" {
-		clientID = "answer-" + randID()
-	}
-
-	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+// answerSignaled runs a call as the answerer on sg, like offerSignaled
+func answerSignaled(ctx context.Context, sg sig.Signaler, opts CallOptions) bool {
+	ctx, stop := context.WithCancel(ctx)
 	defer stop()
 
-	sg := sig.New(strings.TrimRight(server, "/"), room, clientID)
-	role, err := sg.Join()
-	if err != nil {
-		log.Fatal("join:", err)
-	}
-	if role != "answer" {
-		log.Fatalf("room %s expects you as answer; server gave role %q. Start as -auto-o if you're first.", room, role)
-	}
-
 	ice, err := sg.FetchICEServers()
 	if err != nil || len(ice) == 0 {
 		ice = []webrtc.ICEServer{{URLs: []string{"stun:stun.l.google.com:19302"}}}
 	}
 
-	pc, err := CreatePeerConnectionWithFallback(ice)
+	pc, path, err := CreatePeerConnectionWithFallback(ice, opts.ICEPolicy)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer pc.Close()
 
-	pc.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
-		fmt.Printf("Connection state: %s\n", s.String())
-		if s == webrtc.PeerConnectionStateFailed ||
-			s == webrtc.PeerConnectionStateDisconnected ||
-			s == webrtc.PeerConnectionStateClosed {
-			stop()
-		}
-	})
+	c := newCall(ctx, stop, pc, opts)
+	// Viewers get a link of their own from each side
+	c.audience = newAudience(ctx, sg, ice, opts.ICEPolicy)
+	defer c.audience.close()
+	sg.OnSignal(c.audience.onSignal)
+	expired := endOnExpiry(sg, stop)
 
-	// When the caller's DC arrives, render and also send our video
+	// When the caller's DCs arrive, render and also send our video
+	defer c.stopInput()
 	pc.OnDataChannel(func(dc *webrtc.DataChannel) {
+		if c.handleDataChannel(dc) {
+			return
+		}
+
 		fmt.Println("✅ Data channel received")
+		qc := NewQualityController(pc, dc)
+		c.setQuality(qc)
 		dc.OnMessage(func(msg webrtc.DataChannelMessage) {
-			render.MoveCursorToTop()
-			fmt.Print(string(msg.Data))
+			c.showFrame(msg.Data, false)
 		})
 		dc.OnOpen(func() {
+			if opts.SendFile != "" {
+				return
+			}
 			fmt.Println("✅ DC opened (answer). Sending...")
 			render.HideCursor()
 			render.ClearTerminal()
-
-			webcam, _ := capture.OpenWebCam()
-			defer webcam.Close()
-
-			webcam.SetProperty(gocv.VideoCaptureFPS, 10)
-			webcam.SetProperty(gocv.VideoCaptureFrameWidth, 640)
-			webcam.SetProperty(gocv.VideoCaptureFrameHeight, 480)
-
-			t := time.NewTicker(100 * time.Millisecond)
-			defer t.Stop()
-			for {
-				select {
-				case <-ctx.Done():
-					return
-				case <-t.C:
-					frame, err := webcam.ReadFrame()
-					if err != nil {
-						continue
-					}
-					ascii := render.ConvertFrameToASCII(frame)
-					frame.Close()
-					_ = dc.SendText(ascii)
-				}
-			}
+			c.startVideo(dc, qc)
 		})
 	})
 
-	// Send local ICE to server
-	pc.OnICECandidate(func(c *webrtc.ICECandidate) {
-		if c == nil {
-			return
-		}
-		b64, _ := Encode(c.ToJSON())
-		_ = sg.PostICE("answer", b64)
-	})
+	// Add our media tracks before the offer arrives so they are matched to
+	// the offer's m-lines
+	if err := c.setupAudio(false); err != nil {
+		log.Fatal(err)
+	}
+	if err := c.setupVideoTrack(false); err != nil {
+		log.Fatal(err)
+	}
 
-	// Subscribe to ICE destined to answer (from offerer)
-	sseResp, err := sg.SubscribeICE("answer", func(cand string) {
-		var init webrtc.ICECandidateInit
-		if err := Decode(cand, &init); err == nil {
-			_ = pc.AddICECandidate(init)
-		}
+	// Trickle local ICE to the server as it is gathered
+	tr := newTrickle(pc, path, func(b64 string) error { return sg.PostICE("answer", b64) })
+
+	// After the initial exchange either side can renegotiate through the
+	// signaler; the answerer is the polite peer
+	neg := newNegotiator(pc, tr, true, func(d webrtc.SessionDescription) error {
+		return sg.PostDescription("answer", d.Type.String(), path.SDP(d.SDP))
 	})
-	if err != nil {
+
+	// Drops after connecting restart ICE instead of ending the call
+	rc := newReconnector(c, sg, tr, neg, path, "answer")
+	defer rc.close()
+	pc.OnConnectionStateChange(rc.onState)
+	peerLeft := followPeer(sg, c, rc, "offer")
+
+	// Subscribe to ICE destined to answer (from offerer); candidates that
+	// arrive before the offer are held until it is set
+	if err := rc.subscribe(); err != nil {
 		log.Fatal(err)
 	}
-	defer sseResp.Body.Close()
 
 	// Wait for offer, then answer
-	for {
+	sdp, err := sg.WaitOffer(ctx)
+	if err != nil {
+		return peerLeft()
+	}
+	off := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: sdp}
+	if err := pc.SetRemoteDescription(off); err != nil {
+		log.Fatal(err)
+	}
+	tr.remoteReady()
+	declineSendless(pc)
+
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := pc.SetLocalDescription(answer); err != nil {
+		log.Fatal(err)
+	}
+	if err := sg.PostAnswer(path.SDP(pc.LocalDescription().SDP)); err != nil {
+		log.Fatal(err)
+	}
+	tr.localReady()
+	neg.start()
+	go neg.receive(ctx, sg, "offer")
+	rc.armFallback()
+	fmt.Println("✅ Posted answer")
+
+	<-ctx.Done()
+	c.hangup()
+	expired()
+	c.reportLatency()
+	return peerLeft()
+}
+
+// endOnExpiry ends the call, or mesh room, through stop if we lose our
+// place in the room; the returned func says so once it is over
+func endOnExpiry(sg sig.Signaler, stop func()) func() {
+	lost := make(chan error, 1)
+	sg.OnExpired(func(err error) {
+		lost <- err
+		stop()
+	})
+	return func() {
 		select {
-		case <-ctx.Done():
-			return
-		case <-time.After(700 * time.Millisecond):
-			if sdp, ok, _ := sg.GetOffer(); ok {
-				off := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: sdp}
-				if err := pc.SetRemoteDescription(off); err != nil {
-					log.Fatal(err)
-				}
-
-				answer, err := pc.CreateAnswer(nil)
-				if err != nil {
-					log.Fatal(err)
-				}
-				if err := pc.SetLocalDescription(answer); err != nil {
-					log.Fatal(err)
-				}
-				<-webrtc.GatheringCompletePromise(pc)
-				if err := sg.PostAnswer(pc.LocalDescription().SDP); err != nil {
-					log.Fatal(err)
-				}
-				fmt.Println("✅ Posted answer")
-				goto RUN
-			}
+		case err := <-lost:
+			fmt.Println("❌", err)
+		default:
 		}
 	}
+}
 
-RUN:
-	<-ctx.Done()
+// followPeer shows who comes and goes, links viewers, and ends the call if
+// the peer (of role peer) leaves before the call has connected; the
+// returned func reports whether it did
+func followPeer(sg sig.Signaler, c *call, rc *reconnector, peer string) func() bool {
+	var left atomic.Bool
+	sg.OnPresence(func(clientID, role, event string) {
+		c.onPresence(clientID, role, event)
+		c.audience.onPresence(clientID, role, event)
+		if role == peer && event == "left" && !rc.wasConnected() {
+			left.Store(true)
+			c.stop()
+		}
+	})
+	return left.Load
 }
@@ -0,0 +1,392 @@
+package webrtc
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/saswatsam786/snapshell/internal/audio"
+	"github.com/saswatsam786/snapshell/internal/render"
+	sig "github.com/saswatsam786/snapshell/internal/signal"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// controlPingInterval is how often the control channel RTT is probed
+const controlPingInterval = 5 * time.Second
+
+// CallOptions changes what a signaled call sends
+type CallOptions struct {
+	// SendFile, when set, offers this file to the peer once connected and
+	// hangs up after the transfer. No webcam is opened and frames from the
+	// peer are not drawn.
+	SendFile string
+
+	// Audio is "mic" for the default capture device or a .wav/.ogg/.opus
+	// file to send as an Opus track; empty sends no audio. Audio from the
+	// peer is played either way.
+	Audio string
+
+	// VideoTrack sends the webcam as a VP8 track instead of ASCII text so
+	// the receiver renders it itself (and browsers can join)
+	VideoTrack bool
+
+	// Color and Charset control how we render video tracks we receive
+	Color   render.ColorMode
+	Charset string
+
+	// ICEPolicy picks relay-only, all candidates, or relay first with a
+	// fallback to all (the default)
+	ICEPolicy ICEPolicy
+
+	// Credentials admit us to a room with a password: the password or an
+	// invite token
+	Credentials sig.Credentials
+}
+
+// call holds the per-call state shared by the offer and answer flows
+type call struct {
+	ctx  context.Context
+	stop context.CancelFunc
+	pc   *webrtc.PeerConnection
+	opts CallOptions
+
+	mu         sync.Mutex
+	ctrl       *ControlChannel
+	qc         *QualityController
+	remote     Hello
+	remoteMute MuteState
+	localMute  MuteState
+	ctrlRTT    time.Duration
+
+	// clock and latency measure how old the peer's frames are on screen
+	clock   clockSync
+	latency latencyStats
+
+	chat     *Chat
+	input    *render.LineEditor
+	restore  func() // restores the terminal after input mode
+	notice   string
+	noticeAt time.Time
+
+	// reconnecting is when the connection dropped, zero while it is up
+	reconnecting time.Time
+
+	videoTrack  *webrtc.TrackLocalStaticSample
+	player      *audio.Player
+	remoteMeter *audio.Meter
+	localMeter  *audio.Meter
+	vizOnce     sync.Once
+
+	// audience links the viewers of a signaled call; nil otherwise
+	audience *audience
+
+	transfers    []*Transfer
+	pendingFiles []*incomingFile
+
+	// drawMu serialises frame and overlay output so escape sequences from
+	// different goroutines do not interleave
+	drawMu sync.Mutex
+
+	keyframe chan struct{}
+
+	// started is when the PeerConnection was created; firstFrame reports
+	// the time to the first frame from the peer once and sets drawing
+	started    time.Time
+	firstFrame sync.Once
+	drawing    bool
+}
+
+func newCall(ctx context.Context, stop context.CancelFunc, pc *webrtc.PeerConnection, opts CallOptions) *call {
+	c := &call{ctx: ctx, stop: stop, pc: pc, opts: opts, keyframe: make(chan struct{}, 1), started: time.Now()}
+	pc.OnTrack(c.onTrack)
+	return c
+}
+
+// onTrack plays or draws media tracks sent by the peer
+func (c *call) onTrack(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+	switch track.Codec().MimeType {
+	case webrtc.MimeTypeOpus:
+		c.playAudio(track)
+	case webrtc.MimeTypeVP8:
+		c.renderVideoTrack(track)
+	default:
+		debugLog.Printf("ignoring %s track", track.Codec().MimeType)
+	}
+}
+
+// startVideo begins sending our webcam once the ASCII channel is open,
+// either as text frames on dc or on the VP8 track
+func (c *call) startVideo(dc *webrtc.DataChannel, qc *QualityController) {
+	c.mu.Lock()
+	track := c.videoTrack
+	c.mu.Unlock()
+	if track != nil {
+		c.streamVideoTrack(track)
+		return
+	}
+	c.streamWebcam(dc, qc)
+}
+
+// handleDataChannel takes over the non-video channels opened by the peer
+// and reports whether dc was one of them
+func (c *call) handleDataChannel(dc *webrtc.DataChannel) bool {
+	switch {
+	case dc.Label() == ControlLabel:
+		c.setControl(AttachControlChannel(dc))
+	case dc.Label() == ChatLabel:
+		c.setChat(AttachChat(dc))
+	case strings.HasPrefix(dc.Label(), fileLabelPrefix):
+		c.receiveFile(dc)
+	default:
+		return false
+	}
+	return true
+}
+
+// setQuality records the controller for the outgoing ASCII stream
+func (c *call) setQuality(qc *QualityController) {
+	c.mu.Lock()
+	c.qc = qc
+	c.mu.Unlock()
+}
+
+// setControl wires the control channel into the call: it tracks the peer's
+// state, hangs up on bye and feeds viewport/keyframe requests to the sender
+func (c *call) setControl(ctrl *ControlChannel) {
+	c.mu.Lock()
+	c.ctrl = ctrl
+	c.mu.Unlock()
+
+	ctrl.On(ControlHello, func(m ControlMessage) {
+		if m.Hello == nil {
+			return
+		}
+		c.mu.Lock()
+		c.remote = *m.Hello
+		c.mu.Unlock()
+		debugLog.Printf("control: peer hello v%d caps=%v", m.Hello.Version, m.Hello.Capabilities)
+	})
+	ctrl.On(ControlViewport, func(m ControlMessage) {
+		if qc := c.quality(); qc != nil && m.Viewport != nil {
+			qc.SetViewport(m.Viewport.Width, m.Viewport.Height)
+		}
+		c.requestKeyframe()
+	})
+	ctrl.On(ControlMute, func(m ControlMessage) {
+		if m.Mute == nil {
+			return
+		}
+		c.mu.Lock()
+		c.remoteMute = *m.Mute
+		c.mu.Unlock()
+	})
+	ctrl.On(ControlKeyframe, func(ControlMessage) {
+		c.requestKeyframe()
+	})
+	ctrl.On(ControlPong, func(m ControlMessage) {
+		if m.Ping == nil {
+			return
+		}
+		now := time.Now()
+		c.clock.add(*m.Ping, now)
+		c.mu.Lock()
+		c.ctrlRTT = now.Sub(time.Unix(0, m.Ping.Sent))
+		c.mu.Unlock()
+	})
+	ctrl.On(ControlBye, func(m ControlMessage) {
+		reason := ""
+		if m.Bye != nil {
+			reason = m.Bye.Reason
+		}
+		fmt.Printf("\n👋 Peer hung up %s\n", reason)
+		c.stop()
+	})
+	ctrl.OnOpen(func() {
+		c.sendViewport()
+		go c.pingLoop(ctrl)
+		if c.opts.SendFile != "" {
+			go c.sendAndHangUp(c.opts.SendFile)
+		}
+	})
+}
+
+// sendViewport tells the peer how much room we have for its video, leaving
+// space for the audio visualizer when it is shown
+func (c *call) sendViewport() {
+	ctrl := c.control()
+	if ctrl == nil {
+		return
+	}
+	q := c.renderQuality()
+	_ = ctrl.SendViewport(q.Width, q.Height)
+}
+
+// pingLoop probes the control channel RTT, which also keeps the clock
+// offset estimate current. The first pings go out at once so frames get a
+// latency soon after the call starts.
+func (c *call) pingLoop(ctrl *ControlChannel) {
+	for i := 0; i < 3; i++ {
+		_ = ctrl.SendPing()
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+	t := time.NewTicker(controlPingInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-t.C:
+			_ = ctrl.SendPing()
+		}
+	}
+}
+
+// peerHas reports whether the peer advertised capability name
+func (c *call) peerHas(name string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.remote.Has(name)
+}
+
+// frameShown records the glass-to-glass latency of a frame from the peer
+// captured at its clock's captured and displayed now
+func (c *call) frameShown(captured time.Time) {
+	offset, ok := c.clock.offset()
+	if !ok {
+		return
+	}
+	c.latency.add(time.Since(captured.Add(-offset)))
+}
+
+// reportLatency prints the call's glass-to-glass latency percentiles
+func (c *call) reportLatency() {
+	if r := c.latency.report(); r != "" {
+		fmt.Println(r)
+		debugLog.Print(r)
+	}
+}
+
+func (c *call) quality() *QualityController {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.qc
+}
+
+func (c *call) control() *ControlChannel {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ctrl
+}
+
+// setChat wires the chat channel into the call; the input line starts once
+// it opens
+func (c *call) setChat(chat *Chat) {
+	c.mu.Lock()
+	c.chat = chat
+	c.mu.Unlock()
+
+	chat.OnMessage(func(ChatEntry) { c.redrawOverlay() })
+	chat.OnOpen(c.startInput)
+}
+
+func (c *call) requestKeyframe() {
+	select {
+	case c.keyframe <- struct{}{}:
+	default:
+	}
+}
+
+// setVideoMuted turns our camera on or off and tells the peer
+func (c *call) setVideoMuted(muted bool) {
+	c.mu.Lock()
+	c.localMute.Video = muted
+	s := c.localMute
+	c.mu.Unlock()
+	if ctrl := c.control(); ctrl != nil {
+		_ = ctrl.SendMute(s)
+	}
+}
+
+func (c *call) videoMuted() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.localMute.Video
+}
+
+// hangup tells the peer we are leaving so it does not wait for ICE to time out
+func (c *call) hangup() {
+	if ctrl := c.control(); ctrl != nil {
+		if ctrl.SendBye("left the call") == nil {
+			// Give SCTP a moment to flush before the PeerConnection is closed
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+}
+
+// onPresence reports other members joining or leaving the room
+func (c *call) onPresence(_, role, event string) {
+	debugLog.Printf("presence: %s %s", role, event)
+	text := fmt.Sprintf("👥 %s %s the room", role, event)
+	c.mu.Lock()
+	drawing := c.drawing
+	c.mu.Unlock()
+	if !drawing {
+		fmt.Println(text)
+		return
+	}
+	c.notify(text)
+}
+
+// setReconnecting shows or hides the reconnecting banner
+func (c *call) setReconnecting(on bool) {
+	c.mu.Lock()
+	if on {
+		c.reconnecting = time.Now()
+	} else {
+		c.reconnecting = time.Time{}
+	}
+	c.mu.Unlock()
+	c.redrawOverlay()
+}
+
+// status summarises the call state for the status bar
+func (c *call) status() string {
+	status := ""
+	if c.opts.VideoTrack {
+		status = fmt.Sprintf("VP8 %dx%d@%d %dkbps", trackWidth, trackHeight, trackFPS, trackBitrateKbps)
+	} else if qc := c.quality(); qc != nil {
+		status = qc.Status()
+	}
+	status += c.speakingStatus()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ctrlRTT > 0 {
+		status += fmt.Sprintf(" | ctl %dms", c.ctrlRTT.Milliseconds())
+	}
+	if g2g := c.latency.live(); g2g != "" {
+		status += " | " + g2g
+	}
+	if c.remoteMute.Video {
+		status += " | 📷 peer camera off"
+	}
+	if c.localMute.Video {
+		status += " | your camera off"
+	}
+	if c.remoteMute.Audio {
+		status += " | 🔇 peer mic muted"
+	}
+	if c.localMute.Audio {
+		status += " | your mic muted"
+	}
+	if c.player != nil && c.player.Muted() {
+		status += " | speaker off"
+	}
+	return status
+}
@@ -0,0 +1,110 @@
+package webrtc
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// ChatLabel is the label of the data channel carrying text chat
+const ChatLabel = "chat"
+
+// ChatMessage is the wire format of one chat line
+type ChatMessage struct {
+	Text string `json:"text"`
+	Sent int64  `json:"sent"` // sender's clock, unix milliseconds
+}
+
+// ChatEntry is a chat line in the local history
+type ChatEntry struct {
+	Local bool // sent by us
+	Text  string
+	At    time.Time
+}
+
+// Format renders the entry as "[15:04:05] you: text"
+func (e ChatEntry) Format() string {
+	who := "peer"
+	if e.Local {
+		who = "you"
+	}
+	return "[" + e.At.Format("15:04:05") + "] " + who + ": " + e.Text
+}
+
+// Chat sends and receives chat messages and keeps the call's history
+type Chat struct {
+	dc *webrtc.DataChannel
+
+	mu        sync.Mutex
+	history   []ChatEntry
+	onMessage func(ChatEntry)
+}
+
+// NewChat creates the chat data channel on pc (offer side)
+func NewChat(pc *webrtc.PeerConnection) (*Chat, error) {
+	dc, err := pc.CreateDataChannel(ChatLabel, nil)
+	if err != nil {
+		return nil, err
+	}
+	return AttachChat(dc), nil
+}
+
+// AttachChat wraps a chat data channel received from the peer (answer side)
+func AttachChat(dc *webrtc.DataChannel) *Chat {
+	c := &Chat{dc: dc}
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		var m ChatMessage
+		if err := json.Unmarshal(msg.Data, &m); err != nil || m.Text == "" {
+			return
+		}
+		// Show the local receive time; the peer's clock may be off
+		c.add(ChatEntry{Text: m.Text, At: time.Now()})
+	})
+	return c
+}
+
+// OnOpen registers f to be called once the channel can send
+func (c *Chat) OnOpen(f func()) {
+	c.dc.OnOpen(f)
+}
+
+// OnMessage registers f to be called for every entry added to the history,
+// both sent and received
+func (c *Chat) OnMessage(f func(ChatEntry)) {
+	c.mu.Lock()
+	c.onMessage = f
+	c.mu.Unlock()
+}
+
+// Send sends text to the peer and records it in the history
+func (c *Chat) Send(text string) error {
+	now := time.Now()
+	b, err := json.Marshal(ChatMessage{Text: text, Sent: now.UnixMilli()})
+	if err != nil {
+		return err
+	}
+	if err := c.dc.Send(b); err != nil {
+		return err
+	}
+	c.add(ChatEntry{Local: true, Text: text, At: now})
+	return nil
+}
+
+// History returns a copy of all messages exchanged in this call
+func (c *Chat) History() []ChatEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]ChatEntry(nil), c.history...)
+}
+
+func (c *Chat) add(e ChatEntry) {
+	c.mu.Lock()
+	c.history = append(c.history, e)
+	f := c.onMessage
+	c.mu.Unlock()
+	if f != nil {
+		f(e)
+	}
+}
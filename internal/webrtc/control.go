@@ -0,0 +1,211 @@
+package webrtc
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// ControlLabel is the label of the reliable, ordered data channel that
+// carries ControlMessages alongside the "ascii" frame channel
+const ControlLabel = "control"
+
+// ControlVersion is sent in Hello so peers can detect incompatible builds
+const ControlVersion = 1
+
+// ControlType identifies the kind of a ControlMessage
+type ControlType string
+
+const (
+	ControlHello    ControlType = "hello"    // capabilities, sent once on open
+	ControlViewport ControlType = "viewport" // receiver's render area changed
+	ControlMute     ControlType = "mute"     // sender turned camera/mic on or off
+	ControlBye      ControlType = "bye"      // peer is hanging up
+	ControlKeyframe ControlType = "keyframe" // receiver wants a full frame now
+	ControlPing     ControlType = "ping"
+	ControlPong     ControlType = "pong"
+)
+
+// Capabilities advertised in Hello by this build
+var localCapabilities = []string{"ascii", "color", "viewport", "keyframe", "timestamps"}
+
+// ControlMessage is the envelope sent on the control channel. Only the
+// payload field matching Type is set.
+type ControlMessage struct {
+	Type     ControlType `json:"type"`
+	Hello    *Hello      `json:"hello,omitempty"`
+	Viewport *Viewport   `json:"viewport,omitempty"`
+	Mute     *MuteState  `json:"mute,omitempty"`
+	Bye      *Bye        `json:"bye,omitempty"`
+	Ping     *Ping       `json:"ping,omitempty"` // used by ping and pong
+}
+
+type Hello struct {
+	Version      int      `json:"version"`
+	Capabilities []string `json:"capabilities"`
+}
+
+// Has reports whether the peer advertised capability name
+func (h Hello) Has(name string) bool {
+	for _, c := range h.Capabilities {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+type Viewport struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+type MuteState struct {
+	Video bool `json:"video"`
+	Audio bool `json:"audio"`
+}
+
+type Bye struct {
+	Reason string `json:"reason,omitempty"`
+}
+
+// Ping is echoed back in the matching pong, with Echoed set to the
+// replying peer's clock for clock offset estimation
+type Ping struct {
+	Seq    uint32 `json:"seq"`
+	Sent   int64  `json:"sent"`             // sender's clock, unix nanoseconds
+	Echoed int64  `json:"echoed,omitempty"` // replier's clock, unix nanoseconds
+}
+
+// ControlHandler is called for each received message of a subscribed type
+type ControlHandler func(ControlMessage)
+
+// ControlChannel sends and dispatches typed control messages. Handlers run
+// on the data channel's read goroutine and should not block.
+type ControlChannel struct {
+	dc *webrtc.DataChannel
+
+	mu       sync.Mutex
+	handlers map[ControlType]map[int]ControlHandler
+	nextID   int
+	pingSeq  uint32
+}
+
+// NewControlChannel creates the control data channel on pc (offer side)
+func NewControlChannel(pc *webrtc.PeerConnection) (*ControlChannel, error) {
+	dc, err := pc.CreateDataChannel(ControlLabel, nil)
+	if err != nil {
+		return nil, err
+	}
+	return AttachControlChannel(dc), nil
+}
+
+// AttachControlChannel wraps a control data channel received from the peer
+// (answer side). A hello is sent automatically once the channel opens and
+// pings are answered without any subscriber.
+func AttachControlChannel(dc *webrtc.DataChannel) *ControlChannel {
+	c := &ControlChannel{
+		dc:       dc,
+		handlers: map[ControlType]map[int]ControlHandler{},
+	}
+	dc.OnOpen(func() {
+		_ = c.Send(ControlMessage{Type: ControlHello, Hello: &Hello{
+			Version:      ControlVersion,
+			Capabilities: localCapabilities,
+		}})
+		c.dispatch(ControlMessage{Type: controlOpen})
+	})
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		var m ControlMessage
+		if err := json.Unmarshal(msg.Data, &m); err != nil {
+			debugLog.Printf("control: bad message: %v", err)
+			return
+		}
+		if m.Type == ControlPing && m.Ping != nil {
+			pong := *m.Ping
+			pong.Echoed = time.Now().UnixNano()
+			_ = c.Send(ControlMessage{Type: ControlPong, Ping: &pong})
+		}
+		c.dispatch(m)
+	})
+	return c
+}
+
+// controlOpen is a local pseudo-type dispatched when the channel opens
+const controlOpen ControlType = "open"
+
+// OnOpen subscribes to the channel becoming ready to send
+func (c *ControlChannel) OnOpen(f func()) func() {
+	return c.On(controlOpen, func(ControlMessage) { f() })
+}
+
+// On subscribes h to messages of type t and returns a function that removes
+// the subscription
+func (c *ControlChannel) On(t ControlType, h ControlHandler) func() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.handlers[t] == nil {
+		c.handlers[t] = map[int]ControlHandler{}
+	}
+	id := c.nextID
+	c.nextID++
+	c.handlers[t][id] = h
+	return func() {
+		c.mu.Lock()
+		delete(c.handlers[t], id)
+		c.mu.Unlock()
+	}
+}
+
+func (c *ControlChannel) dispatch(m ControlMessage) {
+	c.mu.Lock()
+	hs := make([]ControlHandler, 0, len(c.handlers[m.Type]))
+	for _, h := range c.handlers[m.Type] {
+		hs = append(hs, h)
+	}
+	c.mu.Unlock()
+	for _, h := range hs {
+		h(m)
+	}
+}
+
+// Send marshals m and sends it to the peer
+func (c *ControlChannel) Send(m ControlMessage) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return c.dc.Send(b)
+}
+
+// SendViewport tells the peer how large our render area is
+func (c *ControlChannel) SendViewport(width, height int) error {
+	return c.Send(ControlMessage{Type: ControlViewport, Viewport: &Viewport{Width: width, Height: height}})
+}
+
+// SendMute tells the peer which of our sources are switched off
+func (c *ControlChannel) SendMute(s MuteState) error {
+	return c.Send(ControlMessage{Type: ControlMute, Mute: &s})
+}
+
+// SendBye tells the peer we are hanging up
+func (c *ControlChannel) SendBye(reason string) error {
+	return c.Send(ControlMessage{Type: ControlBye, Bye: &Bye{Reason: reason}})
+}
+
+// RequestKeyframe asks the peer to send a full frame as soon as possible
+func (c *ControlChannel) RequestKeyframe() error {
+	return c.Send(ControlMessage{Type: ControlKeyframe})
+}
+
+// SendPing sends a ping stamped with the local clock; the peer echoes it
+// back as a pong
+func (c *ControlChannel) SendPing() error {
+	c.mu.Lock()
+	c.pingSeq++
+	seq := c.pingSeq
+	c.mu.Unlock()
+	return c.Send(ControlMessage{Type: ControlPing, Ping: &Ping{Seq: seq, Sent: time.Now().UnixNano()}})
+}
@@ -0,0 +1,15 @@
+package webrtc
+
+import (
+	"io"
+	"log"
+)
+
+// debugLog receives diagnostic output that would otherwise corrupt the
+// ASCII video on screen. It is discarded unless SetDebugLog is called.
+var debugLog = log.New(io.Discard, "", log.LstdFlags|log.Lmicroseconds)
+
+// SetDebugLog directs debug output (quality decisions, stats) to w
+func SetDebugLog(w io.Writer) {
+	debugLog.SetOutput(w)
+}
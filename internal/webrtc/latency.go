@@ -0,0 +1,141 @@
+package webrtc
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// clockSamples is how many recent ping exchanges the offset estimate
+	// picks from
+	clockSamples = 8
+	// latencyWindow is how many recent frames the live percentiles cover
+	latencyWindow = 300
+)
+
+// Frames sent to peers that advertise "timestamps" start with their capture
+// time, e.g. "\x1b_t1712345678901234567\x1b\\". It is an APC escape
+// sequence, which terminals ignore should one ever be printed.
+const (
+	stampPrefix = "\x1b_t"
+	stampSuffix = "\x1b\\"
+)
+
+// stampFrame prefixes an ASCII frame with its capture time
+func stampFrame(ascii string, captured time.Time) string {
+	return stampPrefix + strconv.FormatInt(captured.UnixNano(), 10) + stampSuffix + ascii
+}
+
+// unstampFrame splits a received frame into its capture time (on the
+// sender's clock) and the frame itself; ok is false for unstamped frames
+func unstampFrame(data []byte) (captured time.Time, frame []byte, ok bool) {
+	if !bytes.HasPrefix(data, []byte(stampPrefix)) {
+		return time.Time{}, data, false
+	}
+	end := bytes.Index(data, []byte(stampSuffix))
+	if end < 0 {
+		return time.Time{}, data, false
+	}
+	ns, err := strconv.ParseInt(string(data[len(stampPrefix):end]), 10, 64)
+	if err != nil {
+		return time.Time{}, data, false
+	}
+	return time.Unix(0, ns), data[end+len(stampSuffix):], true
+}
+
+// clockSync estimates how far the peer's clock is ahead of ours from
+// ping/pong exchanges, the way NTP does: with t1 our send time, t2 the
+// peer's reply time and t4 our receive time, offset = t2 - (t1+t4)/2. The
+// error is at most half the round trip, so the sample with the shortest
+// round trip of the last few wins.
+type clockSync struct {
+	mu      sync.Mutex
+	samples []clockSample
+}
+
+type clockSample struct {
+	rtt, offset time.Duration
+}
+
+// add records a pong received at recv; pongs from peers that do not echo
+// their clock are ignored
+func (s *clockSync) add(p Ping, recv time.Time) {
+	if p.Echoed == 0 {
+		return
+	}
+	t1, t2, t4 := p.Sent, p.Echoed, recv.UnixNano()
+	sample := clockSample{rtt: time.Duration(t4 - t1), offset: time.Duration(t2 - (t1+t4)/2)}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.samples = append(s.samples, sample)
+	if len(s.samples) > clockSamples {
+		s.samples = s.samples[1:]
+	}
+}
+
+// offset returns the current estimate, or false before the first sample
+func (s *clockSync) offset() (time.Duration, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.samples) == 0 {
+		return 0, false
+	}
+	best := s.samples[0]
+	for _, x := range s.samples[1:] {
+		if x.rtt < best.rtt {
+			best = x
+		}
+	}
+	return best.offset, true
+}
+
+// latencyStats collects capture→display (glass-to-glass) latencies of the
+// peer's frames
+type latencyStats struct {
+	mu     sync.Mutex
+	all    []time.Duration
+	recent []time.Duration // the last latencyWindow frames
+}
+
+func (l *latencyStats) add(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.all = append(l.all, d)
+	l.recent = append(l.recent, d)
+	if len(l.recent) > latencyWindow {
+		l.recent = l.recent[1:]
+	}
+}
+
+func sorted(ds []time.Duration) []time.Duration {
+	out := append([]time.Duration(nil), ds...)
+	sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+	return out
+}
+
+// live summarises the recent frames for the status bar
+func (l *latencyStats) live() string {
+	l.mu.Lock()
+	recent := sorted(l.recent)
+	l.mu.Unlock()
+	if len(recent) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("g2g p50 %dms p95 %dms", percentile(recent, 50).Milliseconds(), percentile(recent, 95).Milliseconds())
+}
+
+// report summarises the whole call
+func (l *latencyStats) report() string {
+	l.mu.Lock()
+	all := sorted(l.all)
+	l.mu.Unlock()
+	if len(all) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("📊 Glass-to-glass latency over %d frames: p50 %s  p90 %s  p95 %s  p99 %s  max %s",
+		len(all), percentile(all, 50), percentile(all, 90), percentile(all, 95), percentile(all, 99), percentile(all, 100))
+}
@@ -0,0 +1,758 @@
+package webrtc
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/saswatsam786/snapshell/internal/capture"
+	"github.com/saswatsam786/snapshell/internal/render"
+	sig "github.com/saswatsam786/snapshell/internal/signal"
+
+	"github.com/pion/webrtc/v4"
+	"gocv.io/x/gocv"
+)
+
+// meshFrameInterval is how often the webcam is read and the grid redrawn;
+// each link sends at its own quality controller's rate within that
+const meshFrameInterval = 100 * time.Millisecond
+
+// mesh is one member of a mesh room. It keeps a PeerConnection to every
+// other peer, sends each of them the webcam sized for the tile it gets on
+// their screen, and draws everyone (us included) as a grid. When the room
+// has the signaler's SFU it keeps a single connection, to the SFU, which
+// forwards everyone's frames.
+type mesh struct {
+	ctx  context.Context
+	stop context.CancelFunc
+	sg   sig.Signaler
+	me   string
+	room string
+	ice  []webrtc.ICEServer
+	opts CallOptions
+	// viewer: we only watch, with no webcam and no tile of our own
+	viewer bool
+
+	mu      sync.Mutex
+	links   map[string]*meshLink
+	sfu     bool              // the room has an SFU and links holds only it
+	order   []string          // peers in the order we learned of them, for a stable grid
+	frames  map[string]string // each peer's latest frame
+	self    string            // our latest frame
+	viewers map[string]bool   // who watches, linked unless through the SFU
+	dirty   bool
+	notice  string
+
+	drawMu sync.Mutex
+}
+
+// meshLink is the connection to one other peer
+type meshLink struct {
+	id   string
+	pc   *webrtc.PeerConnection
+	tr   *trickle
+	ctx  context.Context // ends when the link closes
+	stop context.CancelFunc
+
+	mu     sync.Mutex
+	state  string
+	ascii  *webrtc.DataChannel // once open
+	qc     *QualityController
+	ctrl   *ControlChannel
+	sent   time.Time
+	remote Hello
+}
+
+// RunMesh joins room as one of several peers. Every pair of peers connects
+// directly, the signaler relaying their offers, answers and candidates, or
+// every peer connects to the signaler's SFU if it runs one.
+func RunMesh(server, room, clientID string, opts CallOptions) {
+	if clientID == "" {
+		clientID = "peer-" + randID()
+	}
+	runMesh(server, room, clientID, sig.RolePeer, opts)
+}
+
+// RunWatch joins room as a viewer: it shows the peers' grid, or the two
+// sides of a call, and sends nothing. Every peer links to each viewer,
+// unless the signaler runs an SFU, which then sends the viewer everything.
+func RunWatch(server, room, clientID string, opts CallOptions) {
+	if clientID == "" {
+		clientID = "viewer-" + randID()
+	}
+	runMesh(server, room, clientID, sig.RoleViewer, opts)
+}
+
+func runMesh(server, room, clientID, want string, opts CallOptions) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	sg := sig.Connect(strings.TrimRight(server, "/"), room, clientID, opts.Credentials)
+	defer sg.Close()
+
+	ice, err := sg.FetchICEServers()
+	if err != nil || len(ice) == 0 {
+		ice = []webrtc.ICEServer{{URLs: []string{"stun:stun.l.google.com:19302"}}}
+	}
+	// a mesh link has no renegotiation to fall back with
+	if opts.ICEPolicy != ICEPolicyRelay {
+		opts.ICEPolicy = ICEPolicyAll
+	}
+
+	m := &mesh{ctx: ctx, stop: stop, sg: sg, me: clientID, room: room, ice: ice, opts: opts,
+		viewer: want == sig.RoleViewer,
+		links:  map[string]*meshLink{}, frames: map[string]string{}, viewers: map[string]bool{}}
+
+	// handlers first: the members and signals already there are replayed on join
+	sg.OnPresence(m.onPresence)
+	sg.OnSignal(m.onSignal)
+	expired := endOnExpiry(sg, stop)
+	role, err := sg.JoinAs(want)
+	if err != nil {
+		log.Fatal("join:", err)
+	}
+	if role != want {
+		log.Fatalf("the signaling server does not support mesh rooms (it gave role %q)", role)
+	}
+	defer sg.Leave()
+	if m.viewer {
+		fmt.Printf("✅ Watching room %s as %s\n", room, clientID)
+	} else {
+		fmt.Printf("✅ Joined mesh room %s as %s\n", room, clientID)
+	}
+
+	render.HideCursor()
+	render.ClearTerminal()
+	defer render.ShowCursor()
+
+	if !m.viewer {
+		go m.captureLoop()
+	}
+	go m.drawLoop()
+
+	<-ctx.Done()
+	m.hangup()
+	render.ClearTerminal()
+	expired()
+}
+
+// onPresence connects to peers as they join and drops them as they leave.
+// Of each pair, the peer sig.MeshOfferer picks sends the offer; peers, and
+// the sides of a two-person call, offer to viewers. The SFU is announced before any peer; with it, peers only get
+// a tile.
+func (m *mesh) onPresence(clientID, role, event string) {
+	if role == sig.RoleSFU {
+		m.onSFU(event)
+		return
+	}
+	if clientID == m.me {
+		return
+	}
+	if role == sig.RoleViewer {
+		m.onViewer(clientID, event)
+		return
+	}
+	if role != sig.RolePeer {
+		// the sides of a two-person call offer to viewers too
+		if m.viewer && event == "left" {
+			m.drop(clientID, "left")
+		}
+		return
+	}
+	switch event {
+	case "joined":
+		m.mu.Lock()
+		m.addLocked(clientID)
+		offer := !m.sfu && !m.viewer && sig.MeshOfferer(m.me, clientID) == m.me
+		m.mu.Unlock()
+		if offer {
+			if err := m.offer(clientID); err != nil {
+				debugLog.Printf("mesh: offer %s: %v", clientID, err)
+				m.drop(clientID, "could not be reached")
+			}
+		}
+		m.layoutChanged()
+		m.setNotice(clientID + " joined")
+	case "left":
+		m.drop(clientID, "left")
+	}
+}
+
+// onViewer links a peer to a viewer, unless the SFU does that
+func (m *mesh) onViewer(clientID, event string) {
+	m.mu.Lock()
+	link := !m.sfu && !m.viewer
+	if event == "joined" {
+		m.viewers[clientID] = true
+	} else {
+		delete(m.viewers, clientID)
+	}
+	m.dirty = true
+	m.mu.Unlock()
+	switch {
+	case event == "left":
+		m.drop(clientID, "stopped watching")
+	case link:
+		if err := m.offer(clientID); err != nil {
+			debugLog.Printf("mesh: offer %s: %v", clientID, err)
+			m.drop(clientID, "could not be reached")
+		}
+	}
+}
+
+// onSFU switches to sending everything through the SFU once it is in the
+// room, closing any direct links. If the SFU announces itself while we have
+// no link to it (it restarted, or dropped us), we offer again.
+func (m *mesh) onSFU(event string) {
+	if event != "joined" {
+		m.drop(sig.SFUID, "left")
+		return
+	}
+	m.mu.Lock()
+	if m.sfu && m.links[sig.SFUID] != nil {
+		m.mu.Unlock()
+		return
+	}
+	var direct map[string]*meshLink
+	if !m.sfu {
+		m.sfu = true
+		direct = m.links
+		m.links = map[string]*meshLink{}
+	}
+	m.mu.Unlock()
+	for _, l := range direct {
+		l.close()
+	}
+	m.offerSFU()
+}
+
+// offerSFU connects to the SFU
+func (m *mesh) offerSFU() {
+	if err := m.offer(sig.SFUID); err != nil {
+		debugLog.Printf("mesh: offer %s: %v", sig.SFUID, err)
+		m.setNotice("could not reach the SFU")
+		return
+	}
+	m.setNotice("forwarding through the SFU")
+}
+
+// addLocked puts a peer in the grid
+func (m *mesh) addLocked(id string) {
+	for _, p := range m.order {
+		if p == id {
+			return
+		}
+	}
+	m.order = append(m.order, id)
+	m.dirty = true
+}
+
+// onSignal applies an offer, answer or candidate from another peer
+func (m *mesh) onSignal(msg sig.Message) {
+	from := msg.ClientID
+	var err error
+	switch msg.Type {
+	case sig.MsgOffer:
+		if l := m.link(from); l != nil && from == sig.SFUID {
+			// the SFU adds or removes forwarded tracks
+			err = m.renegotiate(l, msg.SDP)
+			break
+		}
+		err = m.answer(from, msg.SDP)
+	case sig.MsgAnswer:
+		if l := m.link(from); l != nil {
+			err = l.pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: msg.SDP})
+			if err == nil {
+				l.tr.remoteReady()
+			}
+		}
+	case sig.MsgCandidate:
+		if l := m.link(from); l != nil {
+			l.tr.addRemote(msg.Candidate)
+		}
+	}
+	if err != nil {
+		debugLog.Printf("mesh: %s from %s: %v", msg.Type, from, err)
+	}
+}
+
+func (m *mesh) link(id string) *meshLink {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.links[id]
+}
+
+// newLink creates the connection to peer id, replacing any earlier one
+func (m *mesh) newLink(id string) (*meshLink, error) {
+	pc, path, err := CreatePeerConnectionWithFallback(m.ice, m.opts.ICEPolicy)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(m.ctx)
+	l := &meshLink{id: id, pc: pc, ctx: ctx, stop: cancel, state: "connecting…"}
+	l.tr = newTrickle(pc, path, func(b64 string) error {
+		return m.sg.SendSignal(sig.Message{Type: sig.MsgCandidate, To: id, Candidate: b64})
+	})
+
+	pc.OnDataChannel(func(dc *webrtc.DataChannel) {
+		switch label := dc.Label(); {
+		case label == ControlLabel:
+			m.attachControl(l, AttachControlChannel(dc))
+		case label == "ascii":
+			m.attachASCII(l, dc)
+		case strings.HasPrefix(label, "ascii:") && id == sig.SFUID:
+			// another peer's frames, forwarded
+			m.receiveFrames(strings.TrimPrefix(label, "ascii:"), dc)
+		}
+	})
+	pc.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
+		debugLog.Printf("mesh: %s %s", id, s)
+		switch s {
+		case webrtc.PeerConnectionStateConnected:
+			l.setState("")
+			m.setNotice(fmt.Sprintf("🔗 %s connected via %s", id, selectedPath(pc)))
+			m.sg.SetPhase(sig.PhaseConnected)
+		case webrtc.PeerConnectionStateDisconnected:
+			l.setState("reconnecting…")
+		case webrtc.PeerConnectionStateFailed:
+			go func() {
+				// the SFU is still in the room; its end of the link went
+				if m.dropLink(l, "connection failed") && id == sig.SFUID {
+					m.offerSFU()
+				}
+			}()
+		}
+		m.markDirty()
+	})
+
+	m.mu.Lock()
+	old := m.links[id]
+	m.links[id] = l
+	if id != sig.SFUID && !m.viewers[id] {
+		m.addLocked(id)
+	}
+	m.mu.Unlock()
+	if old != nil {
+		old.close()
+	}
+	return l, nil
+}
+
+// offer connects to a peer that joined, creating the channels
+func (m *mesh) offer(id string) error {
+	l, err := m.newLink(id)
+	if err != nil {
+		return err
+	}
+	ctrl, err := NewControlChannel(l.pc)
+	if err != nil {
+		return err
+	}
+	m.attachControl(l, ctrl)
+	// a viewer only offers to the SFU, and has nothing to send it
+	if !m.viewer {
+		dc, err := l.pc.CreateDataChannel("ascii", nil)
+		if err != nil {
+			return err
+		}
+		m.attachASCII(l, dc)
+	}
+
+	offer, err := l.pc.CreateOffer(nil)
+	if err != nil {
+		return err
+	}
+	if err := l.pc.SetLocalDescription(offer); err != nil {
+		return err
+	}
+	if err := m.sg.SendSignal(sig.Message{Type: sig.MsgOffer, To: id, SDP: l.tr.path.SDP(offer.SDP)}); err != nil {
+		return err
+	}
+	l.tr.localReady()
+	return nil
+}
+
+// answer accepts a peer's offer; a new offer from a known peer means it
+// started over, so the old link goes
+func (m *mesh) answer(id, sdp string) error {
+	l, err := m.newLink(id)
+	if err != nil {
+		return err
+	}
+	if err := l.pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: sdp}); err != nil {
+		return err
+	}
+	l.tr.remoteReady()
+	answer, err := l.pc.CreateAnswer(nil)
+	if err != nil {
+		return err
+	}
+	if err := l.pc.SetLocalDescription(answer); err != nil {
+		return err
+	}
+	if err := m.sg.SendSignal(sig.Message{Type: sig.MsgAnswer, To: id, SDP: l.tr.path.SDP(answer.SDP)}); err != nil {
+		return err
+	}
+	l.tr.localReady()
+	m.layoutChanged()
+	return nil
+}
+
+// attachControl tells the peer its tile size once the channel opens and
+// applies the tile size it asks for
+func (m *mesh) attachControl(l *meshLink, ctrl *ControlChannel) {
+	l.mu.Lock()
+	l.ctrl = ctrl
+	l.mu.Unlock()
+	ctrl.On(ControlHello, func(msg ControlMessage) {
+		if msg.Hello != nil {
+			l.mu.Lock()
+			l.remote = *msg.Hello
+			l.mu.Unlock()
+		}
+	})
+	ctrl.On(ControlViewport, func(msg ControlMessage) {
+		if qc := l.quality(); qc != nil && msg.Viewport != nil {
+			qc.SetViewport(msg.Viewport.Width, msg.Viewport.Height)
+		}
+	})
+	ctrl.On(ControlBye, func(ControlMessage) {
+		m.drop(l.id, "left")
+	})
+	ctrl.OnOpen(func() {
+		w, h := m.frameSize()
+		_ = ctrl.SendViewport(w, h)
+	})
+}
+
+// attachASCII draws the peer's frames in its tile and, once open, sends it
+// ours
+func (m *mesh) attachASCII(l *meshLink, dc *webrtc.DataChannel) {
+	dc.OnOpen(func() {
+		qc := NewQualityController(l.pc, dc)
+		w, h := m.frameSize()
+		qc.SetViewport(w, h)
+		go qc.Run(l.ctx)
+		l.mu.Lock()
+		l.ascii, l.qc = dc, qc
+		l.mu.Unlock()
+	})
+	m.receiveFrames(l.id, dc)
+}
+
+// receiveFrames draws the frames arriving on dc in peer id's tile
+func (m *mesh) receiveFrames(id string, dc *webrtc.DataChannel) {
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		_, data, _ := unstampFrame(msg.Data)
+		m.mu.Lock()
+		m.frames[id], m.dirty = string(data), true
+		m.mu.Unlock()
+	})
+}
+
+// renegotiate answers an offer on an existing link
+func (m *mesh) renegotiate(l *meshLink, sdp string) error {
+	if err := l.pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: sdp}); err != nil {
+		return err
+	}
+	answer, err := l.pc.CreateAnswer(nil)
+	if err != nil {
+		return err
+	}
+	if err := l.pc.SetLocalDescription(answer); err != nil {
+		return err
+	}
+	return m.sg.SendSignal(sig.Message{Type: sig.MsgAnswer, To: l.id, SDP: l.tr.path.SDP(answer.SDP)})
+}
+
+// dropLink drops a peer unless l was replaced by a newer link or the peer
+// left meanwhile, and reports whether it did
+func (m *mesh) dropLink(l *meshLink, why string) bool {
+	m.mu.Lock()
+	current := m.links[l.id] == l
+	m.mu.Unlock()
+	if current {
+		m.drop(l.id, why)
+	}
+	return current
+}
+
+// drop closes the link to a peer and removes its tile
+func (m *mesh) drop(id, why string) {
+	m.mu.Lock()
+	l := m.links[id]
+	delete(m.links, id)
+	delete(m.frames, id)
+	known := l != nil
+	for i, p := range m.order {
+		if p == id {
+			m.order = append(m.order[:i], m.order[i+1:]...)
+			known = true
+			break
+		}
+	}
+	m.mu.Unlock()
+	if !known {
+		// a bye followed by the signaler's notice
+		return
+	}
+	if l != nil {
+		l.close()
+	}
+	m.setNotice(id + " " + why)
+	m.layoutChanged()
+}
+
+// hangup says bye to every peer before the connections close
+func (m *mesh) hangup() {
+	m.mu.Lock()
+	links := make([]*meshLink, 0, len(m.links))
+	for _, l := range m.links {
+		links = append(links, l)
+	}
+	m.mu.Unlock()
+	for _, l := range links {
+		if ctrl := l.control(); ctrl != nil {
+			_ = ctrl.SendBye("left the call")
+		}
+	}
+	if len(links) > 0 {
+		// Give SCTP a moment to flush before the PeerConnections are closed
+		time.Sleep(100 * time.Millisecond)
+	}
+	for _, l := range links {
+		l.close()
+	}
+}
+
+func (l *meshLink) close() {
+	l.stop()
+	_ = l.pc.Close()
+}
+
+func (l *meshLink) setState(s string) {
+	l.mu.Lock()
+	l.state = s
+	l.mu.Unlock()
+}
+
+func (l *meshLink) quality() *QualityController {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.qc
+}
+
+func (l *meshLink) control() *ControlChannel {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.ctrl
+}
+
+// area is the part of the terminal the grid may use, above the status bar
+func (m *mesh) area() (width, height int) {
+	q := render.TerminalQuality()
+	return q.Width, q.Height - 1
+}
+
+// frameSize is the frame size of one tile with the current members
+func (m *mesh) frameSize() (width, height int) {
+	m.mu.Lock()
+	n := len(m.order)
+	if !m.viewer {
+		n++
+	}
+	m.mu.Unlock()
+	w, h := m.area()
+	_, _, fw, fh := render.GridLayout(n, w, h)
+	return fw, fh
+}
+
+// layoutChanged tells every peer its new tile size after members came or went
+func (m *mesh) layoutChanged() {
+	w, h := m.frameSize()
+	m.mu.Lock()
+	links := make([]*meshLink, 0, len(m.links))
+	for _, l := range m.links {
+		links = append(links, l)
+	}
+	m.dirty = true
+	m.mu.Unlock()
+	for _, l := range links {
+		if ctrl := l.control(); ctrl != nil {
+			_ = ctrl.SendViewport(w, h)
+		}
+	}
+	// the next draw has a different layout
+	m.drawMu.Lock()
+	render.ClearTerminal()
+	m.drawMu.Unlock()
+}
+
+func (m *mesh) markDirty() {
+	m.mu.Lock()
+	m.dirty = true
+	m.mu.Unlock()
+}
+
+func (m *mesh) setNotice(text string) {
+	debugLog.Printf("mesh: %s", text)
+	m.mu.Lock()
+	m.notice, m.dirty = text, true
+	m.mu.Unlock()
+}
+
+// captureLoop reads the webcam, shows our own tile and sends each peer a
+// frame (see sendFrame)
+func (m *mesh) captureLoop() {
+	webcam, err := capture.OpenWebCam()
+	if err != nil {
+		m.setNotice("webcam: " + err.Error())
+		return
+	}
+	defer webcam.Close()
+	webcam.SetProperty(gocv.VideoCaptureFPS, 10)
+	webcam.SetProperty(gocv.VideoCaptureFrameWidth, 640)
+	webcam.SetProperty(gocv.VideoCaptureFrameHeight, 480)
+
+	t := time.NewTicker(meshFrameInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-t.C:
+		}
+		frame, err := webcam.ReadFrame()
+		if err != nil {
+			continue
+		}
+		captured := time.Now()
+		w, h := m.frameSize()
+		self := render.ConvertFrameToASCIIWithQuality(frame, render.Quality{
+			Width: w, Height: h, Color: m.opts.Color, Charset: render.Charsets[m.opts.Charset],
+		})
+		m.mu.Lock()
+		m.self, m.dirty = self, true
+		links := make([]*meshLink, 0, len(m.links))
+		for _, l := range m.links {
+			links = append(links, l)
+		}
+		m.mu.Unlock()
+		sendFrame(frame, captured, links)
+		frame.Close()
+	}
+}
+
+// sendFrame sends each link the frame rendered at the quality the link allows,
+// when that link is due and not backed up. A slow peer only loses its own
+// frames.
+func sendFrame(frame gocv.Mat, captured time.Time, links []*meshLink) {
+	// peers with the same tile size and level share a rendering
+	type size struct {
+		w, h  int
+		color render.ColorMode
+	}
+	rendered := map[size]string{}
+	convert := func(q render.Quality) string {
+		key := size{q.Width, q.Height, q.Color}
+		if s, ok := rendered[key]; ok {
+			return s
+		}
+		s := render.ConvertFrameToASCIIWithQuality(frame, q)
+		rendered[key] = s
+		return s
+	}
+	for _, l := range links {
+		l.mu.Lock()
+		dc, qc, sent, stamps := l.ascii, l.qc, l.sent, l.remote.Has("timestamps")
+		l.mu.Unlock()
+		if dc == nil || time.Since(sent) < qc.Interval() || dc.BufferedAmount() > bufferedHigh {
+			continue
+		}
+		ascii := convert(qc.Quality())
+		if stamps {
+			ascii = stampFrame(ascii, captured)
+		}
+		if dc.SendText(ascii) == nil {
+			l.mu.Lock()
+			l.sent = captured
+			l.mu.Unlock()
+		}
+	}
+}
+
+// drawLoop redraws the grid when something changed
+func (m *mesh) drawLoop() {
+	t := time.NewTicker(meshFrameInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-t.C:
+		}
+		m.mu.Lock()
+		dirty := m.dirty
+		m.dirty = false
+		m.mu.Unlock()
+		if dirty {
+			m.draw()
+		}
+	}
+}
+
+func (m *mesh) draw() {
+	m.mu.Lock()
+	var tiles []render.Tile
+	if !m.viewer {
+		tiles = append(tiles, render.Tile{Label: m.me + " (you)", Frame: m.self})
+	}
+	for _, id := range m.order {
+		t := render.Tile{Label: id, Frame: m.frames[id]}
+		link := id
+		if m.sfu {
+			link = sig.SFUID
+		}
+		state := ""
+		if l := m.links[link]; l != nil {
+			l.mu.Lock()
+			state = l.state
+			l.mu.Unlock()
+		}
+		if state == "" && t.Frame == "" {
+			state = "waiting…"
+		}
+		if state != "" {
+			t.Label += " " + state
+		}
+		tiles = append(tiles, t)
+	}
+	kind := "mesh"
+	if m.sfu {
+		kind = "sfu"
+	}
+	status := fmt.Sprintf("%s %s | %d in the room", kind, m.room, len(tiles))
+	if m.viewer {
+		status = fmt.Sprintf("watching %s | %d on screen", m.room, len(tiles))
+	}
+	if n := len(m.viewers); n > 0 {
+		status += fmt.Sprintf(" | %d watching", n)
+	}
+	if m.notice != "" {
+		status += " | " + m.notice
+	}
+	m.mu.Unlock()
+
+	w, h := m.area()
+	m.drawMu.Lock()
+	defer m.drawMu.Unlock()
+	render.MoveCursorToTop()
+	fmt.Print(render.ComposeGrid(tiles, w, h))
+	render.DrawStatusBar(render.Truncate(status, render.TerminalWidth()-2))
+}
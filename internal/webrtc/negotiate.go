@@ -0,0 +1,207 @@
+package webrtc
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	sig "github.com/saswatsam786/snapshell/internal/signal"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// answerTimeout is how long the polite peer waits for the answer to an
+// offer before it drops the offer and sends a new one
+var answerTimeout = 10 * time.Second
+
+// negotiator renegotiates a running call with the "perfect negotiation"
+// pattern: either side may send an offer at any time (a new track, an ICE
+// restart), and when both do at once the polite peer drops its own offer and
+// answers while the impolite peer ignores the colliding offer.
+//
+// pion defines SDPTypeRollback but refuses it in have-local-offer
+// (TestPionRefusesLocalRollback), so the polite peer only sets its
+// offer as the local description once the answer arrives; until then it is
+// still stable and dropping the offer is its rollback. Its new transceivers
+// then fire negotiationneeded again; they get mids of their own ("p1", ...)
+// so the impolite peer's offer cannot claim the same ones meanwhile. An
+// offer left unanswered for answerTimeout is dropped and sent again. ICE
+// restarts come from the impolite side, whose CreateOffer restarts ICE at
+// once.
+//
+// The initial exchange still uses the room's offer/answer endpoints; start
+// hands over to the negotiator once it is done. The answerer is polite.
+type negotiator struct {
+	pc     *webrtc.PeerConnection
+	tr     *trickle
+	polite bool
+	send   func(webrtc.SessionDescription) error
+
+	// mu serialises our offers with the peer's descriptions
+	mu    sync.Mutex
+	ready bool
+	// pending is the polite peer's sent offer that is not applied yet
+	pending *webrtc.SessionDescription
+	mids    int
+}
+
+func newNegotiator(pc *webrtc.PeerConnection, tr *trickle, polite bool, send func(webrtc.SessionDescription) error) *negotiator {
+	n := &negotiator{pc: pc, tr: tr, polite: polite, send: send}
+	pc.OnNegotiationNeeded(func() {
+		// pion calls this from its operations queue; do not block it
+		go func() {
+			if err := n.offer(nil); err != nil {
+				debugLog.Printf("negotiate: %v", err)
+			}
+		}()
+	})
+	return n
+}
+
+// start takes over negotiation after the initial exchange. Before that the
+// initial offer covers whatever triggered negotiationneeded.
+func (n *negotiator) start() {
+	n.mu.Lock()
+	n.ready = true
+	n.mu.Unlock()
+}
+
+// offer sends a new offer; opts may request an ICE restart
+func (n *negotiator) offer(opts *webrtc.OfferOptions) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if !n.ready || n.pending != nil {
+		return nil
+	}
+	restart := opts != nil && opts.ICERestart
+	if n.pc.SignalingState() != webrtc.SignalingStateStable && !restart {
+		// an exchange is in flight; negotiationneeded fires again after it
+		return nil
+	}
+	if n.polite {
+		for _, t := range n.pc.GetTransceivers() {
+			if t.Mid() == "" {
+				n.mids++
+				if err := t.SetMid(fmt.Sprintf("p%d", n.mids)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	offer, err := n.pc.CreateOffer(opts)
+	if err != nil {
+		return err
+	}
+	if n.polite && !restart {
+		n.pending = &offer
+	} else if err := n.pc.SetLocalDescription(offer); err != nil {
+		return err
+	}
+	debugLog.Printf("negotiate: sending offer (ICE restart %v)", restart)
+	if err := n.send(offer); err != nil {
+		if n.pending == &offer {
+			n.pending = nil
+		}
+		return err
+	}
+	if n.pending == &offer {
+		time.AfterFunc(answerTimeout, func() { n.expire(&offer) })
+	}
+	return nil
+}
+
+// expire drops pending if the peer has not answered it yet, say because
+// the answer was lost, and offers again: pion never saw the offer, so
+// negotiationneeded will not fire for it a second time
+func (n *negotiator) expire(pending *webrtc.SessionDescription) {
+	n.mu.Lock()
+	unanswered := n.pending == pending
+	if unanswered {
+		n.pending = nil
+	}
+	n.mu.Unlock()
+	if !unanswered {
+		return
+	}
+	debugLog.Printf("negotiate: no answer within %v, offering again", answerTimeout)
+	if err := n.offer(nil); err != nil {
+		debugLog.Printf("negotiate: %v", err)
+	}
+}
+
+// handle applies a description from the peer
+func (n *negotiator) handle(d webrtc.SessionDescription) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	switch d.Type {
+	case webrtc.SDPTypeOffer:
+		if n.pending != nil {
+			debugLog.Printf("negotiate: colliding offer, dropping ours")
+			n.pending = nil
+		} else if n.pc.SignalingState() != webrtc.SignalingStateStable {
+			// only the impolite peer gets here: its offer is out
+			debugLog.Printf("negotiate: ignoring colliding offer")
+			return nil
+		}
+		if err := n.pc.SetRemoteDescription(d); err != nil {
+			return err
+		}
+		n.tr.remoteReady()
+		declineSendless(n.pc)
+		answer, err := n.pc.CreateAnswer(nil)
+		if err != nil {
+			return err
+		}
+		if err := n.pc.SetLocalDescription(answer); err != nil {
+			return err
+		}
+		return n.send(answer)
+
+	case webrtc.SDPTypeAnswer:
+		if n.pending != nil {
+			if err := n.pc.SetLocalDescription(*n.pending); err != nil {
+				n.pending = nil
+				return err
+			}
+			n.pending = nil
+		}
+		if n.pc.SignalingState() != webrtc.SignalingStateHaveLocalOffer {
+			// answer to an offer we dropped or already replaced
+			debugLog.Printf("negotiate: ignoring stale answer")
+			return nil
+		}
+		if err := n.pc.SetRemoteDescription(d); err != nil {
+			return err
+		}
+		n.tr.remoteReady()
+	}
+	return nil
+}
+
+// declineSendless stops the transceivers pion made for m-lines the peer
+// only receives on, when we have nothing to send on them. pion makes them
+// sendonly without a sender and then flags negotiationneeded after every
+// exchange, so the polite peer would offer again and again; stopped, they
+// are answered inactive.
+func declineSendless(pc *webrtc.PeerConnection) {
+	for _, t := range pc.GetTransceivers() {
+		if t.Sender() == nil && t.Direction() == webrtc.RTPTransceiverDirectionSendonly {
+			if err := t.Stop(); err != nil {
+				debugLog.Printf("negotiate: stop %s transceiver: %v", t.Kind(), err)
+			}
+		}
+	}
+}
+
+// receive applies the peer's descriptions from the signaling server in
+// order until ctx ends
+func (n *negotiator) receive(ctx context.Context, sg sig.Signaler, peerRole string) {
+	sg.ReceiveDescriptions(ctx, peerRole, func(d sig.Description) {
+		sd := webrtc.SessionDescription{Type: webrtc.NewSDPType(d.Type), SDP: d.SDP}
+		if err := n.handle(sd); err != nil {
+			debugLog.Printf("negotiate: %s: %v", d.Type, err)
+		}
+	})
+}
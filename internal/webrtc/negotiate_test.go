@@ -0,0 +1,315 @@
+package webrtc
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+)
+
+// link carries one side's descriptions to the other in order, like the
+// signaler does. While held it queues them, so a test can make offers cross.
+type link struct {
+	to func() *negotiator
+	q  chan webrtc.SessionDescription
+
+	mu     sync.Mutex
+	hold   bool
+	held   []webrtc.SessionDescription
+	offers int
+	// lose is how many answers the link still loses
+	lose int
+}
+
+func newLink(t *testing.T, to func() *negotiator) *link {
+	l := &link{to: to, q: make(chan webrtc.SessionDescription, 64)}
+	go func() {
+		for d := range l.q {
+			if err := l.to().handle(d); err != nil {
+				t.Errorf("handle %s: %v", d.Type, err)
+			}
+		}
+	}()
+	return l
+}
+
+func (l *link) send(d webrtc.SessionDescription) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if d.Type == webrtc.SDPTypeOffer {
+		l.offers++
+	}
+	if d.Type == webrtc.SDPTypeAnswer && l.lose > 0 {
+		l.lose--
+		return nil
+	}
+	if l.hold {
+		l.held = append(l.held, d)
+		return nil
+	}
+	l.q <- d
+	return nil
+}
+
+func (l *link) setHold(hold bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.hold = hold
+	if !hold {
+		for _, d := range l.held {
+			l.q <- d
+		}
+		l.held = nil
+	}
+}
+
+func (l *link) loseAnswers(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lose = n
+}
+
+func (l *link) offerCount() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.offers
+}
+
+type testPeer struct {
+	pc   *webrtc.PeerConnection
+	tr   *trickle
+	neg  *negotiator
+	link *link // to the other peer
+}
+
+// connectedPair connects two peers inside the process the way a call does:
+// the initial offer/answer by hand, then negotiators on both sides. The
+// offerer is impolite, and offers to receive the kinds in receive as a call
+// without audio or a video track does.
+func connectedPair(t *testing.T, receive ...webrtc.RTPCodecType) (offerer, answerer *testPeer) {
+	t.Helper()
+	o, a := &testPeer{}, &testPeer{}
+	for _, p := range []*testPeer{o, a} {
+		pc, path, err := CreatePeerConnectionWithFallback(nil, ICEPolicyAll)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { pc.Close() })
+		p.pc = pc
+		p.tr = newTrickle(pc, path, nil)
+	}
+	o.tr.post = func(b64 string) error { go a.tr.addRemote(b64); return nil }
+	a.tr.post = func(b64 string) error { go o.tr.addRemote(b64); return nil }
+	o.link = newLink(t, func() *negotiator { return a.neg })
+	a.link = newLink(t, func() *negotiator { return o.neg })
+	o.neg = newNegotiator(o.pc, o.tr, false, o.link.send)
+	a.neg = newNegotiator(a.pc, a.tr, true, a.link.send)
+
+	for _, kind := range receive {
+		if _, err := o.pc.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := o.pc.CreateDataChannel("control", nil); err != nil {
+		t.Fatal(err)
+	}
+	offer, err := o.pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := o.pc.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.pc.SetRemoteDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	a.tr.remoteReady()
+	declineSendless(a.pc)
+	answer, err := a.pc.CreateAnswer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.pc.SetLocalDescription(answer); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.pc.SetRemoteDescription(answer); err != nil {
+		t.Fatal(err)
+	}
+	o.tr.remoteReady()
+	o.tr.localReady()
+	a.tr.localReady()
+	o.neg.start()
+	a.neg.start()
+
+	waitFor(t, "connection", func() bool { return connected(o) && connected(a) })
+	return o, a
+}
+
+func connected(p *testPeer) bool {
+	return p.pc.ConnectionState() == webrtc.PeerConnectionStateConnected
+}
+
+func stable(p *testPeer) bool {
+	return p.pc.SignalingState() == webrtc.SignalingStateStable
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func addVideo(t *testing.T, p *testPeer, id string) {
+	t.Helper()
+	track, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, id, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.pc.AddTrack(track); err != nil {
+		t.Fatal(err)
+	}
+	// keep the sender busy so nothing waits on an idle track
+	go func() {
+		for p.pc.ConnectionState() != webrtc.PeerConnectionStateClosed {
+			track.WriteSample(media.Sample{Data: []byte{0}, Duration: 100 * time.Millisecond})
+			time.Sleep(100 * time.Millisecond)
+		}
+	}()
+}
+
+// videoSections counts the m=video lines of a description
+func videoSections(d *webrtc.SessionDescription) int {
+	if d == nil {
+		return 0
+	}
+	return strings.Count(d.SDP, "m=video ")
+}
+
+// Both sides add a track at once, so their offers cross. The answerer drops
+// its offer, answers, and offers its track again afterwards.
+func TestNegotiatorGlare(t *testing.T) {
+	o, a := connectedPair(t)
+
+	o.link.setHold(true)
+	a.link.setHold(true)
+	addVideo(t, o, "offerer")
+	addVideo(t, a, "answerer")
+	waitFor(t, "both offers", func() bool { return o.link.offerCount() == 1 && a.link.offerCount() == 1 })
+	o.link.setHold(false)
+	a.link.setHold(false)
+
+	waitFor(t, "both tracks negotiated", func() bool {
+		for _, p := range []*testPeer{o, a} {
+			if !stable(p) || videoSections(p.pc.CurrentLocalDescription()) != 2 || videoSections(p.pc.CurrentRemoteDescription()) != 2 {
+				return false
+			}
+		}
+		return true
+	})
+	if n := a.link.offerCount(); n != 2 {
+		t.Errorf("answerer sent %d offers, want 2 (the dropped one and its retry)", n)
+	}
+	if n := o.link.offerCount(); n != 1 {
+		t.Errorf("offerer sent %d offers, want 1", n)
+	}
+	waitFor(t, "connection after glare", func() bool { return connected(o) && connected(a) })
+}
+
+// An ICE restart from the offerer gives both sides new credentials and the
+// call reconnects over them.
+func TestNegotiatorICERestart(t *testing.T) {
+	o, a := connectedPair(t)
+	oldLocal := sdpUfrag(o.pc.CurrentLocalDescription().SDP)
+	oldRemote := sdpUfrag(o.pc.CurrentRemoteDescription().SDP)
+
+	if err := o.neg.offer(&webrtc.OfferOptions{ICERestart: true}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "restart answered", func() bool { return stable(o) && stable(a) })
+
+	if got := sdpUfrag(o.pc.CurrentLocalDescription().SDP); got == oldLocal {
+		t.Errorf("offerer kept ufrag %s", got)
+	}
+	if got := sdpUfrag(o.pc.CurrentRemoteDescription().SDP); got == oldRemote {
+		t.Errorf("answerer kept ufrag %s", got)
+	}
+	if sdpUfrag(a.pc.CurrentRemoteDescription().SDP) != sdpUfrag(o.pc.CurrentLocalDescription().SDP) {
+		t.Error("answerer has not applied the restarted offer")
+	}
+
+	dc, err := o.pc.CreateDataChannel("after-restart", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	open := make(chan struct{})
+	dc.OnOpen(func() { close(open) })
+	select {
+	case <-open:
+	case <-time.After(10 * time.Second):
+		t.Fatal("no data channel over the restarted connection")
+	}
+}
+
+// The answer to the polite peer's offer is lost. It offers again once the
+// answer is overdue, and the track is negotiated.
+func TestNegotiatorLostAnswer(t *testing.T) {
+	timeout := answerTimeout
+	answerTimeout = 500 * time.Millisecond
+	t.Cleanup(func() { answerTimeout = timeout })
+	o, a := connectedPair(t)
+
+	o.link.loseAnswers(1)
+	addVideo(t, a, "answerer")
+	waitFor(t, "track negotiated", func() bool {
+		return stable(a) && videoSections(a.pc.CurrentLocalDescription()) == 1 && videoSections(o.pc.CurrentRemoteDescription()) == 1
+	})
+	if n := a.link.offerCount(); n != 2 {
+		t.Errorf("answerer sent %d offers, want 2 (the unanswered one and its retry)", n)
+	}
+}
+
+// Neither side has anything to send on the m-lines the offerer only
+// receives on, so once connected nobody has a reason to offer again.
+func TestNegotiatorQuietWithoutMedia(t *testing.T) {
+	o, a := connectedPair(t, webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo)
+
+	time.Sleep(time.Second)
+	if n := a.link.offerCount(); n != 0 {
+		t.Errorf("answerer sent %d offers, want 0", n)
+	}
+	if n := o.link.offerCount(); n != 0 {
+		t.Errorf("offerer sent %d offers, want 0", n)
+	}
+}
+
+// The negotiator drops the polite peer's offer instead of rolling it back
+// because pion refuses the rollback. If this starts failing, pion can roll
+// back and the negotiator can use the standard pattern.
+func TestPionRefusesLocalRollback(t *testing.T) {
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	if _, err := pc.CreateDataChannel("control", nil); err != nil {
+		t.Fatal(err)
+	}
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pc.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	if err := pc.SetLocalDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeRollback, SDP: offer.SDP}); err == nil {
+		t.Fatal("pion rolled back a local offer")
+	}
+}
@@ -3,6 +3,10 @@ package webrtc
 import (
 	"encoding/base64"
 	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/pion/webrtc/v4"
 )
@@ -33,31 +37,151 @@ func CreatePeerConnectionWithServers(ice []webrtc.ICEServer) (*webrtc.PeerConnec
 	return pc, nil
 }
 
-// CreatePeerConnectionWithFallback creates a connection that first tries relay-only,
-// then falls back to all candidates if relay fails
-func CreatePeerConnectionWithFallback(ice []webrtc.ICEServer) (*webrtc.PeerConnection, error) {
-	// First try relay-only for cross-network connectivity
+// ICEPolicy selects which candidates a connection may use
+type ICEPolicy string
+
+const (
+	// ICEPolicyAll uses every candidate (host, server reflexive, relay)
+	ICEPolicyAll ICEPolicy = "all"
+	// ICEPolicyRelay only uses TURN relays
+	ICEPolicyRelay ICEPolicy = "relay"
+	// ICEPolicyAuto tries relays first and falls back to all candidates
+	// when that does not connect within relayFallbackAfter
+	ICEPolicyAuto ICEPolicy = "auto"
+)
+
+// relayFallbackAfter is how long the auto policy waits for a relayed
+// connection before renegotiating with all candidates
+const relayFallbackAfter = 8 * time.Second
+
+// ParseICEPolicy parses the --ice-policy flag
+func ParseICEPolicy(s string) (ICEPolicy, bool) {
+	switch p := ICEPolicy(s); p {
+	case ICEPolicyAll, ICEPolicyRelay, ICEPolicyAuto:
+		return p, true
+	case "":
+		return ICEPolicyAuto, true
+	}
+	return "", false
+}
+
+// ICEPath tracks which candidates we currently signal to the peer. Under the
+// auto policy pion gathers everything and only relay candidates are sent,
+// trickled or in our descriptions, until FallBack is called; the ICE
+// restart that follows sends them all.
+type ICEPath struct {
+	policy ICEPolicy
+
+	mu        sync.Mutex
+	relayOnly bool
+}
+
+// Allow reports whether a gathered candidate should be sent to the peer
+func (p *ICEPath) Allow(c *webrtc.ICECandidate) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return c == nil || !p.relayOnly || c.Typ == webrtc.ICECandidateTypeRelay
+}
+
+// SDP strips the candidates Allow holds back from a description we send;
+// pion puts every candidate gathered so far into the SDP it creates
+func (p *ICEPath) SDP(sdp string) string {
+	p.mu.Lock()
+	relayOnly := p.relayOnly
+	p.mu.Unlock()
+	if !relayOnly {
+		return sdp
+	}
+	var b strings.Builder
+	for _, line := range strings.SplitAfter(sdp, "\n") {
+		if strings.HasPrefix(line, "a=candidate:") && !strings.Contains(line, " typ relay") {
+			continue
+		}
+		b.WriteString(line)
+	}
+	return b.String()
+}
+
+// CanFallBack reports whether a relay-only attempt is still pending fallback
+func (p *ICEPath) CanFallBack() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.policy == ICEPolicyAuto && p.relayOnly
+}
+
+// FallBack allows all candidates from now on
+func (p *ICEPath) FallBack() {
+	p.mu.Lock()
+	p.relayOnly = false
+	p.mu.Unlock()
+}
+
+// String names the candidates currently in use
+func (p *ICEPath) String() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.relayOnly || p.policy == ICEPolicyRelay {
+		return "relay-only"
+	}
+	return "all candidates"
+}
+
+// CreatePeerConnectionWithFallback creates a connection for the given ICE
+// policy. Relay policies need a TURN server; without one auto goes straight
+// to all candidates. Falling back needs signaling, so the caller drives it
+// through the returned ICEPath.
+func CreatePeerConnectionWithFallback(ice []webrtc.ICEServer, policy ICEPolicy) (*webrtc.PeerConnection, *ICEPath, error) {
+	if policy == "" {
+		policy = ICEPolicyAuto
+	}
+	path := &ICEPath{policy: policy}
+
 	cfg := webrtc.Configuration{
-		ICEServers:         ice,
-		ICETransportPolicy: webrtc.ICETransportPolicyRelay,
-		BundlePolicy:       webrtc.BundlePolicyMaxBundle,
-		RTCPMuxPolicy:      webrtc.RTCPMuxPolicyRequire,
+		ICEServers:    ice,
+		BundlePolicy:  webrtc.BundlePolicyMaxBundle,
+		RTCPMuxPolicy: webrtc.RTCPMuxPolicyRequire,
+	}
+	switch {
+	case policy == ICEPolicyRelay:
+		cfg.ICETransportPolicy = webrtc.ICETransportPolicyRelay
+	case policy == ICEPolicyAuto && hasTURN(ice):
+		// gather everything so the fallback only needs an ICE restart, but
+		// signal relays alone at first
+		path.relayOnly = true
+	case policy == ICEPolicyAuto:
+		debugLog.Printf("ice: no TURN server, using all candidates")
 	}
 
 	pc, err := webrtc.NewPeerConnection(cfg)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	return pc, path, nil
+}
 
-	// Add connection state change handler to detect relay failures
-	pc.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
-		if s == webrtc.PeerConnectionStateFailed {
-			// If relay fails, we could implement fallback logic here
-			// For now, just log the failure
+func hasTURN(ice []webrtc.ICEServer) bool {
+	for _, s := range ice {
+		for _, u := range s.URLs {
+			if strings.HasPrefix(u, "turn:") || strings.HasPrefix(u, "turns:") {
+				return true
+			}
 		}
-	})
+	}
+	return false
+}
 
-	return pc, nil
+// selectedPath describes the candidate pair ICE settled on, e.g.
+// "relay ↔ srflx"
+func selectedPath(pc *webrtc.PeerConnection) string {
+	sctp := pc.SCTP()
+	if sctp == nil {
+		return "unknown"
+	}
+	pair, err := sctp.Transport().ICETransport().GetSelectedCandidatePair()
+	if err != nil || pair == nil {
+		return "unknown"
+	}
+	return fmt.Sprintf("%s ↔ %s", pair.Local.Typ, pair.Remote.Typ)
 }
 
 // Encode an SDP structure into base64 for manual exchange
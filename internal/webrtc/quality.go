@@ -0,0 +1,216 @@
+package webrtc
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/saswatsam786/snapshell/internal/render"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// qualityLevel is one rung of the adaptive quality ladder
+type qualityLevel struct {
+	Scale float64 // fraction of the terminal geometry
+	Color render.ColorMode
+	FPS   int
+}
+
+// qualityLadder is ordered from cheapest to most expensive. Each step up
+// costs roughly 1.5-3x the bytes per second of the one below it.
+var qualityLadder = []qualityLevel{
+	{Scale: 0.4, Color: render.ColorNone, FPS: 5},
+	{Scale: 0.6, Color: render.ColorNone, FPS: 8},
+	{Scale: 1.0, Color: render.ColorNone, FPS: 10},
+	{Scale: 1.0, Color: render.Color256, FPS: 12},
+	{Scale: 1.0, Color: render.ColorTrue, FPS: 15},
+}
+
+// defaultQualityLevel matches the fixed full-size grayscale 10fps stream
+const defaultQualityLevel = 2
+
+const (
+	qualitySampleInterval = 2 * time.Second
+
+	// Step down when any of these is exceeded...
+	rttHigh      = 400 * time.Millisecond
+	bufferedHigh = 256 * 1024
+
+	// ...and only step up when all of these hold
+	rttLow      = 150 * time.Millisecond
+	bufferedLow = 16 * 1024
+
+	// Consecutive samples needed before acting; stepping up is deliberately
+	// slower than stepping down so the controller does not oscillate
+	downAfter = 2
+	upAfter   = 5
+)
+
+// qualitySample is one measurement taken from pc.GetStats()
+type qualitySample struct {
+	RTT        time.Duration
+	Buffered   uint64
+	Throughput float64 // bytes/s sent on the data channel since the last sample
+	Available  float64 // bytes/s the transport estimates it can send, 0 if unknown
+}
+
+// QualityController adjusts the render geometry, color depth and frame rate
+// of the outgoing stream based on RTT, buffered amount and throughput
+type QualityController struct {
+	pc *webrtc.PeerConnection
+	dc *webrtc.DataChannel
+
+	mu         sync.Mutex
+	level      int
+	bad, good  int
+	last       qualitySample
+	lastBytes  uint64
+	lastSample time.Time
+	changed    chan struct{}
+
+	// viewport is the peer's render area; frames are never sent larger
+	viewport Viewport
+}
+
+// NewQualityController creates a controller for frames sent on dc
+func NewQualityController(pc *webrtc.PeerConnection, dc *webrtc.DataChannel) *QualityController {
+	return &QualityController{
+		pc:      pc,
+		dc:      dc,
+		level:   defaultQualityLevel,
+		changed: make(chan struct{}, 1),
+	}
+}
+
+// Run samples stats periodically until ctx is done
+func (qc *QualityController) Run(ctx context.Context) {
+	t := time.NewTicker(qualitySampleInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			qc.step(qc.measure())
+		}
+	}
+}
+
+// Changed fires after the controller switches to a different level
+func (qc *QualityController) Changed() <-chan struct{} {
+	return qc.changed
+}
+
+// SetViewport caps the frame geometry to the peer's render area
+func (qc *QualityController) SetViewport(width, height int) {
+	qc.mu.Lock()
+	qc.viewport = Viewport{Width: width, Height: height}
+	qc.mu.Unlock()
+	debugLog.Printf("quality: peer viewport %dx%d", width, height)
+}
+
+// Quality returns the render settings for the current level
+func (qc *QualityController) Quality() render.Quality {
+	qc.mu.Lock()
+	lvl := qualityLadder[qc.level]
+	vp := qc.viewport
+	qc.mu.Unlock()
+
+	q := render.TerminalQuality()
+	if vp.Width > 0 && vp.Width < q.Width {
+		q.Width = vp.Width
+	}
+	if vp.Height > 0 && vp.Height < q.Height {
+		q.Height = vp.Height
+	}
+	q.Width = int(float64(q.Width) * lvl.Scale)
+	q.Height = int(float64(q.Height) * lvl.Scale)
+	q.Color = lvl.Color
+	return q
+}
+
+// Interval returns the time between frames for the current level
+func (qc *QualityController) Interval() time.Duration {
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+	return time.Second / time.Duration(qualityLadder[qc.level].FPS)
+}
+
+// Status returns a short summary suitable for the status bar
+func (qc *QualityController) Status() string {
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+	lvl := qualityLadder[qc.level]
+	return fmt.Sprintf("Q%d/%d %d%% %s %dfps | rtt %dms buf %dKB %.0fKB/s",
+		qc.level, len(qualityLadder)-1, int(lvl.Scale*100), lvl.Color, lvl.FPS,
+		qc.last.RTT.Milliseconds(), qc.last.Buffered/1024, qc.last.Throughput/1024)
+}
+
+func (qc *QualityController) measure() qualitySample {
+	now := time.Now()
+	s := qualitySample{Buffered: qc.dc.BufferedAmount()}
+
+	report := qc.pc.GetStats()
+	for _, st := range report {
+		if pair, ok := st.(webrtc.ICECandidatePairStats); ok && pair.Nominated {
+			s.RTT = time.Duration(pair.CurrentRoundTripTime * float64(time.Second))
+			s.Available = pair.AvailableOutgoingBitrate / 8
+		}
+	}
+	if dcStats, ok := report.GetDataChannelStats(qc.dc); ok {
+		if !qc.lastSample.IsZero() && dcStats.BytesSent >= qc.lastBytes {
+			s.Throughput = float64(dcStats.BytesSent-qc.lastBytes) / now.Sub(qc.lastSample).Seconds()
+		}
+		qc.lastBytes = dcStats.BytesSent
+	}
+	qc.lastSample = now
+	return s
+}
+
+// step feeds one sample into the controller and reports whether the level
+// changed
+func (qc *QualityController) step(s qualitySample) bool {
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+	qc.last = s
+
+	congested := s.RTT > rttHigh || s.Buffered > bufferedHigh ||
+		(s.Available > 0 && s.Throughput > 0.9*s.Available)
+	healthy := s.RTT < rttLow && s.Buffered < bufferedLow &&
+		(s.Available == 0 || s.Throughput < 0.5*s.Available)
+
+	switch {
+	case congested:
+		qc.bad++
+		qc.good = 0
+	case healthy:
+		qc.good++
+		qc.bad = 0
+	default:
+		// In the dead band between thresholds: hold the current level
+		qc.bad, qc.good = 0, 0
+	}
+
+	prev := qc.level
+	if qc.bad >= downAfter && qc.level > 0 {
+		qc.level--
+	} else if qc.good >= upAfter && qc.level < len(qualityLadder)-1 {
+		qc.level++
+	}
+
+	debugLog.Printf("quality: rtt=%s buffered=%d throughput=%.0fB/s available=%.0fB/s congested=%v healthy=%v level=%d",
+		s.RTT, s.Buffered, s.Throughput, s.Available, congested, healthy, qc.level)
+
+	if qc.level == prev {
+		return false
+	}
+	qc.bad, qc.good = 0, 0
+	debugLog.Printf("quality: level %d -> %d (%+v)", prev, qc.level, qualityLadder[qc.level])
+	select {
+	case qc.changed <- struct{}{}:
+	default:
+	}
+	return true
+}
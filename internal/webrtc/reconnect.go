@@ -0,0 +1,268 @@
+package webrtc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	sig "github.com/saswatsam786/snapshell/internal/signal"
+
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	// reconnectGrace gives ICE a chance to recover on its own (a short
+	// Wi-Fi drop) before the offerer restarts it
+	reconnectGrace = 5 * time.Second
+	// reconnectAttempt is how long one ICE restart may take to connect
+	// before the offerer tries again
+	reconnectAttempt = 10 * time.Second
+	// reconnectTimeout ends the call when it cannot be restored
+	reconnectTimeout = 45 * time.Second
+)
+
+// reconnector keeps a call alive across network changes. When the
+// connection drops after having been up, the offerer restarts ICE with a new
+// offer through the negotiator and the answerer answers it; the call
+// only ends if that does not succeed within reconnectTimeout. The same
+// restart carries the auto ICE policy's fallback from relays to all
+// candidates.
+type reconnector struct {
+	c    *call
+	sg   sig.Signaler
+	tr   *trickle
+	neg  *negotiator
+	path *ICEPath
+	role string
+
+	mu        sync.Mutex
+	connected bool               // the connection has been up at least once
+	cancel    context.CancelFunc // set while reconnecting
+	ice       io.Closer          // the current candidate subscription
+}
+
+func newReconnector(c *call, sg sig.Signaler, tr *trickle, neg *negotiator, path *ICEPath, role string) *reconnector {
+	return &reconnector{c: c, sg: sg, tr: tr, neg: neg, path: path, role: role}
+}
+
+// subscribe (re)opens the stream of candidates from the peer. The server
+// replays its backlog, and the old stream may have died with the network.
+func (r *reconnector) subscribe() error {
+	sub, err := r.sg.SubscribeICE(r.role, r.tr.addRemote)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	old := r.ice
+	r.ice = sub
+	r.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// wasConnected reports whether the connection has been up
+func (r *reconnector) wasConnected() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.connected
+}
+
+func (r *reconnector) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.ice != nil {
+		r.ice.Close()
+	}
+	if r.cancel != nil {
+		r.cancel()
+	}
+}
+
+// onState is the PeerConnection's state handler
+func (r *reconnector) onState(s webrtc.PeerConnectionState) {
+	r.mu.Lock()
+	connected := r.connected
+	r.mu.Unlock()
+	if connected {
+		debugLog.Printf("connection state: %s", s)
+	} else {
+		fmt.Printf("Connection state: %s\n", s.String())
+	}
+
+	switch s {
+	case webrtc.PeerConnectionStateConnected:
+		r.mu.Lock()
+		r.connected = true
+		cancel := r.cancel
+		r.cancel = nil
+		r.mu.Unlock()
+		if cancel != nil {
+			cancel()
+		}
+		r.sg.SetPhase(sig.PhaseConnected)
+		via := fmt.Sprintf("🔗 Connected via %s (%s)", selectedPath(r.c.pc), r.path)
+		debugLog.Print(via)
+		if !connected {
+			fmt.Println(via)
+		} else if cancel != nil {
+			r.c.setReconnecting(false)
+			r.c.notify("✅ reconnected, " + via)
+		}
+	case webrtc.PeerConnectionStateDisconnected, webrtc.PeerConnectionStateFailed:
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.cancel != nil {
+			return
+		}
+		if !r.connected {
+			if r.path.CanFallBack() {
+				r.fallBackLocked("relay-only connection " + s.String())
+				return
+			}
+			// never got through; there is nothing to restore
+			r.c.stop()
+			return
+		}
+		r.sg.SetPhase(sig.PhaseReconnecting)
+		r.beginLocked(reconnectGrace)
+	case webrtc.PeerConnectionStateClosed:
+		r.c.stop()
+	}
+}
+
+// armFallback starts the auto policy's clock once the SDP exchange is done:
+// if relays have not connected by then, renegotiate with all candidates.
+// The answerer also starts answering restarts then whatever its own policy,
+// since the offerer may be falling back.
+func (r *reconnector) armFallback() {
+	if r.role == "offer" && !r.path.CanFallBack() {
+		return
+	}
+	go func() {
+		select {
+		case <-r.c.ctx.Done():
+			return
+		case <-time.After(relayFallbackAfter):
+		}
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.connected || r.cancel != nil {
+			return
+		}
+		if r.path.CanFallBack() {
+			r.fallBackLocked(fmt.Sprintf("no relayed connection after %s", relayFallbackAfter))
+		} else {
+			r.beginLocked(0)
+		}
+	}()
+}
+
+func (r *reconnector) fallBackLocked(reason string) {
+	r.path.FallBack()
+	fmt.Printf("↪ %s, retrying with all candidates\n", reason)
+	debugLog.Printf("ice: %s, falling back to all candidates", reason)
+	r.beginLocked(0)
+}
+
+// beginLocked starts restoring the connection; the offerer waits grace
+// before restarting ICE
+func (r *reconnector) beginLocked(grace time.Duration) {
+	ctx, cancel := context.WithTimeout(r.c.ctx, reconnectTimeout)
+	r.cancel = cancel
+	go r.reconnect(ctx, grace, r.connected)
+}
+
+func (r *reconnector) reconnect(ctx context.Context, grace time.Duration, wasConnected bool) {
+	c := r.c
+	if !wasConnected {
+		// relay fallback during setup: nothing on screen to cover yet
+		r.restore(ctx, grace)
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			fmt.Println("❌ Could not connect")
+			c.stop()
+		}
+		return
+	}
+
+	c.setReconnecting(true)
+	debugLog.Printf("reconnect: connection lost")
+
+	// Redraw the overlay so the countdown moves while no frames arrive
+	go func() {
+		tick := time.NewTicker(time.Second)
+		defer tick.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-tick.C:
+				c.redrawOverlay()
+			}
+		}
+	}()
+
+	if err := r.rejoin(); err != nil {
+		debugLog.Printf("reconnect: rejoin: %v", err)
+	}
+	r.restore(ctx, grace)
+
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		c.setReconnecting(false)
+		c.notify("❌ connection lost")
+		debugLog.Printf("reconnect: gave up after %s", reconnectTimeout)
+		c.stop()
+	}
+}
+
+func (r *reconnector) restore(ctx context.Context, grace time.Duration) {
+	if r.role == "offer" {
+		r.restartICE(ctx, grace)
+		return
+	}
+	// the negotiator answers the offerer's restart; just make sure its
+	// candidates reach us
+	if err := r.subscribe(); err != nil {
+		debugLog.Printf("reconnect: subscribe: %v", err)
+	}
+	<-ctx.Done()
+}
+
+// restartICE sends ICE restart offers until the connection is back or ctx
+// ends, after giving ICE the grace period to recover by itself
+func (r *reconnector) restartICE(ctx context.Context, grace time.Duration) {
+	select {
+	case <-ctx.Done():
+		return
+	case <-time.After(grace):
+	}
+	for attempt := 1; ctx.Err() == nil; attempt++ {
+		debugLog.Printf("reconnect: ICE restart attempt %d", attempt)
+		if err := r.subscribe(); err != nil {
+			debugLog.Printf("reconnect: subscribe: %v", err)
+		} else if err := r.neg.offer(&webrtc.OfferOptions{ICERestart: true}); err != nil {
+			debugLog.Printf("reconnect: ICE restart: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(reconnectAttempt):
+		}
+	}
+}
+
+// rejoin refreshes our room membership. Join is idempotent for a client ID;
+// a different role means the room expired and was taken over meanwhile.
+func (r *reconnector) rejoin() error {
+	role, err := r.sg.Join()
+	if err != nil {
+		return err
+	}
+	if role != r.role {
+		return fmt.Errorf("room now assigns us %q instead of %q", role, r.role)
+	}
+	return nil
+}
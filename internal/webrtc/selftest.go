@@ -0,0 +1,249 @@
+package webrtc
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/saswatsam786/snapshell/internal/render"
+
+	"github.com/pion/webrtc/v4"
+	"gocv.io/x/gocv"
+)
+
+const (
+	patternWidth  = 640
+	patternHeight = 480
+)
+
+// SelfTestOptions configures RunSelfTest
+type SelfTestOptions struct {
+	Duration time.Duration
+	FPS      int
+	Quality  render.Quality
+	// Show draws the received frames and live stats in the terminal
+	Show bool
+}
+
+// SelfTestResult summarises a self-test run. Latency is measured from
+// before a test frame is rendered to ASCII until the other peer has drawn
+// it, with the same capture stamps a call uses.
+type SelfTestResult struct {
+	Sent, Received, Dropped int
+	Elapsed                 time.Duration
+	Bytes                   int64
+	Latency                 []time.Duration // sorted
+}
+
+// FPS is the rate at which frames arrived
+func (r SelfTestResult) FPS() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Received) / r.Elapsed.Seconds()
+}
+
+// Kbps is the received ASCII bandwidth
+func (r SelfTestResult) Kbps() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Bytes*8) / 1000 / r.Elapsed.Seconds()
+}
+
+func (r SelfTestResult) String() string {
+	return fmt.Sprintf("%d/%d frames (%d dropped) in %.1fs — %.1f fps, latency p50 %s p95 %s max %s, %.0f kbps",
+		r.Received, r.Sent, r.Dropped, r.Elapsed.Seconds(), r.FPS(),
+		percentile(r.Latency, 50), percentile(r.Latency, 95), percentile(r.Latency, 100), r.Kbps())
+}
+
+// percentile returns the p-th percentile (0-100) of sorted durations
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted)-1) * p / 100)
+	return sorted[i].Round(100 * time.Microsecond)
+}
+
+// RunSelfTest connects two PeerConnections inside this process, without a
+// signaling server, and streams a moving test pattern from one to the other
+// over an "ascii" data channel, the same way a call sends webcam frames
+func RunSelfTest(opts SelfTestOptions) (SelfTestResult, error) {
+	var res SelfTestResult
+	if opts.FPS <= 0 {
+		opts.FPS = 15
+	}
+
+	sender, _, err := CreatePeerConnectionWithFallback(nil, ICEPolicyAll)
+	if err != nil {
+		return res, err
+	}
+	defer sender.Close()
+	receiver, path, err := CreatePeerConnectionWithFallback(nil, ICEPolicyAll)
+	if err != nil {
+		return res, err
+	}
+	defer receiver.Close()
+
+	// Candidates go straight to the other peer instead of the signaler
+	var ts, tr *trickle
+	ts = newTrickle(sender, path, func(b64 string) error { go tr.addRemote(b64); return nil })
+	tr = newTrickle(receiver, path, func(b64 string) error { go ts.addRemote(b64); return nil })
+
+	var (
+		mu       sync.Mutex
+		sent     int
+		received int
+		latency  []time.Duration
+		bytes    int64
+	)
+	receiver.OnDataChannel(func(dc *webrtc.DataChannel) {
+		dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+			captured, frame, stamped := unstampFrame(msg.Data)
+			if opts.Show {
+				render.MoveCursorToTop()
+				fmt.Print(string(frame))
+			}
+			mu.Lock()
+			received++
+			bytes += int64(len(msg.Data))
+			if stamped {
+				latency = append(latency, time.Since(captured))
+			}
+			n := received
+			mu.Unlock()
+			if opts.Show {
+				render.DrawStatusBar(fmt.Sprintf("self-test frame %d | %s", n, selectedPath(receiver)))
+			}
+		})
+	})
+
+	dc, err := sender.CreateDataChannel("ascii", nil)
+	if err != nil {
+		return res, err
+	}
+	open := make(chan struct{})
+	dc.OnOpen(func() { close(open) })
+
+	offer, err := sender.CreateOffer(nil)
+	if err != nil {
+		return res, err
+	}
+	if err := sender.SetLocalDescription(offer); err != nil {
+		return res, err
+	}
+	if err := receiver.SetRemoteDescription(offer); err != nil {
+		return res, err
+	}
+	tr.remoteReady()
+	answer, err := receiver.CreateAnswer(nil)
+	if err != nil {
+		return res, err
+	}
+	if err := receiver.SetLocalDescription(answer); err != nil {
+		return res, err
+	}
+	if err := sender.SetRemoteDescription(answer); err != nil {
+		return res, err
+	}
+	ts.remoteReady()
+	ts.localReady()
+	tr.localReady()
+
+	select {
+	case <-open:
+	case <-time.After(10 * time.Second):
+		return res, errors.New("self-test: data channel did not open within 10s")
+	}
+	if opts.Show {
+		render.HideCursor()
+		render.ClearTerminal()
+		defer render.ShowCursor()
+	}
+
+	start := time.Now()
+	tick := time.NewTicker(time.Second / time.Duration(opts.FPS))
+	defer tick.Stop()
+	for n := 0; time.Since(start) < opts.Duration; n++ {
+		<-tick.C
+		if dc.BufferedAmount() > bufferedHigh {
+			res.Dropped++
+			continue
+		}
+		at := time.Now()
+		frame, err := gocv.NewMatFromBytes(patternHeight, patternWidth, gocv.MatTypeCV8UC3, testPattern(n, patternWidth, patternHeight))
+		if err != nil {
+			return res, err
+		}
+		ascii := render.ConvertFrameToASCIIWithQuality(frame, opts.Quality)
+		frame.Close()
+		mu.Lock()
+		sent++
+		mu.Unlock()
+		if err := dc.SendText(stampFrame(ascii, at)); err != nil {
+			return res, err
+		}
+	}
+
+	// Let frames in flight arrive
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		mu.Lock()
+		done := received >= sent
+		mu.Unlock()
+		if done {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	res.Elapsed = time.Since(start)
+	res.Sent, res.Received, res.Bytes = sent, received, bytes
+	res.Latency = sorted(latency)
+	if res.Received == 0 {
+		return res, errors.New("self-test: no frames received")
+	}
+	return res, nil
+}
+
+// testPattern draws frame n of a moving test card as BGR bytes: color bars
+// scrolling sideways, a gray ramp along the bottom and a white square
+// bouncing across them
+func testPattern(n, w, h int) []byte {
+	bars := [][3]byte{
+		{255, 255, 255}, {0, 255, 255}, {255, 255, 0}, {0, 255, 0},
+		{255, 0, 255}, {0, 0, 255}, {255, 0, 0}, {0, 0, 0},
+	}
+	buf := make([]byte, w*h*3)
+	barWidth := w / len(bars)
+	shift := n * 4
+
+	size := h / 5
+	span := w - size
+	x0 := (n * 8) % (2 * span)
+	if x0 > span {
+		x0 = 2*span - x0
+	}
+	y0 := h/2 - size/2
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var px [3]byte
+			switch {
+			case x >= x0 && x < x0+size && y >= y0 && y < y0+size:
+				px = [3]byte{255, 255, 255}
+			case y >= h*4/5:
+				v := byte(x * 255 / w)
+				px = [3]byte{v, v, v}
+			default:
+				px = bars[((x+shift)/barWidth)%len(bars)]
+			}
+			copy(buf[(y*w+x)*3:], px[:])
+		}
+	}
+	return buf
+}
@@ -0,0 +1,65 @@
+package webrtc
+
+import (
+	"log"
+	"time"
+
+	"github.com/saswatsam786/snapshell/internal/capture"
+	"github.com/saswatsam786/snapshell/internal/render"
+
+	"github.com/pion/webrtc/v4"
+	"gocv.io/x/gocv"
+)
+
+// streamWebcam captures webcam frames and sends them as ASCII on dc until
+// the call ends. The frame geometry, color depth and rate follow qc; a
+// keyframe request sends the next frame immediately.
+func (c *call) streamWebcam(dc *webrtc.DataChannel, qc *QualityController) {
+	webcam, err := capture.OpenWebCam()
+	if err != nil {
+		log.Println("webcam:", err)
+		return
+	}
+	defer webcam.Close()
+
+	webcam.SetProperty(gocv.VideoCaptureFPS, 10)
+	webcam.SetProperty(gocv.VideoCaptureFrameWidth, 640)
+	webcam.SetProperty(gocv.VideoCaptureFrameHeight, 480)
+
+	go qc.Run(c.ctx)
+
+	send := func() {
+		if c.videoMuted() {
+			return
+		}
+		frame, err := webcam.ReadFrame()
+		if err != nil {
+			return
+		}
+		captured := time.Now()
+		ascii := render.ConvertFrameToASCIIWithQuality(frame, qc.Quality())
+		if c.audience != nil {
+			c.audience.sendFrame(frame, captured)
+		}
+		frame.Close()
+		if c.peerHas("timestamps") {
+			ascii = stampFrame(ascii, captured)
+		}
+		_ = dc.SendText(ascii)
+	}
+
+	t := time.NewTicker(qc.Interval())
+	defer t.Stop()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-qc.Changed():
+			t.Reset(qc.Interval())
+		case <-c.keyframe:
+			send()
+		case <-t.C:
+			send()
+		}
+	}
+}
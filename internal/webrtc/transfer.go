@@ -0,0 +1,549 @@
+package webrtc
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/saswatsam786/snapshell/internal/render"
+
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	// fileLabelPrefix starts the label of every per-transfer data channel
+	fileLabelPrefix = "file:"
+
+	// fileChunkSize stays well under SCTP's 64KB message limit and matches
+	// the 16KB browsers can reliably interoperate with
+	fileChunkSize = 16 * 1024
+
+	// fileMaxBuffered bounds how much file data may queue in the shared SCTP
+	// association so video frames are never stuck behind it
+	fileMaxBuffered = 256 * 1024
+
+	// fileReplyTimeout is how long the sender waits for the peer to verify
+	fileReplyTimeout = 2 * time.Minute
+)
+
+// fileMessage is the JSON control traffic on a transfer channel; file data
+// itself is sent as binary messages
+type fileMessage struct {
+	Type   string `json:"type"` // offer|accept|decline|done|result
+	Name   string `json:"name,omitempty"`
+	Size   int64  `json:"size,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+	Offset int64  `json:"offset,omitempty"` // accept: resume from here
+	OK     bool   `json:"ok,omitempty"`     // result
+	Error  string `json:"error,omitempty"`  // result
+}
+
+// Transfer tracks one file being sent or received
+type Transfer struct {
+	ID       string
+	Name     string
+	Size     int64
+	Outgoing bool
+
+	mu      sync.Mutex
+	done    int64
+	state   string // waiting|sending|receiving|verifying|complete|declined|failed
+	started time.Time
+	resumed int64
+}
+
+func (t *Transfer) setState(state string) {
+	t.mu.Lock()
+	t.state = state
+	t.mu.Unlock()
+}
+
+func (t *Transfer) advance(n int64) {
+	t.mu.Lock()
+	t.done += n
+	t.mu.Unlock()
+}
+
+// Finished reports whether the transfer has reached a terminal state
+func (t *Transfer) Finished() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.state == "complete" || t.state == "declined" || t.state == "failed"
+}
+
+// Format renders a one-line progress bar for the transfer
+func (t *Transfer) Format(width int) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	arrow := "↓"
+	if t.Outgoing {
+		arrow = "↑"
+	}
+	rate := ""
+	if !t.started.IsZero() {
+		if secs := time.Since(t.started).Seconds(); secs > 0 {
+			rate = formatBytes(int64(float64(t.done-t.resumed)/secs)) + "/s"
+		}
+	}
+	pct := 100
+	if t.Size > 0 {
+		pct = int(t.done * 100 / t.Size)
+	}
+	bar := render.ProgressBar(t.done, t.Size, 20)
+	return render.Truncate(fmt.Sprintf("%s %s %s %3d%% %s %s %s",
+		arrow, t.Name, bar, pct, formatBytes(t.Size), rate, t.state), width)
+}
+
+// formatBytes renders n as a human readable size
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%cB", float64(n)/float64(div), "KMGT"[exp])
+}
+
+// addTransfer registers t for the overlay
+func (c *call) addTransfer(t *Transfer) {
+	c.mu.Lock()
+	c.transfers = append(c.transfers, t)
+	c.mu.Unlock()
+}
+
+// activeTransfers returns transfers that are in progress or just finished
+func (c *call) activeTransfers() []*Transfer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var out []*Transfer
+	for _, t := range c.transfers {
+		if !t.Finished() {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// sendFile offers path to the peer on a new data channel and streams it
+// once accepted. It blocks until the peer has verified the file.
+func (c *call) sendFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if st.IsDir() {
+		return fmt.Errorf("%s is a directory", path)
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+
+	t := &Transfer{ID: randID(), Name: filepath.Base(path), Size: st.Size(), Outgoing: true, state: "waiting"}
+	c.addTransfer(t)
+
+	ordered := true
+	dc, err := c.pc.CreateDataChannel(fileLabelPrefix+t.ID, &webrtc.DataChannelInit{Ordered: &ordered})
+	if err != nil {
+		t.setState("failed")
+		return err
+	}
+	defer dc.Close()
+
+	replies := make(chan fileMessage, 4)
+	opened := make(chan struct{})
+	lowWater := make(chan struct{}, 1)
+
+	dc.SetBufferedAmountLowThreshold(fileMaxBuffered / 2)
+	dc.OnBufferedAmountLow(func() {
+		select {
+		case lowWater <- struct{}{}:
+		default:
+		}
+	})
+	dc.OnOpen(func() { close(opened) })
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		var m fileMessage
+		if msg.IsString && json.Unmarshal(msg.Data, &m) == nil {
+			replies <- m
+		}
+	})
+
+	wait := func(timeout time.Duration) (fileMessage, error) {
+		var expire <-chan time.Time
+		if timeout > 0 {
+			expire = time.After(timeout)
+		}
+		select {
+		case m := <-replies:
+			return m, nil
+		case <-expire:
+			return fileMessage{}, errors.New("peer did not respond")
+		case <-c.ctx.Done():
+			return fileMessage{}, c.ctx.Err()
+		}
+	}
+	fail := func(err error) error {
+		t.setState("failed")
+		c.redrawOverlay()
+		return err
+	}
+
+	select {
+	case <-opened:
+	case <-c.ctx.Done():
+		return fail(c.ctx.Err())
+	}
+	offer, _ := json.Marshal(fileMessage{Type: "offer", Name: t.Name, Size: t.Size, SHA256: sum})
+	if err := dc.SendText(string(offer)); err != nil {
+		return fail(err)
+	}
+
+	// No timeout: the peer may take a while to decide
+	reply, err := wait(0)
+	if err != nil {
+		return fail(err)
+	}
+	if reply.Type != "accept" {
+		t.setState("declined")
+		c.redrawOverlay()
+		return errors.New("peer declined " + t.Name)
+	}
+	if reply.Offset < 0 || reply.Offset > t.Size {
+		reply.Offset = 0
+	}
+	if _, err := f.Seek(reply.Offset, io.SeekStart); err != nil {
+		return fail(err)
+	}
+
+	t.mu.Lock()
+	t.state, t.started, t.done, t.resumed = "sending", time.Now(), reply.Offset, reply.Offset
+	t.mu.Unlock()
+
+	buf := make([]byte, fileChunkSize)
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			if err := c.waitForRoom(dc, lowWater); err != nil {
+				return fail(err)
+			}
+			if err := dc.Send(buf[:n]); err != nil {
+				return fail(err)
+			}
+			t.advance(int64(n))
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fail(err)
+		}
+	}
+
+	done, _ := json.Marshal(fileMessage{Type: "done"})
+	if err := dc.SendText(string(done)); err != nil {
+		return fail(err)
+	}
+	t.setState("verifying")
+	result, err := wait(fileReplyTimeout)
+	if err != nil {
+		return fail(err)
+	}
+	if !result.OK {
+		return fail(errors.New("peer rejected " + t.Name + ": " + result.Error))
+	}
+	t.setState("complete")
+	c.redrawOverlay()
+	return nil
+}
+
+// waitForRoom blocks while the transfer channel has too much queued, and
+// while video frames are waiting, so file data never starves the stream
+func (c *call) waitForRoom(dc *webrtc.DataChannel, lowWater <-chan struct{}) error {
+	for dc.BufferedAmount() > fileMaxBuffered {
+		select {
+		case <-lowWater:
+		case <-time.After(100 * time.Millisecond):
+		case <-c.ctx.Done():
+			return c.ctx.Err()
+		}
+	}
+	for {
+		qc := c.quality()
+		if qc == nil || qc.dc.BufferedAmount() < bufferedLow {
+			return nil
+		}
+		select {
+		case <-time.After(10 * time.Millisecond):
+		case <-c.ctx.Done():
+			return c.ctx.Err()
+		}
+	}
+}
+
+// incomingFile is a transfer offered by the peer. Its methods are called
+// from the data channel callbacks and from /accept, hence the mutex.
+type incomingFile struct {
+	c     *call
+	t     *Transfer
+	dc    *webrtc.DataChannel
+	offer fileMessage
+
+	mu   sync.Mutex
+	part *os.File
+}
+
+// receiveFile handles a transfer channel opened by the peer: it waits for
+// the offer and asks the user to accept or decline it. An offer whose
+// channel closes before it is answered is withdrawn.
+func (c *call) receiveFile(dc *webrtc.DataChannel) {
+	// set by the offer; pion runs OnMessage and OnClose on different
+	// goroutines, so in is guarded by c.mu
+	var in *incomingFile
+	incoming := func() *incomingFile {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return in
+	}
+
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		if !msg.IsString {
+			if in := incoming(); in != nil {
+				in.write(msg.Data)
+			}
+			return
+		}
+
+		var m fileMessage
+		if err := json.Unmarshal(msg.Data, &m); err != nil {
+			return
+		}
+		switch m.Type {
+		case "offer":
+			name := filepath.Base(m.Name)
+			if name == "." || name == string(filepath.Separator) || strings.HasPrefix(name, ".") {
+				name = "snapshell-" + randID()
+			}
+			offered := &incomingFile{
+				c:     c,
+				t:     &Transfer{ID: strings.TrimPrefix(dc.Label(), fileLabelPrefix), Name: name, Size: m.Size, state: "waiting"},
+				dc:    dc,
+				offer: m,
+			}
+			c.mu.Lock()
+			if in != nil {
+				// one offer per channel
+				c.mu.Unlock()
+				return
+			}
+			in = offered
+			c.pendingFiles = append(c.pendingFiles, offered)
+			c.mu.Unlock()
+			c.addTransfer(offered.t)
+			c.notify(fmt.Sprintf("peer wants to send %s (%s) — /accept or /decline", name, formatBytes(m.Size)))
+		case "done":
+			if in := incoming(); in != nil {
+				in.finish()
+			}
+		}
+	})
+	dc.OnClose(func() {
+		c.mu.Lock()
+		closed, pending := in, false
+		for i, p := range c.pendingFiles {
+			if p == closed {
+				c.pendingFiles = append(c.pendingFiles[:i], c.pendingFiles[i+1:]...)
+				pending = true
+				break
+			}
+		}
+		c.mu.Unlock()
+		switch {
+		case pending:
+			closed.t.setState("failed")
+			c.notify(closed.t.Name + " was withdrawn")
+		case closed != nil:
+			closed.abort()
+		}
+	})
+}
+
+func (in *incomingFile) reply(m fileMessage) {
+	b, _ := json.Marshal(m)
+	_ = in.dc.SendText(string(b))
+}
+
+// accept opens (or reopens) the .part file and tells the peer where to
+// resume from
+func (in *incomingFile) accept() {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	f, offset, err := openPartFile(in.t.Name, in.t.Size)
+	if err != nil {
+		in.t.setState("failed")
+		in.reply(fileMessage{Type: "decline"})
+		go in.c.notify("cannot save " + in.t.Name + ": " + err.Error())
+		return
+	}
+	in.part = f
+	in.t.mu.Lock()
+	in.t.state, in.t.started, in.t.done, in.t.resumed = "receiving", time.Now(), offset, offset
+	in.t.mu.Unlock()
+	in.reply(fileMessage{Type: "accept", Offset: offset})
+}
+
+func (in *incomingFile) decline() {
+	in.t.setState("declined")
+	in.reply(fileMessage{Type: "decline"})
+}
+
+func (in *incomingFile) write(data []byte) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if in.part == nil {
+		return
+	}
+	if _, err := in.part.Write(data); err != nil {
+		in.t.setState("failed")
+		in.reply(fileMessage{Type: "result", Error: err.Error()})
+		in.part.Close()
+		in.part = nil
+		return
+	}
+	in.t.advance(int64(len(data)))
+}
+
+// finish verifies the received file and moves it into place
+func (in *incomingFile) finish() {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if in.part == nil {
+		return
+	}
+	in.t.setState("verifying")
+	in.part.Close()
+	in.part = nil
+
+	saved, err := finishPartFile(in.t.Name, in.offer.SHA256)
+	if err != nil {
+		in.t.setState("failed")
+		in.reply(fileMessage{Type: "result", Error: err.Error()})
+		go in.c.notify(in.t.Name + ": " + err.Error())
+		return
+	}
+	in.t.setState("complete")
+	in.reply(fileMessage{Type: "result", OK: true})
+	go in.c.notify("saved " + saved)
+}
+
+// abort runs when the channel closes mid-transfer; the .part file is kept
+// so the next attempt can resume
+func (in *incomingFile) abort() {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if in.part != nil {
+		in.part.Close()
+		in.part = nil
+		in.t.setState("failed")
+	}
+}
+
+// answerFile accepts or declines the oldest pending transfer offer
+func (c *call) answerFile(accept bool) {
+	c.mu.Lock()
+	if len(c.pendingFiles) == 0 {
+		c.mu.Unlock()
+		c.notify("no pending file offers")
+		return
+	}
+	in := c.pendingFiles[0]
+	c.pendingFiles = c.pendingFiles[1:]
+	c.mu.Unlock()
+
+	if accept {
+		in.accept()
+		return
+	}
+	in.decline()
+	c.notify("declined " + in.t.Name)
+}
+
+// openPartFile opens name.part for appending and returns the offset to
+// resume from. A part file larger than the offer is stale and restarted.
+func openPartFile(name string, size int64) (*os.File, int64, error) {
+	f, err := os.OpenFile(name+".part", os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, 0, err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	offset := st.Size()
+	if offset > size {
+		if err := f.Truncate(0); err != nil {
+			f.Close()
+			return nil, 0, err
+		}
+		offset = 0
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, offset, nil
+}
+
+// finishPartFile checks name.part against the expected SHA-256 and renames
+// it to a free file name, returning the name it was saved as
+func finishPartFile(name, want string) (string, error) {
+	part := name + ".part"
+	f, err := os.Open(part)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	f.Close()
+	if err != nil {
+		return "", err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != want {
+		// A corrupt part file cannot be resumed from
+		os.Remove(part)
+		return "", errors.New("sha256 mismatch")
+	}
+
+	saved := name
+	ext := filepath.Ext(name)
+	for i := 1; ; i++ {
+		if _, err := os.Stat(saved); os.IsNotExist(err) {
+			break
+		}
+		saved = fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), i, ext)
+	}
+	return saved, os.Rename(part, saved)
+}
@@ -0,0 +1,143 @@
+package webrtc
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// trickle sends local ICE candidates to the signaler as they are gathered,
+// instead of waiting for gathering to complete, and applies the peer's
+// candidates once a remote description exists to attach them to.
+//
+// The signaler clears a side's candidate backlog when that side posts its
+// SDP, so local candidates are held back until localReady is called.
+// Candidates carry the ICE username fragment they were gathered for, so
+// after an ICE restart ones for the new generation wait for the new remote
+// description and stale ones are dropped.
+type trickle struct {
+	pc   *webrtc.PeerConnection
+	path *ICEPath
+	post func(candB64 string) error
+
+	// postMu keeps posts in gathering order so end-of-candidates is last
+	postMu sync.Mutex
+
+	mu     sync.Mutex
+	ready  bool
+	local  []string
+	remote []webrtc.ICECandidateInit
+}
+
+func newTrickle(pc *webrtc.PeerConnection, path *ICEPath, post func(string) error) *trickle {
+	t := &trickle{pc: pc, path: path, post: post}
+	pc.OnICECandidate(t.onLocal)
+	return t
+}
+
+func (t *trickle) onLocal(c *webrtc.ICECandidate) {
+	if !t.path.Allow(c) {
+		return
+	}
+	// A nil candidate means gathering finished; the peer learns this from
+	// an empty candidate (end-of-candidates)
+	init := webrtc.ICECandidateInit{}
+	if c != nil {
+		init = c.ToJSON()
+	}
+	if local := t.pc.LocalDescription(); local != nil {
+		if ufrag := sdpUfrag(local.SDP); ufrag != "" {
+			init.UsernameFragment = &ufrag
+		}
+	}
+	b64, err := Encode(init)
+	if err != nil {
+		return
+	}
+
+	t.mu.Lock()
+	if !t.ready {
+		t.local = append(t.local, b64)
+		t.mu.Unlock()
+		return
+	}
+	t.mu.Unlock()
+
+	t.postMu.Lock()
+	defer t.postMu.Unlock()
+	if err := t.post(b64); err != nil {
+		debugLog.Printf("ice: post candidate: %v", err)
+	}
+}
+
+// localReady is called once our offer/answer is posted; queued candidates
+// are sent and later ones go straight out
+func (t *trickle) localReady() {
+	t.postMu.Lock()
+	defer t.postMu.Unlock()
+
+	t.mu.Lock()
+	t.ready = true
+	queued := t.local
+	t.local = nil
+	t.mu.Unlock()
+
+	for _, b64 := range queued {
+		if err := t.post(b64); err != nil {
+			debugLog.Printf("ice: post candidate: %v", err)
+		}
+	}
+}
+
+// addRemote applies a candidate from the peer, or keeps it until the remote
+// description is set
+func (t *trickle) addRemote(b64 string) {
+	var init webrtc.ICECandidateInit
+	if err := Decode(b64, &init); err != nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if remote := t.pc.RemoteDescription(); remote == nil || !matchesUfrag(init, remote.SDP) {
+		t.remote = append(t.remote, init)
+		return
+	}
+	if err := t.pc.AddICECandidate(init); err != nil {
+		debugLog.Printf("ice: add candidate: %v", err)
+	}
+}
+
+// remoteReady is called after SetRemoteDescription to apply candidates that
+// arrived before it
+func (t *trickle) remoteReady() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	remote := t.pc.RemoteDescription()
+	for _, init := range t.remote {
+		if !matchesUfrag(init, remote.SDP) {
+			continue
+		}
+		if err := t.pc.AddICECandidate(init); err != nil {
+			debugLog.Printf("ice: add candidate: %v", err)
+		}
+	}
+	t.remote = nil
+}
+
+// sdpUfrag returns the ICE username fragment of a session description
+func sdpUfrag(sdp string) string {
+	for _, line := range strings.Split(sdp, "\n") {
+		if ufrag, ok := strings.CutPrefix(strings.TrimSpace(line), "a=ice-ufrag:"); ok {
+			return ufrag
+		}
+	}
+	return ""
+}
+
+// matchesUfrag reports whether a candidate belongs to the ICE generation of
+// sdp; untagged candidates always match
+func matchesUfrag(init webrtc.ICECandidateInit, sdp string) bool {
+	return init.UsernameFragment == nil || *init.UsernameFragment == "" || *init.UsernameFragment == sdpUfrag(sdp)
+}
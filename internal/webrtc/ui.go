@@ -0,0 +1,268 @@
+package webrtc
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/saswatsam786/snapshell/internal/render"
+)
+
+const (
+	// chatOverlayLines is how many recent chat lines are drawn over the video
+	chatOverlayLines = 5
+	// chatOverlayTTL hides chat lines after a while so they do not cover the
+	// peer's face for the rest of the call
+	chatOverlayTTL = 30 * time.Second
+)
+
+const inputHelp = "commands: /send <path>  /accept  /decline  /mute (toggle camera)  /mic  /speaker  /quit  /help — anything else is sent as chat"
+
+// showFrame draws a received frame followed by the overlay. clear wipes the
+// screen first instead of drawing over the previous frame. Frames stamped
+// with their capture time count towards the glass-to-glass latency.
+func (c *call) showFrame(data []byte, clear bool) {
+	captured, data, stamped := unstampFrame(data)
+	c.firstFrame.Do(func() {
+		c.mu.Lock()
+		c.drawing = true
+		c.mu.Unlock()
+		ttff := time.Since(c.started)
+		debugLog.Printf("time to first frame: %s", ttff)
+		go c.notify(fmt.Sprintf("first frame after %.2fs", ttff.Seconds()))
+	})
+	if c.opts.SendFile != "" {
+		return
+	}
+	c.drawMu.Lock()
+	defer c.drawMu.Unlock()
+	if clear {
+		render.ClearTerminal()
+	} else {
+		render.MoveCursorToTop()
+	}
+	fmt.Print(string(data))
+	if stamped {
+		c.frameShown(captured)
+	}
+	c.drawOverlayLocked()
+}
+
+// redrawOverlay refreshes the status bar, input line and chat without
+// waiting for the next frame
+func (c *call) redrawOverlay() {
+	if c.opts.SendFile != "" {
+		return
+	}
+	c.drawMu.Lock()
+	defer c.drawMu.Unlock()
+	c.drawOverlayLocked()
+}
+
+func (c *call) drawOverlayLocked() {
+	c.drawVisualizerLocked()
+
+	width := render.TerminalWidth()
+	row := 0
+
+	if status := c.status(); status != "" {
+		render.DrawStatusBar(render.Truncate(status, width-2))
+	}
+	row++
+
+	c.mu.Lock()
+	input, chat := c.input, c.chat
+	notice, noticeAt := c.notice, c.noticeAt
+	reconnecting := c.reconnecting
+	c.mu.Unlock()
+
+	if !reconnecting.IsZero() {
+		banner := fmt.Sprintf(" ⟳ reconnecting… %ds ", int(time.Since(reconnecting).Seconds()))
+		_, height := render.GetTerminalSize()
+		col := (width-len([]rune(banner)))/2 + 1
+		render.DrawAt(height/2, max(col, 1), "\033[7m"+banner+"\033[0m")
+	}
+
+	if input != nil {
+		render.DrawBottomLine(row, input.Render(width))
+		row++
+	}
+
+	for _, t := range c.activeTransfers() {
+		render.DrawBottomLine(row, t.Format(width))
+		row++
+	}
+
+	var lines []string
+	if chat != nil {
+		for _, e := range chat.History() {
+			if time.Since(e.At) < chatOverlayTTL {
+				lines = append(lines, e.Format())
+			}
+		}
+	}
+	if notice != "" && time.Since(noticeAt) < chatOverlayTTL {
+		lines = append(lines, "* "+notice)
+	}
+	if len(lines) > chatOverlayLines {
+		lines = lines[len(lines)-chatOverlayLines:]
+	}
+	for i := len(lines) - 1; i >= 0; i-- {
+		render.DrawBottomLine(row, render.Truncate(lines[i], width))
+		row++
+	}
+}
+
+// notify shows a local message in the overlay
+func (c *call) notify(text string) {
+	c.mu.Lock()
+	c.notice, c.noticeAt = text, time.Now()
+	c.mu.Unlock()
+	c.redrawOverlay()
+}
+
+// startInput puts the terminal in raw mode and reads the input line until
+// the call ends. It does nothing when stdin is not a terminal.
+func (c *call) startInput() {
+	if c.opts.SendFile != "" {
+		return
+	}
+	c.mu.Lock()
+	if c.input != nil {
+		c.mu.Unlock()
+		return
+	}
+	restore, err := render.RawMode()
+	if err != nil {
+		c.mu.Unlock()
+		debugLog.Printf("input: %v", err)
+		return
+	}
+	c.input = render.NewLineEditor("> ")
+	c.restore = restore
+	input := c.input
+	c.mu.Unlock()
+
+	c.notify(inputHelp)
+
+	go func() {
+		buf := make([]byte, 256)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if err != nil || c.ctx.Err() != nil {
+				return
+			}
+			for _, line := range input.Feed(buf[:n]) {
+				c.handleLine(line)
+			}
+			c.redrawOverlay()
+		}
+	}()
+}
+
+// stopInput restores the terminal; safe to call if input never started
+func (c *call) stopInput() {
+	c.mu.Lock()
+	restore := c.restore
+	c.restore = nil
+	c.mu.Unlock()
+	if restore != nil {
+		restore()
+	}
+}
+
+// handleLine runs a /command or sends the line as chat
+func (c *call) handleLine(line string) {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "/") {
+		c.mu.Lock()
+		chat := c.chat
+		c.mu.Unlock()
+		if err := chat.Send(line); err != nil {
+			c.notify("chat: " + err.Error())
+		}
+		return
+	}
+
+	cmd, arg, _ := strings.Cut(line, " ")
+	switch cmd {
+	case "/send":
+		path := strings.TrimSpace(arg)
+		if path == "" {
+			c.notify("usage: /send <path>")
+			return
+		}
+		go func() {
+			if err := c.sendFile(path); err != nil {
+				c.notify("send " + path + ": " + err.Error())
+			} else {
+				c.notify("sent " + path)
+			}
+		}()
+	case "/accept":
+		c.answerFile(true)
+	case "/decline":
+		c.answerFile(false)
+	case "/quit", "/bye":
+		c.stop()
+	case "/mute":
+		muted := !c.videoMuted()
+		c.setVideoMuted(muted)
+		if muted {
+			c.notify("camera off")
+		} else {
+			c.notify("camera on")
+		}
+	case "/mic":
+		muted := !c.audioMuted()
+		c.setAudioMuted(muted)
+		if muted {
+			c.notify("microphone muted")
+		} else {
+			c.notify("microphone on")
+		}
+	case "/speaker":
+		muted, ok := c.toggleSpeaker()
+		switch {
+		case !ok:
+			c.notify("no audio from peer")
+		case muted:
+			c.notify("speaker off")
+		default:
+			c.notify("speaker on")
+		}
+	case "/help":
+		c.notify(inputHelp)
+	default:
+		c.notify("unknown command " + cmd + " — " + inputHelp)
+	}
+}
+
+// sendAndHangUp is the body of send mode: transfer one file, printing
+// progress on a single line, then end the call
+func (c *call) sendAndHangUp(path string) {
+	fmt.Printf("📤 Offering %s to peer, waiting for them to accept...\n", path)
+	done := make(chan error, 1)
+	go func() { done <- c.sendFile(path) }()
+
+	t := time.NewTicker(500 * time.Millisecond)
+	defer t.Stop()
+	for {
+		select {
+		case err := <-done:
+			fmt.Println()
+			if err != nil {
+				fmt.Println("❌", err)
+			} else {
+				fmt.Println("✅ Sent", path)
+			}
+			c.stop()
+			return
+		case <-t.C:
+			for _, tr := range c.activeTransfers() {
+				fmt.Printf("\r\033[2K%s", tr.Format(render.TerminalWidth()))
+			}
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package webrtc
+
+import (
+	"image"
+	"log"
+	"time"
+
+	"github.com/saswatsam786/snapshell/internal/capture"
+	"github.com/saswatsam786/snapshell/internal/render"
+	"github.com/saswatsam786/snapshell/internal/video"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+	"github.com/pion/webrtc/v4/pkg/media/samplebuilder"
+	"gocv.io/x/gocv"
+)
+
+const (
+	trackWidth       = 640
+	trackHeight      = 480
+	trackFPS         = 15
+	trackBitrateKbps = 600
+
+	// keyframeInterval limits how often a PLI may restart the encoder
+	keyframeInterval = time.Second
+)
+
+// setupVideoTrack adds a VP8 track when sending real video. Without one the
+// offerer still offers to receive video so either side can send it; video
+// from the peer is always decoded and drawn with our own render settings.
+func (c *call) setupVideoTrack(offerer bool) error {
+	if !c.opts.VideoTrack {
+		if offerer {
+			_, err := c.pc.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo,
+				webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly})
+			return err
+		}
+		return nil
+	}
+
+	track, err := webrtc.NewTrackLocalStaticSample(
+		webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, "video", "snapshell")
+	if err != nil {
+		return err
+	}
+	sender, err := c.pc.AddTrack(track)
+	if err != nil {
+		return err
+	}
+
+	// Keyframe requests from the peer arrive as RTCP
+	go func() {
+		for {
+			pkts, _, err := sender.ReadRTCP()
+			if err != nil {
+				return
+			}
+			for _, p := range pkts {
+				switch p.(type) {
+				case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+					c.requestKeyframe()
+				}
+			}
+		}
+	}()
+
+	c.mu.Lock()
+	c.videoTrack = track
+	c.mu.Unlock()
+	return nil
+}
+
+// streamVideoTrack captures webcam frames and sends them VP8-encoded on
+// track until the call ends
+func (c *call) streamVideoTrack(track *webrtc.TrackLocalStaticSample) {
+	webcam, err := capture.OpenWebCam()
+	if err != nil {
+		log.Println("webcam:", err)
+		return
+	}
+	defer webcam.Close()
+
+	webcam.SetProperty(gocv.VideoCaptureFPS, trackFPS)
+	webcam.SetProperty(gocv.VideoCaptureFrameWidth, trackWidth)
+	webcam.SetProperty(gocv.VideoCaptureFrameHeight, trackHeight)
+
+	var (
+		enc       *video.Encoder
+		restarted time.Time
+	)
+	start := func() error {
+		e, err := video.NewEncoder(trackWidth, trackHeight, trackFPS, trackBitrateKbps)
+		if err != nil {
+			return err
+		}
+		enc, restarted = e, time.Now()
+		go func() {
+			for {
+				frame, err := e.ReadFrame()
+				if err != nil {
+					return
+				}
+				_ = track.WriteSample(media.Sample{Data: frame, Duration: time.Second / trackFPS})
+			}
+		}()
+		return nil
+	}
+	if err := start(); err != nil {
+		log.Println("video:", err)
+		return
+	}
+	defer func() { enc.Close() }()
+
+	sized := gocv.NewMat()
+	defer sized.Close()
+
+	t := time.NewTicker(time.Second / trackFPS)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-c.keyframe:
+			// A fresh encoder always starts with a keyframe
+			if time.Since(restarted) < keyframeInterval {
+				continue
+			}
+			enc.Close()
+			if err := start(); err != nil {
+				log.Println("video:", err)
+				return
+			}
+		case <-t.C:
+			if c.videoMuted() {
+				continue
+			}
+			frame, err := webcam.ReadFrame()
+			if err != nil {
+				continue
+			}
+			gocv.Resize(frame, &sized, image.Point{X: trackWidth, Y: trackHeight}, 0, 0, gocv.InterpolationLinear)
+			frame.Close()
+			if err := enc.WriteFrame(sized.ToBytes()); err != nil {
+				debugLog.Printf("video: encode: %v", err)
+			}
+		}
+	}
+}
+
+// renderVideoTrack decodes the peer's VP8 track and draws it as ASCII using
+// our terminal size, color mode and charset
+func (c *call) renderVideoTrack(track *webrtc.TrackRemote) {
+	sb := samplebuilder.New(64, &codecs.VP8Packet{}, track.Codec().ClockRate)
+
+	var (
+		dec     *video.Decoder
+		lastPLI time.Time
+	)
+	defer func() {
+		if dec != nil {
+			dec.Close()
+		}
+	}()
+
+	for c.ctx.Err() == nil {
+		pkt, _, err := track.ReadRTP()
+		if err != nil {
+			return
+		}
+		sb.Push(pkt)
+		for s := sb.Pop(); s != nil; s = sb.Pop() {
+			if w, h, ok := video.KeyframeSize(s.Data); ok && (dec == nil || w != dec.Width || h != dec.Height) {
+				if dec != nil {
+					dec.Close()
+				}
+				if dec, err = video.NewDecoder(w, h); err != nil {
+					log.Println("video:", err)
+					return
+				}
+				go c.drawDecoded(dec)
+			}
+			if dec == nil {
+				// Cannot decode until a keyframe arrives; ask for one
+				if time.Since(lastPLI) > keyframeInterval {
+					lastPLI = time.Now()
+					_ = c.pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(track.SSRC())}})
+				}
+				continue
+			}
+			if err := dec.WriteFrame(s.Data); err != nil {
+				debugLog.Printf("video: decode: %v", err)
+			}
+		}
+	}
+}
+
+func (c *call) drawDecoded(dec *video.Decoder) {
+	for {
+		bgr, err := dec.ReadFrame()
+		if err != nil {
+			return
+		}
+		mat, err := gocv.NewMatFromBytes(dec.Height, dec.Width, gocv.MatTypeCV8UC3, bgr)
+		if err != nil {
+			continue
+		}
+		ascii := render.ConvertFrameToASCIIWithQuality(mat, c.renderQuality())
+		mat.Close()
+		c.showFrame([]byte(ascii), false)
+	}
+}
+
+// renderQuality is how we draw video we decode ourselves: the terminal
+// minus the visualizer strip, in the color mode and charset the user chose
+func (c *call) renderQuality() render.Quality {
+	q := render.TerminalQuality()
+	if remote, _ := c.meters(); remote != nil {
+		q.Width -= vizWidth
+	}
+	q.Color = c.opts.Color
+	q.Charset = render.Charsets[c.opts.Charset]
+	return q
+}
@@ -0,0 +1,88 @@
+package webrtc
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/saswatsam786/snapshell/internal/audio"
+	"github.com/saswatsam786/snapshell/internal/render"
+)
+
+const (
+	vizBands   = 16
+	vizHeight  = 8
+	vizRefresh = 100 * time.Millisecond
+
+	// vizWidth is the number of columns reserved at the right edge of the
+	// screen: the peer's spectrum, a gap, our level and a margin
+	vizWidth = vizBands + 3
+)
+
+// enableVisualizer creates the meters on first use and keeps the strip
+// refreshed even when no video frames arrive (e.g. peer camera off)
+func (c *call) enableVisualizer() {
+	c.vizOnce.Do(func() {
+		c.mu.Lock()
+		c.remoteMeter = audio.NewMeter(vizBands)
+		c.localMeter = audio.NewMeter(1)
+		c.mu.Unlock()
+
+		// Make room for the strip next to the peer's video
+		c.sendViewport()
+
+		go func() {
+			t := time.NewTicker(vizRefresh)
+			defer t.Stop()
+			for {
+				select {
+				case <-c.ctx.Done():
+					return
+				case <-t.C:
+					c.redrawOverlay()
+				}
+			}
+		}()
+	})
+}
+
+func (c *call) meters() (remote, local *audio.Meter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.remoteMeter, c.localMeter
+}
+
+// drawVisualizerLocked draws the peer's spectrum and our level as a strip
+// of block characters in the top right corner. Caller holds drawMu.
+func (c *call) drawVisualizerLocked() {
+	remote, local := c.meters()
+	if remote == nil {
+		return
+	}
+	col := render.TerminalWidth() - vizWidth + 1
+	if col < 1 {
+		return
+	}
+
+	peer := render.BarRows(remote.Spectrum(), vizHeight)
+	me := render.BarRows([]float64{local.Level()}, vizHeight)
+	for r := 0; r < vizHeight; r++ {
+		render.DrawAt(r+1, col, "\033[32m"+peer[r]+"\033[0m \033[36m"+me[r]+"\033[0m")
+	}
+	render.DrawAt(vizHeight+1, col, fmt.Sprintf("%-*s %s", vizBands, "peer", "me"))
+}
+
+// speakingStatus returns the speaking indicator for the status bar
+func (c *call) speakingStatus() string {
+	remote, local := c.meters()
+	if remote == nil {
+		return ""
+	}
+	s := ""
+	if remote.Speaking() {
+		s += " | 🗣 peer speaking"
+	}
+	if local.Speaking() {
+		s += " | 🎙 you"
+	}
+	return s
+}